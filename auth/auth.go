@@ -1,19 +1,17 @@
 package auth
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"net/http"
 	"nojoke/lib"
-	"os"
+	"nojoke/openapi"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 )
 
-var jwtSecret = os.Getenv("JWT_SECRET")
-
 type AdminForm struct {
 	Username string `json:"username" validate:"required"`
 	Email    string `json:"email" validate:"required|email"`
@@ -37,30 +35,15 @@ type JWTResponse struct {
 	JwtPayload AdminResponse `json:"user"`
 }
 
-func createAdminTable(database *sql.DB, logger *lib.Logger) {
-	query := CreateAdminTableQuery
-	_, err := database.Exec(query)
-	if err != nil {
-		logger.Error("Error creating admin table" + err.Error())
-		return
-	}
-	logger.Info("Admin table created")
-}
-
-func getAdminByUserName(database *sql.DB, username string) (Admin, error) {
+func getAdminByUserName(ctx context.Context, database *sql.DB, username string) (Admin, error) {
 	query := `
 		SELECT username, email, password
 		FROM Admin
 		WHERE username= $1
 	`
-	tx, err := database.Begin()
-	if err != nil {
-		tx.Rollback()
-		return Admin{}, err
-	}
-	row := database.QueryRow(query, username)
+	row := database.QueryRowContext(ctx, query, username)
 	var admin Admin
-	err = row.Scan(&admin.Username, &admin.Email, &admin.Password)
+	err := row.Scan(&admin.Username, &admin.Email, &admin.Password)
 	return admin, err
 }
 
@@ -68,28 +51,24 @@ func signUpHandler(database *sql.DB, logger *lib.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		var admin AdminForm
-		err := json.NewDecoder(r.Body).Decode(&admin)
+		err := lib.DecodeBody(r, &admin)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid form"))
+			lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid form"))
 			return
 		}
 		isValid, message := lib.ValidateForm(admin)
 
 		if !isValid {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(lib.NewErrorResponse(400, message))
+			lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, message))
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
 		hashedPassword := lib.HashPassword(admin.Password)
-		tx, err := database.Begin()
+		tx, err := database.BeginTx(r.Context(), nil)
 		if err != nil {
 			tx.Rollback()
-			logger.Error(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error creating transaction"+err.Error()))
+			logger.ErrorContext(r.Context(), err.Error())
+			lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error creating transaction"+err.Error()))
 			return
 		}
 
@@ -97,15 +76,14 @@ func signUpHandler(database *sql.DB, logger *lib.Logger) http.HandlerFunc {
 			SELECT username, email
 			FROM Admin
 			WHERE username = $1 OR email = $2`
-		existingAdmin := tx.QueryRow(checkExistQuery, admin.Username, admin.Email)
+		existingAdmin := tx.QueryRowContext(r.Context(), checkExistQuery, admin.Username, admin.Email)
 		var existingUsername string
 		var existingEmail string
 		err = existingAdmin.Scan(&existingUsername, &existingEmail)
 
 		if err == nil {
 			tx.Rollback()
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Username or email already exists"))
+			lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Username or email already exists"))
 			return
 		}
 		query := `
@@ -113,48 +91,45 @@ func signUpHandler(database *sql.DB, logger *lib.Logger) http.HandlerFunc {
 			VALUES ($1, $2, $3)
 			RETURNING username, email
 		`
-		row := tx.QueryRow(query, admin.Username, admin.Email, string(hashedPassword))
+		row := tx.QueryRowContext(r.Context(), query, admin.Username, admin.Email, string(hashedPassword))
 		err = row.Scan(&admin.Username, &admin.Email)
 		if err != nil {
 			tx.Rollback()
-			logger.Error(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error creating admin"+err.Error()))
+			logger.ErrorContext(r.Context(), err.Error())
+			lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error creating admin"+err.Error()))
 			return
 		}
 		err = tx.Commit()
 		if err != nil {
 			tx.Rollback()
-			logger.Error(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error creating admin"+err.Error()))
+			logger.ErrorContext(r.Context(), err.Error())
+			lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error creating admin"+err.Error()))
 			return
 		}
-		json.NewEncoder(w).Encode(lib.NewDataResponse(200, "Success", AdminResponse{
+		lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "Success", AdminResponse{
 			Username: admin.Username,
 			Email:    admin.Email,
 		}))
 	}
 }
 
-func signInHandler(database *sql.DB, logger *lib.Logger) http.HandlerFunc {
+func signInHandler(database *sql.DB, logger *lib.Logger, config *lib.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		var creds lib.Credentials
-		err := json.NewDecoder(r.Body).Decode(&creds)
+		err := lib.DecodeBody(r, &creds)
 		if err != nil {
-			logger.Error(err.Error())
+			logger.ErrorContext(r.Context(), err.Error())
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		admin, err := getAdminByUserName(database, creds.Username)
+		admin, err := getAdminByUserName(r.Context(), database, creds.Username)
 		isMatch := lib.CheckHashAndPassword(creds.Password, admin.Password)
 		if err != nil || !isMatch {
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(lib.NewErrorResponse(401, "Invalid credentials"))
+			lib.Render(w, r, http.StatusUnauthorized, lib.NewErrorResponse(401, "Invalid credentials"))
 			return
 		}
-		expirationTime := time.Now().Add(5 * time.Minute)
+		expirationTime := time.Now().Add(config.Auth.TokenTTL)
 		claims := &lib.Claims{
 			Username: creds.Username,
 			RegisteredClaims: jwt.RegisteredClaims{
@@ -162,9 +137,9 @@ func signInHandler(database *sql.DB, logger *lib.Logger) http.HandlerFunc {
 			},
 		}
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString([]byte(jwtSecret))
+		tokenString, err := token.SignedString([]byte(config.Auth.JWTSecret))
 		if err != nil {
-			logger.Error("" + err.Error())
+			logger.ErrorContext(r.Context(), "Error signing token", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -175,7 +150,7 @@ func signInHandler(database *sql.DB, logger *lib.Logger) http.HandlerFunc {
 			Expires: expirationTime,
 		})
 
-		json.NewEncoder(w).Encode(JWTResponse{
+		lib.Render(w, r, http.StatusOK, JWTResponse{
 			Token:     tokenString,
 			ExpiresAt: expirationTime,
 			JwtPayload: AdminResponse{
@@ -186,9 +161,11 @@ func signInHandler(database *sql.DB, logger *lib.Logger) http.HandlerFunc {
 	}
 }
 
-func InitAuthRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger) {
-	createAdminTable(database, logger)
+func InitAuthRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config) {
 	router := mux.PathPrefix("/api/auth").Subrouter()
-	router.HandleFunc("/signup", signUpHandler(database, logger)).Methods("POST")
-	router.HandleFunc("/signin", signInHandler(database, logger)).Methods("POST")
+	router.Use(lib.Negotiate)
+	openapi.Describe(router.HandleFunc("/signup", signUpHandler(database, logger)).Methods("POST"),
+		openapi.Operation{Summary: "Register an admin", Request: AdminForm{}, Response: AdminResponse{}})
+	openapi.Describe(router.HandleFunc("/signin", signInHandler(database, logger, config)).Methods("POST"),
+		openapi.Operation{Summary: "Sign in and receive a JWT", Request: lib.Credentials{}, Response: JWTResponse{}, Raw: true})
 }
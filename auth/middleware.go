@@ -8,22 +8,55 @@ type AuthenticatedHandler func(http.ResponseWriter, *http.Request, *Admin)
 
 type AuthMiddleware struct {
 	handler AuthenticatedHandler
+	// verifies the JWT when set, see Verified
+	secret string
 }
 
 func (am *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if am.secret != "" {
+		am.handler(w, r, AdminFromRequest(r, am.secret))
+		return
+	}
 	// get jwt
 	// check if jwt is valid
 	// if valid, get admin
 	// if not, redirect to guest page
-	jwt := r.Header.Get("Authorization")
-	admin := Admin{}
-	if jwt == "" {
-		am.handler(w, r, nil)
-		return
+	am.handler(w, r, AdminFromHeader(r.Header.Get("Authorization")))
+}
+
+// AdminFromHeader returns the admin for an Authorization header value, nil
+// for guests
+func AdminFromHeader(authorization string) *Admin {
+	if authorization == "" {
+		return nil
 	}
-	am.handler(w, r, &admin)
+	return &Admin{}
+}
+
+// AdminFromRequest returns the admin named by a JWT on r signed with
+// secret, nil for guests and for tokens that are invalid or expired
+func AdminFromRequest(r *http.Request, secret string) *Admin {
+	return AdminFromToken(TokenFromRequest(r), secret)
+}
+
+// AdminFromToken is AdminFromRequest for a bare JWT
+func AdminFromToken(token string, secret string) *Admin {
+	if token == "" {
+		return nil
+	}
+	claims, err := ParseToken(token, secret)
+	if err != nil {
+		return nil
+	}
+	return &Admin{Username: claims.Username}
 }
 
 func Authenticated(handler AuthenticatedHandler) *AuthMiddleware {
-	return &AuthMiddleware{handler}
+	return &AuthMiddleware{handler: handler}
+}
+
+// Verified is Authenticated for routes that change shared state, handler
+// only gets an admin for a valid JWT signed with secret
+func Verified(secret string, handler AuthenticatedHandler) *AuthMiddleware {
+	return &AuthMiddleware{handler: handler, secret: secret}
 }
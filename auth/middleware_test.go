@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"nojoke/lib"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func sign(t *testing.T, secret string, ttl time.Duration) string {
+	t.Helper()
+	claims := &lib.Claims{
+		Username: "admin",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerified(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		admin         bool
+	}{
+		{"no header", "", false},
+		{"any value", "letmein", false},
+		{"wrong secret", "Bearer " + sign(t, "other", time.Minute), false},
+		{"expired", "Bearer " + sign(t, "secret", -time.Minute), false},
+		{"valid bearer", "Bearer " + sign(t, "secret", time.Minute), true},
+		{"valid bare token", sign(t, "secret", time.Minute), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *Admin
+			handler := Verified("secret", func(w http.ResponseWriter, r *http.Request, a *Admin) {
+				got = a
+			})
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if (got != nil) != tt.admin {
+				t.Fatalf("admin = %v, want %v", got, tt.admin)
+			}
+			if got != nil && got.Username != "admin" {
+				t.Errorf("username = %q", got.Username)
+			}
+		})
+	}
+}
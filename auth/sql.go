@@ -9,3 +9,26 @@ const CreateAdminTableQuery = `
 		create_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 `
+
+const DropAdminTableQuery = `
+	DROP TABLE IF EXISTS admin;
+`
+
+const RenameAdminCreateAtQuery = `
+	ALTER TABLE admin RENAME COLUMN create_at TO created_at;
+`
+
+const RevertAdminCreateAtQuery = `
+	ALTER TABLE admin RENAME COLUMN created_at TO create_at;
+`
+
+const AddAdminUpdatedAtQuery = `
+	ALTER TABLE admin ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+	CREATE TRIGGER admin_set_updated_at BEFORE UPDATE ON admin
+		FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+`
+
+const DropAdminUpdatedAtQuery = `
+	DROP TRIGGER IF EXISTS admin_set_updated_at ON admin;
+	ALTER TABLE admin DROP COLUMN IF EXISTS updated_at;
+`
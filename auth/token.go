@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"nojoke/lib"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenFromRequest returns the JWT issued by signInHandler, read from the
+// Authorization bearer header or the token cookie
+func TokenFromRequest(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if token, found := strings.CutPrefix(header, "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	if header != "" {
+		return header
+	}
+	if cookie, err := r.Cookie("token"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// ParseToken verifies the signature and expiry of tokenString
+func ParseToken(tokenString string, secret string) (*lib.Claims, error) {
+	claims := &lib.Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
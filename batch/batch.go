@@ -0,0 +1,325 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"nojoke/events"
+	"nojoke/lib"
+	"nojoke/openapi"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Request is one sub-request of a batch, Body is sent as JSON
+type Request struct {
+	// echoed in the response to tell items apart, the index when empty
+	Id      string            `json:"id"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+type Form struct {
+	// run every request in one database transaction, rolled back when any
+	// of them fails
+	Atomic   bool      `json:"atomic"`
+	Requests []Request `json:"requests"`
+}
+
+// Response is the outcome of one sub-request, Body is the JSON the route
+// answered with, or a string for anything else
+type Response struct {
+	Id      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    interface{}       `json:"body"`
+}
+
+type Result struct {
+	Atomic bool `json:"atomic"`
+	// false when an atomic batch was rolled back
+	Committed bool       `json:"committed"`
+	Responses []Response `json:"responses"`
+}
+
+// headers of the batch request that are not passed on to its items
+var batchOnlyHeaders = []string{
+	"Content-Length", "Content-Type", "Content-Encoding", "Accept", "Accept-Encoding",
+	"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since",
+}
+
+var errTooLarge = errors.New("batch: response too large")
+
+// response keeps what a route writes for one item, up to limit bytes
+type response struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (w *response) Header() http.Header {
+	return w.header
+}
+
+func (w *response) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *response) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.overflow || int64(w.body.Len()+len(b)) > w.limit {
+		w.overflow = true
+		w.body.Reset()
+		return 0, errTooLarge
+	}
+	return w.body.Write(b)
+}
+
+func (w *response) result(id string) Response {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	result := Response{Id: id, Status: w.status, Headers: map[string]string{}}
+	for _, name := range []string{"Location", "ETag", "Last-Modified", "Content-Type"} {
+		if value := w.header.Get(name); value != "" {
+			result.Headers[name] = value
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(w.header.Get("Content-Type"))
+	body := bytes.TrimSpace(w.body.Bytes())
+	switch {
+	case len(body) == 0:
+	case (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && json.Valid(body):
+		result.Body = json.RawMessage(body)
+	default:
+		result.Body = string(body)
+	}
+	return result
+}
+
+func validate(form Form, config lib.BatchConfig) error {
+	if len(form.Requests) == 0 {
+		return errors.New("requests is required")
+	}
+	if len(form.Requests) > config.MaxRequests {
+		return errors.New("At most " + strconv.Itoa(config.MaxRequests) + " requests are allowed in a batch")
+	}
+	for i, item := range form.Requests {
+		position := "requests[" + strconv.Itoa(i) + "]"
+		switch strings.ToUpper(item.Method) {
+		case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			return errors.New(position + ": method must be GET, POST, PUT, PATCH or DELETE")
+		}
+		u, err := url.Parse(item.Path)
+		if err != nil || u.Scheme != "" || u.Host != "" {
+			return errors.New(position + ": path must be a path such as /api/users")
+		}
+		// the router matches the decoded path, so /api/%62atch is /api/batch
+		p := path.Clean(u.Path)
+		if !strings.HasPrefix(p, "/api/") {
+			return errors.New(position + ": path must start with /api/")
+		}
+		if p == "/api/batch" {
+			return errors.New(position + ": batches cannot be nested")
+		}
+		if excluded(p) {
+			return errors.New(position + ": " + p + " cannot be batched")
+		}
+		if form.Atomic && !transactional(p) {
+			return errors.New(position + ": an atomic batch can only use " + strings.Join(transactionalPaths, ", "))
+		}
+	}
+	return nil
+}
+
+// excluded keeps out of batches the sign in routes, whose rate limit the
+// items would bypass, and the imports, exports and streams whose bodies are
+// too large to hold in memory
+func excluded(p string) bool {
+	if p == "/api/auth" || strings.HasPrefix(p, "/api/auth/") || p == "/api/stream" || strings.HasPrefix(p, "/api/stream/") {
+		return true
+	}
+	last := path.Base(p)
+	return last == "import" || last == "export"
+}
+
+// transactionalPaths are the routes whose queries go through lib.DB and so
+// join the transaction of an atomic batch, the others would commit on their
+// own
+var transactionalPaths = []string{"/api/users", "/api/products", "/api/collections"}
+
+func transactional(p string) bool {
+	for _, prefix := range transactionalPaths {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// newRequest builds the request for item with the credentials of the batch
+func newRequest(ctx context.Context, batch *http.Request, item Request) (*http.Request, error) {
+	var body io.Reader
+	if len(item.Body) > 0 && string(item.Body) != "null" {
+		body = bytes.NewReader(item.Body)
+	}
+	r, err := http.NewRequestWithContext(ctx, strings.ToUpper(item.Method), item.Path, body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header = batch.Header.Clone()
+	for _, name := range batchOnlyHeaders {
+		r.Header.Del(name)
+	}
+	r.Header.Set("Accept", "application/json")
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range item.Headers {
+		r.Header.Set(name, value)
+	}
+	r.RemoteAddr = batch.RemoteAddr
+	r.Host = batch.Host
+	return r, nil
+}
+
+// tooLarge answers an item whose response did not fit in limit bytes
+func tooLarge(id string, limit int64) Response {
+	message := "Response larger than " + strconv.FormatInt(limit, 10) + " bytes"
+	return Response{Id: id, Status: http.StatusRequestEntityTooLarge, Body: lib.NewErrorResponse(413, message)}
+}
+
+// run serves the items one after the other on router, an atomic batch stops
+// at the first item answered with an error status. Each response is kept
+// up to batch.max_response_bytes and all of them up to
+// batch.max_total_bytes, the items after that are not run.
+func run(ctx context.Context, router http.Handler, batch *http.Request, form Form, config lib.BatchConfig) []Response {
+	responses := []Response{}
+	left := config.MaxTotalBytes
+	for i, item := range form.Requests {
+		id := item.Id
+		if id == "" {
+			id = strconv.Itoa(i)
+		}
+		limit := config.MaxResponseBytes
+		if left < limit {
+			limit = left
+		}
+		r, err := newRequest(ctx, batch, item)
+		switch {
+		case err != nil:
+			responses = append(responses, Response{Id: id, Status: http.StatusBadRequest, Body: lib.NewErrorResponse(400, err.Error())})
+		case limit <= 0:
+			responses = append(responses, tooLarge(id, config.MaxTotalBytes))
+		default:
+			w := &response{header: http.Header{}, limit: limit}
+			router.ServeHTTP(w, r)
+			if w.overflow {
+				responses = append(responses, tooLarge(id, limit))
+			} else {
+				left -= int64(w.body.Len())
+				responses = append(responses, w.result(id))
+			}
+		}
+		if form.Atomic && responses[i].Status >= 400 {
+			break
+		}
+	}
+	return responses
+}
+
+// failed returns the index of the first item that failed, or -1
+func failed(responses []Response) int {
+	for i, response := range responses {
+		if response.Status >= 400 {
+			return i
+		}
+	}
+	return -1
+}
+
+func handleBatch(w http.ResponseWriter, r *http.Request, database *sql.DB, logger *lib.Logger, config *lib.Config, router http.Handler) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	form := Form{}
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config.Batch.MaxBodyBytes))
+	if err != nil {
+		lib.Render(w, r, http.StatusRequestEntityTooLarge, lib.NewErrorResponse(413, "Body larger than "+strconv.FormatInt(config.Batch.MaxBodyBytes, 10)+" bytes"))
+		return
+	}
+	// a bare array is a batch that is not atomic
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &form.Requests)
+	} else {
+		err = json.Unmarshal(content, &form)
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+	if err := validate(form, config.Batch); err != nil {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+
+	result := Result{Atomic: form.Atomic}
+	if !form.Atomic {
+		result.Responses = run(r.Context(), router, r, form, config.Batch)
+		result.Committed = true
+		lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "OK", result))
+		return
+	}
+
+	tx, err := lib.BeginTx(r.Context(), database)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error creating transaction", "error", err)
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error starting the batch"))
+		return
+	}
+	// events and the changes they describe are only seen after the commit
+	ctx, pending := events.Defer(lib.WithQueryer(r.Context(), tx))
+	result.Responses = run(ctx, router, r, form, config.Batch)
+	if i := failed(result.Responses); i >= 0 {
+		tx.Rollback()
+		pending.Discard()
+		message := "Batch rolled back, request " + result.Responses[i].Id + " failed"
+		lib.Render(w, r, http.StatusUnprocessableEntity, lib.NewDataResponse(422, message, result))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		pending.Discard()
+		logger.ErrorContext(r.Context(), "Error committing batch", "error", err)
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error committing the batch"))
+		return
+	}
+	pending.Flush(events.Default)
+	result.Committed = true
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "OK", result))
+}
+
+// InitBatchRouter serves POST /api/batch, whose items are dispatched to
+// mux itself without going through the rate limiter or chaos again, which
+// is why validate keeps the sign in routes out
+func InitBatchRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config) {
+	openapi.Describe(mux.Handle("/api/batch", lib.Negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleBatch(w, r, database, logger, config, mux)
+	}))).Methods("POST"), openapi.Operation{Summary: "Run several requests, optionally in one transaction", Request: Form{}, Response: Result{}})
+}
@@ -0,0 +1,95 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"nojoke/lib"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidate(t *testing.T) {
+	config := lib.BatchConfig{MaxRequests: 3}
+	item := func(method string, path string) Request {
+		return Request{Method: method, Path: path}
+	}
+	tests := []struct {
+		name     string
+		atomic   bool
+		requests []Request
+		err      string
+	}{
+		{"valid", false, []Request{item("GET", "/api/users"), item("post", "/api/products?x=1")}, ""},
+		{"empty", false, nil, "requests is required"},
+		{"too many", false, []Request{item("GET", "/api/users"), item("GET", "/api/users"), item("GET", "/api/users"), item("GET", "/api/users")}, "At most 3"},
+		{"method", false, []Request{item("HEAD", "/api/users")}, "method must be"},
+		{"outside the api", false, []Request{item("GET", "/health")}, "must start with /api/"},
+		{"dot segments", false, []Request{item("GET", "/api/../health")}, "must start with /api/"},
+		{"absolute url", false, []Request{item("GET", "http://example.com/api/users")}, "path must be a path"},
+		{"nested", false, []Request{item("POST", "/api/batch")}, "cannot be nested"},
+		{"nested with a query", false, []Request{item("POST", "/api/batch?x=1")}, "cannot be nested"},
+		{"nested with a fragment", false, []Request{item("POST", "/api/batch#x")}, "cannot be nested"},
+		{"nested and escaped", false, []Request{item("POST", "/api/%62atch")}, "cannot be nested"},
+		{"nested with a trailing slash", false, []Request{item("POST", "/api/batch/")}, "cannot be nested"},
+		{"nested behind dot segments", false, []Request{item("POST", "/api/users/../batch")}, "cannot be nested"},
+		{"atomic", true, []Request{item("POST", "/api/users"), item("PUT", "/api/products/1"), item("GET", "/api/collections")}, ""},
+		{"atomic outside the data routes", true, []Request{item("POST", "/api/users"), item("POST", "/api/bins")}, "requests[1]: an atomic batch can only use"},
+		{"atomic and a lookalike prefix", true, []Request{item("GET", "/api/usersx")}, "an atomic batch can only use"},
+		{"not atomic outside the data routes", false, []Request{item("POST", "/api/bins")}, ""},
+		{"sign in", false, []Request{item("POST", "/api/auth/signin")}, "/api/auth/signin cannot be batched"},
+		{"sign in behind dot segments", false, []Request{item("POST", "/api/users/../auth/signin")}, "cannot be batched"},
+		{"export", false, []Request{item("GET", "/api/products/export?format=ndjson")}, "cannot be batched"},
+		{"import", false, []Request{item("POST", "/api/users/import")}, "cannot be batched"},
+		{"stream", false, []Request{item("GET", "/api/stream/products")}, "cannot be batched"},
+		{"a product named export", false, []Request{item("GET", "/api/products?q=export")}, ""},
+	}
+	for _, tt := range tests {
+		err := validate(Form{Atomic: tt.atomic, Requests: tt.requests}, config)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRunLimitsResponses(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/size/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(mux.Vars(r)["n"])
+		w.Write([]byte(strings.Repeat("x", n)))
+	})
+	config := lib.BatchConfig{MaxResponseBytes: 10, MaxTotalBytes: 25}
+	tests := []struct {
+		name     string
+		atomic   bool
+		sizes    []int
+		statuses []int
+	}{
+		{"within the limits", false, []int{10, 10, 5}, []int{200, 200, 200}},
+		{"one response too large", false, []int{5, 11, 5}, []int{200, 413, 200}},
+		{"larger than what the total leaves", false, []int{10, 10, 10, 1}, []int{200, 200, 413, 200}},
+		{"total reached", false, []int{10, 10, 5, 1}, []int{200, 200, 200, 413}},
+		{"atomic stops at the first too large", true, []int{11, 5}, []int{413}},
+	}
+	for _, tt := range tests {
+		form := Form{Atomic: tt.atomic}
+		for _, size := range tt.sizes {
+			form.Requests = append(form.Requests, Request{Method: "GET", Path: "/api/size/" + strconv.Itoa(size)})
+		}
+		responses := run(context.Background(), router, httptest.NewRequest("POST", "/api/batch", nil), form, config)
+		statuses := []int{}
+		for _, response := range responses {
+			statuses = append(statuses, response.Status)
+		}
+		if fmt.Sprint(statuses) != fmt.Sprint(tt.statuses) {
+			t.Errorf("%s: statuses %v, want %v", tt.name, statuses, tt.statuses)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package bins
+
+import (
+	"crypto/rand"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"nojoke/lib"
+	"nojoke/openapi"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+//go:embed inspect.html
+var inspectPage []byte
+
+// captured requests are sent to /b/{id}, the inspector is at /bins/{id}
+const (
+	capturePrefix = "/b/"
+	inspectPrefix = "/bins/"
+)
+
+// Bin collects the requests sent to its URL
+type Bin struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	URL        string    `json:"url"`
+	InspectURL string    `json:"inspect_url"`
+	Requests   int       `json:"requests"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type BinForm struct {
+	Name string `json:"name" validate:"max_len:255"`
+}
+
+// CapturedRequest is a request received by a bin, Body is base64 when
+// BodyEncoding says so because it was not valid UTF-8
+type CapturedRequest struct {
+	Id           int64               `json:"id"`
+	Method       string              `json:"method"`
+	Path         string              `json:"path"`
+	Query        string              `json:"query"`
+	QueryParams  map[string][]string `json:"query_params"`
+	Headers      map[string][]string `json:"headers"`
+	Body         string              `json:"body"`
+	BodyEncoding string              `json:"body_encoding"`
+	// size of the whole body, only the first bins.max_body_bytes are kept
+	BodySize   int       `json:"body_size"`
+	Truncated  bool      `json:"truncated"`
+	RemoteAddr string    `json:"remote_addr"`
+	DurationMs int64     `json:"duration_ms"`
+	ReceivedAt time.Time `json:"received_at"`
+	body       []byte
+}
+
+// render fills in the fields derived from the stored body and query
+func (c CapturedRequest) render() CapturedRequest {
+	c.QueryParams, _ = url.ParseQuery(c.Query)
+	if utf8.Valid(c.body) {
+		c.Body = string(c.body)
+		c.BodyEncoding = "utf-8"
+	} else {
+		c.Body = base64.StdEncoding.EncodeToString(c.body)
+		c.BodyEncoding = "base64"
+	}
+	return c
+}
+
+func newId() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// baseURL is the scheme and host the client used to reach the server
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func withURLs(r *http.Request, bin Bin) Bin {
+	bin.URL = baseURL(r) + capturePrefix + bin.Id
+	bin.InspectURL = baseURL(r) + inspectPrefix + bin.Id
+	return bin
+}
+
+// findBin answers 404 or 500 when the bin of the {id} route variable cannot
+// be loaded
+func findBin(w http.ResponseWriter, r *http.Request, q *BinQuery) (Bin, bool) {
+	bin, err := q.FindOne(r.Context(), mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Bin not found"))
+		return bin, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error getting bin"))
+		return bin, false
+	}
+	return withURLs(r, bin), true
+}
+
+func handlePost(w http.ResponseWriter, r *http.Request, q *BinQuery, config *lib.Config) {
+	w.Header().Set("Content-Type", "application/json")
+	form := BinForm{}
+	// the body is optional, a bin needs no name
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+	if isValid, message := lib.ValidateForm(form); !isValid {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, message))
+		return
+	}
+	id, err := newId()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error creating bin"))
+		return
+	}
+	bin, err := q.Create(r.Context(), id, form.Name, config.Bins.IdleTTL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error creating bin"))
+		return
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lib.NewDataResponse(201, "OK", withURLs(r, bin)))
+}
+
+func handleFindOne(w http.ResponseWriter, r *http.Request, q *BinQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	bin, ok := findBin(w, r, q)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", bin))
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, q *BinQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	err := q.Delete(r.Context(), mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Bin not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error deleting bin"))
+		return
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "DELETED", nil))
+}
+
+func handleRequests(w http.ResponseWriter, r *http.Request, q *BinQuery, config *lib.Config) {
+	w.Header().Set("Content-Type", "application/json")
+	limit, page, _, err := lib.PaginationParams(r.URL.Query().Get("limit"), r.URL.Query().Get("page"), "")
+	if err != nil || limit < 1 || page < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid query params"))
+		return
+	}
+	bin, ok := findBin(w, r, q)
+	if !ok {
+		return
+	}
+	pagination := lib.Pagination{Limit: limit, Page: page}
+	requests, err := q.Requests(r.Context(), bin.Id, &pagination)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error getting requests"))
+		return
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	json.NewEncoder(w).Encode(lib.DataResponse{Status: 200, Message: "OK", Data: requests, Pagination: pagination})
+}
+
+func handleClear(w http.ResponseWriter, r *http.Request, q *BinQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	bin, ok := findBin(w, r, q)
+	if !ok {
+		return
+	}
+	if err := q.Clear(r.Context(), bin.Id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error deleting requests"))
+		return
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "DELETED", nil))
+}
+
+// handleCapture stores any request sent to the bin URL or below it and
+// answers 200 with the id of the captured request
+func handleCapture(w http.ResponseWriter, r *http.Request, q *BinQuery, config *lib.Config) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	start := time.Now()
+	body, err := io.ReadAll(io.LimitReader(r.Body, config.Bins.MaxBodyBytes))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+	// the rest is only counted, up to a limit so a bin cannot be used to
+	// keep a connection busy forever
+	rest, _ := io.Copy(io.Discard, io.LimitReader(r.Body, 64*config.Bins.MaxBodyBytes))
+	headers := map[string][]string(r.Header.Clone())
+	headers["Host"] = []string{r.Host}
+	request := CapturedRequest{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Headers:    headers,
+		BodySize:   len(body) + int(rest),
+		Truncated:  rest > 0,
+		RemoteAddr: r.RemoteAddr,
+		DurationMs: time.Since(start).Milliseconds(),
+		body:       body,
+	}
+	request, err = q.Capture(r.Context(), mux.Vars(r)["id"], request, config.Bins.MaxRequests)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Bin not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error capturing request"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", map[string]int64{"request_id": request.Id}))
+}
+
+func InitBinRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config) {
+	router := mux.PathPrefix("/api/bins").Subrouter()
+	q := NewBinQuery(database, logger)
+	openapi.Describe(router.HandleFunc("", func(w http.ResponseWriter, r *http.Request) {
+		handlePost(w, r, q, config)
+	}).Methods("POST"), openapi.Operation{Summary: "Create a request bin, every request to its url is captured", Request: BinForm{}, Response: Bin{}, Tags: []string{"bins"}})
+	openapi.Describe(router.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleFindOne(w, r, q)
+	}).Methods("GET"), openapi.Operation{Summary: "Get a request bin", Response: Bin{}, Tags: []string{"bins"}})
+	openapi.Describe(router.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleDelete(w, r, q)
+	}).Methods("DELETE"), openapi.Operation{Summary: "Delete a request bin with its requests", Tags: []string{"bins"}})
+	openapi.Describe(router.HandleFunc("/{id}/requests", func(w http.ResponseWriter, r *http.Request) {
+		handleRequests(w, r, q, config)
+	}).Methods("GET"), openapi.Operation{Summary: "List the captured requests, newest first", Response: CapturedRequest{}, List: true, Tags: []string{"bins"}})
+	openapi.Describe(router.HandleFunc("/{id}/requests", func(w http.ResponseWriter, r *http.Request) {
+		handleClear(w, r, q)
+	}).Methods("DELETE"), openapi.Operation{Summary: "Delete the captured requests", Tags: []string{"bins"}})
+
+	openapi.Describe(mux.HandleFunc(inspectPrefix+"{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(inspectPage)
+	}).Methods("GET"), openapi.Operation{Summary: "Inspect the requests of a bin", Tags: []string{"bins"}, Raw: true, ContentType: "text/html"})
+	// any method, path, query and body is captured
+	openapi.Describe(mux.PathPrefix(capturePrefix+"{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleCapture(w, r, q, config)
+	}), openapi.Operation{Hidden: true})
+}
@@ -0,0 +1,122 @@
+package bins
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http/httptest"
+	"nojoke/lib"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		encoded  string
+		encoding string
+	}{
+		{"text", []byte(`{"ok": true}`), `{"ok": true}`, "utf-8"},
+		{"empty", nil, "", "utf-8"},
+		{"binary", []byte{0xff, 0xfe, 0x00}, "//4A", "base64"},
+	}
+	for _, tt := range tests {
+		c := CapturedRequest{Query: "a=1&a=2&b=", body: tt.body}.render()
+		if c.Body != tt.encoded || c.BodyEncoding != tt.encoding {
+			t.Errorf("%s: %q as %s", tt.name, c.Body, c.BodyEncoding)
+		}
+		if len(c.QueryParams["a"]) != 2 || len(c.QueryParams["b"]) != 1 {
+			t.Errorf("%s: query params %v", tt.name, c.QueryParams)
+		}
+	}
+}
+
+func TestWithURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		proto   string
+		tls     bool
+		url     string
+		inspect string
+	}{
+		{"http", "", false, "http://nojoke.test/b/abc", "http://nojoke.test/bins/abc"},
+		{"tls", "", true, "https://nojoke.test/b/abc", "https://nojoke.test/bins/abc"},
+		{"behind a proxy", "https", false, "https://nojoke.test/b/abc", "https://nojoke.test/bins/abc"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "http://nojoke.test/api/bins", nil)
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		bin := withURLs(r, Bin{Id: "abc"})
+		if bin.URL != tt.url || bin.InspectURL != tt.inspect {
+			t.Errorf("%s: %s and %s", tt.name, bin.URL, bin.InspectURL)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		found  bool
+		status int
+	}{
+		{"small body", "hello", true, 200},
+		{"body above the limit", strings.Repeat("x", 12), true, 200},
+		{"unknown bin", "hello", false, 404},
+	}
+	for _, tt := range tests {
+		database, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := lib.DefaultConfig()
+		config.Bins.MaxBodyBytes = 8
+		router := mux.NewRouter()
+		InitBinRouter(router, database, lib.NewLogger(nil, lib.LogConfig{Level: "error"}), config)
+
+		kept := tt.body
+		if len(kept) > 8 {
+			kept = kept[:8]
+		}
+		mock.ExpectBegin()
+		if tt.found {
+			mock.ExpectExec(regexp.QuoteMeta(TouchBinQuery)).WithArgs("abc").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(regexp.QuoteMeta(InsertRequestQuery)).
+				WithArgs("abc", "PUT", "/b/abc/hooks", "x=1", sqlmock.AnyArg(), []byte(kept), len(tt.body), len(tt.body) > 8, sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "received_at"}).AddRow(5, time.Now()))
+			mock.ExpectExec(regexp.QuoteMeta(TrimRequestsQuery)).WithArgs("abc", config.Bins.MaxRequests).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectExec(regexp.QuoteMeta(TouchBinQuery)).WithArgs("abc").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectRollback()
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("PUT", "/b/abc/hooks?x=1", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if tt.found {
+			response := struct {
+				Data map[string]int64 `json:"data"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Data["request_id"] != 5 {
+				t.Errorf("%s: %s", tt.name, w.Body.String())
+			}
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		database.Close()
+	}
+}
@@ -0,0 +1,134 @@
+package bins
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"nojoke/lib"
+	"time"
+)
+
+type BinQuery struct {
+	database *sql.DB
+	logger   *lib.Logger
+}
+
+func NewBinQuery(database *sql.DB, logger *lib.Logger) *BinQuery {
+	return &BinQuery{database: database, logger: logger}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBin(row rowScanner) (Bin, error) {
+	bin := Bin{}
+	err := row.Scan(&bin.Id, &bin.Name, &bin.CreatedAt, &bin.UpdatedAt, &bin.Requests)
+	return bin, err
+}
+
+// Create stores a bin and removes the bins idle for longer than idle
+func (q *BinQuery) Create(ctx context.Context, id string, name string, idle time.Duration) (Bin, error) {
+	if _, err := q.database.ExecContext(ctx, DeleteIdleBinsQuery, idle.Seconds()); err != nil {
+		q.logger.WarnContext(ctx, "Error removing idle bins", "error", err)
+	}
+	return scanBin(q.database.QueryRowContext(ctx, InsertBinQuery, id, name))
+}
+
+// FindOne returns sql.ErrNoRows when the bin does not exist
+func (q *BinQuery) FindOne(ctx context.Context, id string) (Bin, error) {
+	return scanBin(q.database.QueryRowContext(ctx, GetBinQuery, id))
+}
+
+// Delete removes the bin with its requests, sql.ErrNoRows when it does not
+// exist
+func (q *BinQuery) Delete(ctx context.Context, id string) error {
+	result, err := q.database.ExecContext(ctx, DeleteBinQuery, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Capture stores request in its bin and drops the oldest requests beyond
+// keep, sql.ErrNoRows when the bin does not exist
+func (q *BinQuery) Capture(ctx context.Context, binId string, request CapturedRequest, keep int) (CapturedRequest, error) {
+	headers, err := json.Marshal(request.Headers)
+	if err != nil {
+		return request, err
+	}
+	tx, err := q.database.BeginTx(ctx, nil)
+	if err != nil {
+		return request, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, TouchBinQuery, binId)
+	if err != nil {
+		return request, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return request, sql.ErrNoRows
+	}
+	err = tx.QueryRowContext(ctx, InsertRequestQuery,
+		binId, request.Method, request.Path, request.Query, headers, request.body,
+		request.BodySize, request.Truncated, request.RemoteAddr, request.DurationMs,
+	).Scan(&request.Id, &request.ReceivedAt)
+	if err != nil {
+		return request, err
+	}
+	if _, err := tx.ExecContext(ctx, TrimRequestsQuery, binId, keep); err != nil {
+		return request, err
+	}
+	return request, tx.Commit()
+}
+
+// Requests returns a page of the requests of a bin, newest first, and sets
+// pagination.Total
+func (q *BinQuery) Requests(ctx context.Context, binId string, pagination *lib.Pagination) ([]CapturedRequest, error) {
+	err := q.database.QueryRowContext(ctx, CountRequestsQuery, binId).Scan(&pagination.Total)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error counting bin requests", "error", err)
+		return nil, err
+	}
+	offset := (pagination.Page - 1) * pagination.Limit
+	rows, err := q.database.QueryContext(ctx, GetRequestsQuery, binId, pagination.Limit, offset)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error getting bin requests", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	requests := []CapturedRequest{}
+	for rows.Next() {
+		request := CapturedRequest{}
+		var headers []byte
+		err := rows.Scan(
+			&request.Id,
+			&request.Method,
+			&request.Path,
+			&request.Query,
+			&headers,
+			&request.body,
+			&request.BodySize,
+			&request.Truncated,
+			&request.RemoteAddr,
+			&request.DurationMs,
+			&request.ReceivedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(headers, &request.Headers); err != nil {
+			return nil, err
+		}
+		requests = append(requests, request.render())
+	}
+	return requests, rows.Err()
+}
+
+func (q *BinQuery) Clear(ctx context.Context, binId string) error {
+	_, err := q.database.ExecContext(ctx, DeleteRequestsQuery, binId)
+	return err
+}
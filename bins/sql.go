@@ -0,0 +1,92 @@
+package bins
+
+const CreateBinTablesQuery = `
+	CREATE TABLE IF NOT EXISTS bins (
+		id VARCHAR(32) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TRIGGER bins_set_updated_at BEFORE UPDATE ON bins
+		FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+	CREATE TABLE IF NOT EXISTS bin_requests (
+		id SERIAL PRIMARY KEY,
+		bin_id VARCHAR(32) NOT NULL REFERENCES bins(id) ON DELETE CASCADE,
+		method VARCHAR(16) NOT NULL,
+		path TEXT NOT NULL,
+		query TEXT NOT NULL,
+		headers JSONB NOT NULL,
+		body BYTEA NOT NULL,
+		body_size INTEGER NOT NULL,
+		truncated BOOLEAN NOT NULL,
+		remote_addr VARCHAR(255) NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS bin_requests_bin ON bin_requests (bin_id, id);
+`
+
+const DropBinTablesQuery = `
+	DROP TABLE IF EXISTS bin_requests;
+	DROP TABLE IF EXISTS bins;
+`
+
+const binColumns = `id, name, created_at, updated_at,
+	(SELECT COUNT(*) FROM bin_requests WHERE bin_id = bins.id)`
+
+const InsertBinQuery = `
+	INSERT INTO bins (id, name)
+	VALUES ($1, $2)
+	RETURNING ` + binColumns + `;
+`
+
+const GetBinQuery = `
+	SELECT ` + binColumns + `
+	FROM bins
+	WHERE id = $1;
+`
+
+const DeleteBinQuery = `
+	DELETE FROM bins WHERE id = $1;
+`
+
+// bins nobody sent a request to for $1 seconds
+const DeleteIdleBinsQuery = `
+	DELETE FROM bins WHERE updated_at < CURRENT_TIMESTAMP - make_interval(secs => $1);
+`
+
+// touching the bin keeps it from expiring
+const TouchBinQuery = `
+	UPDATE bins SET updated_at = CURRENT_TIMESTAMP WHERE id = $1;
+`
+
+const InsertRequestQuery = `
+	INSERT INTO bin_requests (bin_id, method, path, query, headers, body, body_size, truncated, remote_addr, duration_ms)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	RETURNING id, received_at;
+`
+
+// keeps the newest $2 requests of a bin
+const TrimRequestsQuery = `
+	DELETE FROM bin_requests
+	WHERE bin_id = $1 AND id <= (
+		SELECT id FROM bin_requests WHERE bin_id = $1 ORDER BY id DESC OFFSET $2 LIMIT 1
+	);
+`
+
+const CountRequestsQuery = `
+	SELECT COUNT(*) FROM bin_requests WHERE bin_id = $1;
+`
+
+const GetRequestsQuery = `
+	SELECT id, method, path, query, headers, body, body_size, truncated, remote_addr, duration_ms, received_at
+	FROM bin_requests
+	WHERE bin_id = $1
+	ORDER BY id DESC
+	LIMIT $2 OFFSET $3;
+`
+
+const DeleteRequestsQuery = `
+	DELETE FROM bin_requests WHERE bin_id = $1;
+`
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"nojoke/auth"
+	"nojoke/lib"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const Header = "X-Cache"
+
+// headers that describe a single exchange and must not be replayed
+var perRequestHeaders = []string{
+	Header, lib.RequestIDHeader, "Set-Cookie", "Retry-After",
+	"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy",
+}
+
+// Cache serves GET responses of the configured routes from memory and drops
+// them whenever a request mutates the same resource
+type Cache struct {
+	store  *Store
+	logger *lib.Logger
+	ttl    time.Duration
+	routes map[string]bool
+}
+
+func NewCache(logger *lib.Logger, config *lib.Config) *Cache {
+	routes := map[string]bool{}
+	for _, route := range config.Cache.Routes {
+		routes[route] = true
+	}
+	return &Cache{
+		store:  NewStore(config.Cache.MaxEntries, config.Cache.MaxBytes),
+		logger: logger,
+		ttl:    config.Cache.TTL,
+		routes: routes,
+	}
+}
+
+type storeKey struct{}
+
+// Invalidate drops the responses cached for resource, such as /api/users,
+// from handlers that change it without going through its routes
+func Invalidate(ctx context.Context, resource string) {
+	if store, ok := ctx.Value(storeKey{}).(*Store); ok {
+		store.Invalidate(resource)
+	}
+}
+
+// WithStore lets Invalidate reach the cache from handlers served outside the
+// HTTP router, such as the gRPC services
+func (c *Cache) WithStore(ctx context.Context) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, storeKey{}, c.store)
+}
+
+// resource groups route templates so /api/products and /api/products/{id}
+// invalidate each other
+func resource(template string) string {
+	parts := strings.SplitN(strings.TrimPrefix(template, "/"), "/", 3)
+	if len(parts) >= 2 && parts[0] == "api" {
+		return "/api/" + parts[1]
+	}
+	return template
+}
+
+// principal separates cached responses per credentials without trusting
+// them, the token itself is hashed so it never lives in the cache keys
+func principal(r *http.Request) string {
+	token := auth.TokenFromRequest(r)
+	if token == "" {
+		return "guest"
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func key(template string, r *http.Request) string {
+	// Encode sorts the parameters so their order does not matter
+	query := r.URL.Query().Encode()
+	return strings.Join([]string{
+		template, r.URL.Path, query, principal(r), r.Header.Get("Accept"),
+	}, "|")
+}
+
+// recorder writes through to the client and keeps a copy of the body
+type recorder struct {
+	*lib.ResponseWriter
+	body     bytes.Buffer
+	maxBytes int
+	overflow bool
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(b) > w.maxBytes {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func serveEntry(w http.ResponseWriter, r *http.Request, entry *Entry) {
+	for name, values := range entry.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(Header, "HIT")
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+	lastModified, _ := http.ParseTime(entry.Header.Get("Last-Modified"))
+	// the stored headers already hold the ETag of the cached format
+	if lib.NotModifiedAs(w, r, entry.Header.Get("ETag"), lastModified) {
+		return
+	}
+	w.WriteHeader(entry.Status)
+	w.Write(entry.Body)
+}
+
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			r = r.WithContext(context.WithValue(r.Context(), storeKey{}, c.store))
+			rw := lib.NewResponseWriter(w)
+			next.ServeHTTP(rw, r)
+			if rw.Status >= 200 && rw.Status < 300 {
+				removed := c.store.Invalidate(resource(template))
+				c.logger.DebugContext(r.Context(), "Cache invalidated", "resource", resource(template), "entries", removed)
+			}
+			return
+		}
+
+		// responses read inside a transaction may be rolled back
+		if !c.routes[template] || lib.Scoped(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cacheKey := key(template, r)
+		// Cache-Control: no-cache asks for a fresh response, which then
+		// replaces the cached one
+		noCache := strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+		if !noCache {
+			if entry, ok := c.store.Get(cacheKey); ok {
+				serveEntry(w, r, entry)
+				return
+			}
+		}
+
+		if noCache {
+			w.Header().Set(Header, "BYPASS")
+		} else {
+			w.Header().Set(Header, "MISS")
+		}
+		rec := &recorder{ResponseWriter: lib.NewResponseWriter(w), maxBytes: c.store.maxBytes}
+		next.ServeHTTP(rec, r)
+		if rec.Status != http.StatusOK || rec.overflow || r.Method == http.MethodHead {
+			return
+		}
+		header := w.Header().Clone()
+		for _, name := range perRequestHeaders {
+			header.Del(name)
+		}
+		now := time.Now()
+		c.store.Set(&Entry{
+			key:      cacheKey,
+			resource: resource(template),
+			Status:   rec.Status,
+			Header:   header,
+			Body:     rec.body.Bytes(),
+			StoredAt: now,
+			Expires:  now.Add(c.ttl),
+		})
+	})
+}
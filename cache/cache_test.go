@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"nojoke/lib"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type testUser struct {
+	Id   int64  `json:"id" xml:"id"`
+	Name string `json:"name" xml:"name"`
+}
+
+// newTestRouter serves a user behind the cache and counts the requests that
+// reach the handler
+func newTestRouter(calls *int) *mux.Router {
+	config := lib.DefaultConfig()
+	config.Cache.Routes = []string{"/api/users/{id}"}
+	c := NewCache(lib.NewLogger(nil, lib.LogConfig{Level: "error"}), config)
+	router := mux.NewRouter()
+	router.Use(c.Middleware)
+	router.HandleFunc("/api/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		user := testUser{Id: 1, Name: "Ada"}
+		if lib.NotModified(w, r, lib.ETag(user), time.Time{}) {
+			return
+		}
+		lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "User found", user))
+	}).Methods("GET")
+	router.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		status, err := strconv.Atoi(r.URL.Query().Get("status"))
+		if err != nil {
+			status = http.StatusCreated
+		}
+		w.WriteHeader(status)
+	}).Methods("POST")
+	return router
+}
+
+func TestHitKeepsTheETagOfTheFormat(t *testing.T) {
+	calls := 0
+	router := newTestRouter(&calls)
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/users/1", nil)
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	miss := get(map[string]string{"Accept": "application/xml"})
+	hit := get(map[string]string{"Accept": "application/xml"})
+	if miss.Header().Get(Header) != "MISS" || hit.Header().Get(Header) != "HIT" || calls != 1 {
+		t.Fatalf("X-Cache %q then %q after %d calls", miss.Header().Get(Header), hit.Header().Get(Header), calls)
+	}
+	etag := miss.Header().Get("ETag")
+	if len(etag) < 6 || etag[len(etag)-5:] != `-xml"` || hit.Header().Get("ETag") != etag {
+		t.Errorf("ETag %q on the miss, %q on the hit", etag, hit.Header().Get("ETag"))
+	}
+	if hit.Body.String() != miss.Body.String() {
+		t.Errorf("hit body %q, want %q", hit.Body.String(), miss.Body.String())
+	}
+
+	revalidated := get(map[string]string{"Accept": "application/xml", "If-None-Match": etag})
+	if revalidated.Code != http.StatusNotModified || revalidated.Header().Get(Header) != "HIT" {
+		t.Errorf("If-None-Match %s on a hit: %d, X-Cache %q", etag, revalidated.Code, revalidated.Header().Get(Header))
+	}
+}
+
+func TestKey(t *testing.T) {
+	request := func(target string, header map[string]string) *http.Request {
+		r := httptest.NewRequest("GET", target, nil)
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		return r
+	}
+	base := key("/api/users", request("/api/users?page=2&limit=5", nil))
+	tests := []struct {
+		name   string
+		r      *http.Request
+		shared bool
+	}{
+		{"query in another order", request("/api/users?limit=5&page=2", nil), true},
+		{"another query", request("/api/users?page=3&limit=5", nil), false},
+		{"another Accept", request("/api/users?page=2&limit=5", map[string]string{"Accept": "text/csv"}), false},
+		{"a token", request("/api/users?page=2&limit=5", map[string]string{"Authorization": "Bearer abc"}), false},
+	}
+	for _, tt := range tests {
+		if got := key("/api/users", tt.r); (got == base) != tt.shared {
+			t.Errorf("%s: key %q, base %q", tt.name, got, base)
+		}
+	}
+	withToken := key("/api/users", request("/api/users", map[string]string{"Authorization": "Bearer abc"}))
+	if withToken != key("/api/users", request("/api/users", map[string]string{"Authorization": "Bearer abc"})) {
+		t.Error("the same token got another key")
+	}
+	if strings.Contains(withToken, "abc") {
+		t.Errorf("key %q holds the token", withToken)
+	}
+}
+
+func TestResource(t *testing.T) {
+	tests := []struct {
+		template, resource string
+	}{
+		{"/api/products", "/api/products"},
+		{"/api/products/{id}", "/api/products"},
+		{"/api/products/{id}/reviews", "/api/products"},
+		{"/health/live", "/health/live"},
+	}
+	for _, tt := range tests {
+		if got := resource(tt.template); got != tt.resource {
+			t.Errorf("resource(%s) = %s, want %s", tt.template, got, tt.resource)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		header  string
+		scoped  bool
+		xcache  string
+		reached bool
+	}{
+		{"first read", "GET", "/api/users/1", "", false, "MISS", true},
+		{"second read", "GET", "/api/users/1", "", false, "HIT", false},
+		{"no-cache", "GET", "/api/users/1", "no-cache", false, "BYPASS", true},
+		{"read inside a transaction", "GET", "/api/users/1", "", true, "", true},
+		{"read after the transaction", "GET", "/api/users/1", "", false, "HIT", false},
+		{"failed write keeps the entry", "POST", "/api/users?status=400", "", false, "", true},
+		{"read after the failed write", "GET", "/api/users/1", "", false, "HIT", false},
+		{"write drops the entry", "POST", "/api/users", "", false, "", true},
+		{"read after the write", "GET", "/api/users/1", "", false, "MISS", true},
+	}
+	calls := 0
+	router := newTestRouter(&calls)
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("Cache-Control", tt.header)
+		}
+		if tt.scoped {
+			r = r.WithContext(lib.WithQueryer(r.Context(), (*sql.DB)(nil)))
+		}
+		before := calls
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if got := w.Header().Get(Header); got != tt.xcache || (calls > before) != tt.reached {
+			t.Errorf("%s: X-Cache %q, handler reached %v", tt.name, got, calls > before)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Entry struct {
+	key      string
+	resource string
+	Status   int
+	Header   http.Header
+	Body     []byte
+	StoredAt time.Time
+	Expires  time.Time
+}
+
+func (e *Entry) size() int {
+	return len(e.key) + len(e.Body)
+}
+
+// Store is an LRU of responses bounded by entry count and total body size
+type Store struct {
+	mu         sync.Mutex
+	entries    *list.List
+	items      map[string]*list.Element
+	bytes      int
+	maxEntries int
+	maxBytes   int
+}
+
+func NewStore(maxEntries int, maxBytes int) *Store {
+	return &Store{
+		entries:    list.New(),
+		items:      map[string]*list.Element{},
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+func (s *Store) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*Entry)
+	if time.Now().After(entry.Expires) {
+		s.remove(element)
+		return nil, false
+	}
+	s.entries.MoveToFront(element)
+	return entry, true
+}
+
+func (s *Store) Set(entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry.size() > s.maxBytes {
+		return
+	}
+	if element, ok := s.items[entry.key]; ok {
+		s.remove(element)
+	}
+	s.items[entry.key] = s.entries.PushFront(entry)
+	s.bytes += entry.size()
+	for s.entries.Len() > s.maxEntries || s.bytes > s.maxBytes {
+		s.remove(s.entries.Back())
+	}
+}
+
+// Invalidate drops every entry cached for resource
+func (s *Store) Invalidate(resource string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for element := s.entries.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*Entry).resource == resource {
+			s.remove(element)
+			removed++
+		}
+		element = next
+	}
+	return removed
+}
+
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries.Len()
+}
+
+func (s *Store) remove(element *list.Element) {
+	entry := s.entries.Remove(element).(*Entry)
+	delete(s.items, entry.key)
+	s.bytes -= entry.size()
+}
@@ -0,0 +1,330 @@
+package chaos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"nojoke/auth"
+	"nojoke/lib"
+	"nojoke/openapi"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routes that are never disturbed so probes, scrapes and the chaos admin
+// endpoint keep working while chaos is active
+var exemptPrefixes = []string{"/health", "/metrics", "/api/admin"}
+
+// WebSocket and Server-Sent Events routes can be delayed, failed or dropped
+// before they start, but neither truncated nor slowed down since their
+// responses never end
+var streamPrefixes = []string{"/ws", "/api/stream"}
+
+// Chaos injects latency, failures, dropped connections, slow streaming and
+// truncated bodies in front of handler according to the rules in store
+type Chaos struct {
+	handler http.Handler
+	store   *Store
+	logger  *lib.Logger
+	enabled bool
+}
+
+func NewChaos(handler http.Handler, store *Store, logger *lib.Logger, config *lib.Config) *Chaos {
+	return &Chaos{handler, store, logger, config.Chaos.Enabled}
+}
+
+func NewStoreFromConfig(config *lib.Config) *Store {
+	return NewStore(Rule{
+		Delay:      Duration(config.Chaos.Delay),
+		Jitter:     Duration(config.Chaos.Jitter),
+		FailRate:   config.Chaos.FailRate,
+		FailStatus: config.Chaos.FailStatus,
+	})
+}
+
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, errors.New("rate must be between 0 and 1")
+	}
+	return rate, nil
+}
+
+func parseStatus(value string) (int, error) {
+	code, err := strconv.Atoi(value)
+	if err != nil || code < 400 || code > 599 {
+		return 0, errors.New("invalid mock status: " + value)
+	}
+	return code, nil
+}
+
+func hasPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isExempt(path string) bool {
+	return hasPrefix(path, exemptPrefixes)
+}
+
+func isStream(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" || hasPrefix(r.URL.Path, streamPrefixes)
+}
+
+func hit(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+func (c *Chaos) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !c.enabled || isExempt(r.URL.Path) {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+	rule, err := requestOverrides(c.store.Match(lib.Route(r), r.Method), r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+
+	delay := time.Duration(rule.Delay)
+	if rule.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(rule.Jitter)))
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if hit(rule.DropRate) {
+		c.logger.InfoContext(r.Context(), "Chaos dropped connection", "path", r.URL.Path)
+		drop(w)
+		return
+	}
+
+	if hit(rule.FailRate) {
+		status := rule.FailStatus
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Chaos", "fail")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(status, http.StatusText(status)))
+		return
+	}
+
+	if isStream(r) {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if hit(rule.TruncateRate) {
+		tw := &truncateWriter{ResponseWriter: w}
+		c.handler.ServeHTTP(tw, r)
+		tw.finish()
+		return
+	}
+
+	if rule.ChunkDelay > 0 {
+		c.handler.ServeHTTP(&slowWriter{ResponseWriter: w, ctx: r.Context(), delay: time.Duration(rule.ChunkDelay)}, r)
+		return
+	}
+	c.handler.ServeHTTP(w, r)
+}
+
+// drop closes the underlying connection without writing a response
+func drop(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if ok {
+		conn, _, err := hijacker.Hijack()
+		if err == nil {
+			conn.Close()
+			return
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// bodies larger than this are cut at half of it rather than buffered whole
+const truncateLimit = 1 << 20
+
+var errTruncated = errors.New("chaos: response truncated")
+
+// truncateWriter buffers the body and sends only its first half
+type truncateWriter struct {
+	http.ResponseWriter
+	status   int
+	buffer   bytes.Buffer
+	finished bool
+}
+
+func (w *truncateWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *truncateWriter) Write(b []byte) (int, error) {
+	if w.finished {
+		return 0, errTruncated
+	}
+	if w.buffer.Len()+len(b) > truncateLimit {
+		n, _ := w.buffer.Write(b[:truncateLimit-w.buffer.Len()])
+		w.finish()
+		return n, errTruncated
+	}
+	return w.buffer.Write(b)
+}
+
+func (w *truncateWriter) finish() {
+	if w.finished {
+		return
+	}
+	w.finished = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Chaos", "truncate")
+	w.ResponseWriter.WriteHeader(w.status)
+	body := w.buffer.Bytes()
+	w.ResponseWriter.Write(body[:len(body)/2])
+}
+
+const slowChunkSize = 64
+
+// slowWriter streams the body in small flushed chunks with a pause between,
+// and stops once the client is gone
+type slowWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	written := 0
+	flusher, _ := w.ResponseWriter.(http.Flusher)
+	for len(b) > 0 {
+		size := min(slowChunkSize, len(b))
+		n, err := w.ResponseWriter.Write(b[:size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		b = b[size:]
+		if len(b) > 0 {
+			timer := time.NewTimer(w.delay)
+			select {
+			case <-timer.C:
+			case <-w.ctx.Done():
+				timer.Stop()
+				return written, w.ctx.Err()
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *slowWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type RulesResponse struct {
+	Enabled bool   `json:"enabled"`
+	Global  Rule   `json:"global"`
+	Routes  []Rule `json:"routes"`
+}
+
+func rulesResponse(c *Chaos) RulesResponse {
+	return RulesResponse{
+		Enabled: c.enabled,
+		Global:  c.store.Global(),
+		Routes:  c.store.Routes(),
+	}
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(lib.NewErrorResponse(401, "Unauthorized"))
+}
+
+func handleGet(w http.ResponseWriter, r *http.Request, admin *auth.Admin, c *Chaos) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", rulesResponse(c)))
+}
+
+func handlePut(w http.ResponseWriter, r *http.Request, admin *auth.Admin, c *Chaos) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	rule := Rule{}
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+	if err := rule.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+	rule.Method = strings.ToUpper(rule.Method)
+	c.store.Set(rule)
+	c.logger.InfoContext(r.Context(), "Chaos rule updated", "route", rule.Route, "method", rule.Method)
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", rulesResponse(c)))
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, admin *auth.Admin, c *Chaos) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	route := r.URL.Query().Get("route")
+	if route == "" {
+		c.store.Reset()
+	} else {
+		c.store.Delete(route, strings.ToUpper(r.URL.Query().Get("method")))
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "DELETED", rulesResponse(c)))
+}
+
+func InitChaosRouter(mux *mux.Router, logger *lib.Logger, config *lib.Config, c *Chaos) {
+	router := mux.PathPrefix("/api/admin/chaos").Subrouter()
+	openapi.Describe(router.Handle("", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleGet(w, r, a, c)
+	})).Methods("GET"), openapi.Operation{Summary: "Show the chaos rules", Response: RulesResponse{}, Auth: true})
+	openapi.Describe(router.Handle("", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handlePut(w, r, a, c)
+	})).Methods("PUT"), openapi.Operation{Summary: "Set the global rule or a route rule", Request: Rule{}, Response: RulesResponse{}, Auth: true})
+	openapi.Describe(router.Handle("", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleDelete(w, r, a, c)
+	})).Methods("DELETE"), openapi.Operation{Summary: "Remove a route rule, or every rule without ?route", Response: RulesResponse{}, Auth: true})
+}
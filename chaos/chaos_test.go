@@ -0,0 +1,173 @@
+package chaos
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"nojoke/lib"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestStoreMatch(t *testing.T) {
+	store := NewStore(Rule{FailStatus: 500})
+	store.Set(Rule{Route: "/api/products/{id}", FailStatus: 502})
+	store.Set(Rule{Route: "/api/products/{id}", Method: "DELETE", FailStatus: 503})
+	tests := []struct {
+		route, method string
+		status        int
+	}{
+		{"/api/products/{id}", "DELETE", 503},
+		{"/api/products/{id}", "GET", 502},
+		{"/api/products", "GET", 500},
+		{"", "GET", 500},
+	}
+	for _, tt := range tests {
+		if got := store.Match(tt.route, tt.method).FailStatus; got != tt.status {
+			t.Errorf("Match(%s, %s) = %d, want %d", tt.route, tt.method, got, tt.status)
+		}
+	}
+	store.Delete("/api/products/{id}", "DELETE")
+	if got := store.Match("/api/products/{id}", "DELETE").FailStatus; got != 502 {
+		t.Errorf("after Delete: %d", got)
+	}
+	store.Set(Rule{FailStatus: 504})
+	store.Reset()
+	if len(store.Routes()) != 0 || store.Global().FailStatus != 500 {
+		t.Errorf("after Reset: %v %v", store.Routes(), store.Global())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		valid bool
+	}{
+		{"empty", Rule{}, true},
+		{"within the bounds", Rule{Delay: Duration(20 * time.Second), Jitter: Duration(10 * time.Second), ChunkDelay: Duration(MaxDuration)}, true},
+		{"rate above 1", Rule{DropRate: 1.5}, false},
+		{"negative delay", Rule{Delay: Duration(-time.Second)}, false},
+		{"delay plus jitter too long", Rule{Delay: Duration(20 * time.Second), Jitter: Duration(11 * time.Second)}, false},
+		{"jitter that overflows", Rule{Delay: Duration(time.Second), Jitter: Duration(1<<63 - 1)}, false},
+		{"chunk delay too long", Rule{ChunkDelay: Duration(time.Hour)}, false},
+		{"status out of range", Rule{FailStatus: 302}, false},
+		{"route without a slash", Rule{Route: "api/users"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestRequestOverrides(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header string
+		check  func(Rule) bool
+		valid  bool
+	}{
+		{"delay", "/?_delay=200ms", "", func(r Rule) bool { return r.Delay == Duration(200*time.Millisecond) }, true},
+		{"delay header", "/", "300ms", func(r Rule) bool { return r.Delay == Duration(300*time.Millisecond) }, true},
+		{"status fails every request", "/?_status=418", "", func(r Rule) bool { return r.FailStatus == 418 && r.FailRate == 1 }, true},
+		{"rates", "/?_drop=0.5&_truncate=1", "", func(r Rule) bool { return r.DropRate == 0.5 && r.TruncateRate == 1 }, true},
+		{"slow", "/?_slow=10ms", "", func(r Rule) bool { return r.ChunkDelay == Duration(10*time.Millisecond) }, true},
+		{"delay above the bound", "/?_delay=1h", "", nil, false},
+		{"bad rate", "/?_fail=2", "", nil, false},
+		{"bad status", "/?_status=200", "", nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("X-Mock-Delay", tt.header)
+		}
+		rule, err := requestOverrides(Rule{}, r)
+		if (err == nil) != tt.valid || tt.valid && !tt.check(rule) {
+			t.Errorf("%s: %+v, %v", tt.name, rule, err)
+		}
+	}
+}
+
+func newTestChaos(store *Store) http.Handler {
+	router := mux.NewRouter()
+	body := strings.Repeat("x", 200)
+	for _, path := range []string{"/api/products/{id}", "/api/stream/tickers", "/health/live"} {
+		router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+	}
+	config := lib.DefaultConfig()
+	config.Chaos.Enabled = true
+	return lib.NewRoutes(NewChaos(router, store, lib.NewLogger(nil, lib.LogConfig{Level: "error"}), config), router)
+}
+
+func TestServeHTTP(t *testing.T) {
+	store := NewStore(Rule{})
+	store.Set(Rule{Route: "/api/products/{id}", Method: "DELETE", FailRate: 1, FailStatus: 503})
+	store.Set(Rule{Route: "/api/products/{id}", Method: "GET", TruncateRate: 1})
+	store.Set(Rule{Route: "/api/stream/tickers", TruncateRate: 1, ChunkDelay: Duration(time.Second)})
+	store.Set(Rule{Route: "/health/live", FailRate: 1})
+	c := newTestChaos(store)
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+		length int
+	}{
+		{"route and method rule fails", "DELETE", "/api/products/1", 503, -1},
+		{"truncated", "GET", "/api/products/1", 200, 100},
+		{"query override", "GET", "/api/products/1?_truncate=0", 200, 200},
+		{"streams are not truncated or slowed", "GET", "/api/stream/tickers", 200, 200},
+		{"exempt path", "GET", "/health/live", 200, 200},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		c.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.status || tt.length >= 0 && w.Body.Len() != tt.length {
+			t.Errorf("%s: %d with %d bytes, want %d with %d", tt.name, w.Code, w.Body.Len(), tt.status, tt.length)
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Errorf("%s took %v", tt.name, time.Since(start))
+		}
+	}
+}
+
+func TestTruncateWriterBoundsTheBuffer(t *testing.T) {
+	w := httptest.NewRecorder()
+	tw := &truncateWriter{ResponseWriter: w}
+	chunk := make([]byte, truncateLimit/4+1)
+	var err error
+	for i := 0; i < 8 && err == nil; i++ {
+		_, err = tw.Write(chunk)
+	}
+	tw.finish()
+	if err != errTruncated || w.Body.Len() != truncateLimit/2 || w.Header().Get("X-Chaos") != "truncate" {
+		t.Errorf("err = %v, %d bytes sent", err, w.Body.Len())
+	}
+}
+
+func TestSlowWriterStopsWhenTheClientLeaves(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &slowWriter{ResponseWriter: httptest.NewRecorder(), ctx: ctx, delay: time.Hour}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() {
+		_, err := w.Write(make([]byte, 3*slowChunkSize))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write kept sleeping after the client left")
+	}
+}
@@ -0,0 +1,202 @@
+package chaos
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Duration is a time.Duration that reads and writes as "800ms" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MaxDuration bounds the delay plus jitter and the chunk delay of a rule
+const MaxDuration = 30 * time.Second
+
+type Rule struct {
+	// mux path template such as /api/products/{id}, empty for the global rule
+	Route  string `json:"route"`
+	Method string `json:"method,omitempty"`
+	// fixed latency plus a random jitter in [0, Jitter)
+	Delay  Duration `json:"delay"`
+	Jitter Duration `json:"jitter"`
+	// probability of answering with FailStatus instead of calling the handler
+	FailRate   float64 `json:"fail_rate"`
+	FailStatus int     `json:"fail_status"`
+	// probability of closing the connection without a response
+	DropRate float64 `json:"drop_rate"`
+	// probability of cutting the response body in half
+	TruncateRate float64 `json:"truncate_rate"`
+	// pause between response chunks to simulate a slow stream
+	ChunkDelay Duration `json:"chunk_delay"`
+}
+
+func (rule Rule) key() string {
+	return strings.ToUpper(rule.Method) + " " + rule.Route
+}
+
+func (rule Rule) Validate() error {
+	for _, rate := range []float64{rule.FailRate, rule.DropRate, rule.TruncateRate} {
+		if rate < 0 || rate > 1 {
+			return errors.New("rates must be between 0 and 1")
+		}
+	}
+	if rule.Delay < 0 || rule.Jitter < 0 || rule.ChunkDelay < 0 {
+		return errors.New("durations must not be negative")
+	}
+	if time.Duration(rule.Delay) > MaxDuration || time.Duration(rule.Jitter) > MaxDuration-time.Duration(rule.Delay) || time.Duration(rule.ChunkDelay) > MaxDuration {
+		return errors.New("delay plus jitter and chunk_delay must not exceed " + MaxDuration.String())
+	}
+	if rule.FailStatus != 0 && (rule.FailStatus < 400 || rule.FailStatus > 599) {
+		return errors.New("fail_status must be a 4xx or 5xx status code")
+	}
+	if rule.Route != "" && !strings.HasPrefix(rule.Route, "/") {
+		return errors.New("route must be a path template starting with /")
+	}
+	return nil
+}
+
+// Store holds the global rule and the per-route rules, safe for concurrent use
+type Store struct {
+	mu       sync.RWMutex
+	defaults Rule
+	global   Rule
+	routes   map[string]Rule
+}
+
+func NewStore(global Rule) *Store {
+	return &Store{
+		defaults: global,
+		global:   global,
+		routes:   map[string]Rule{},
+	}
+}
+
+// Match returns the rule for route and method, a route rule for a specific
+// method wins over one for any method, which wins over the global rule
+func (s *Store) Match(route string, method string) Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if rule, ok := s.routes[Rule{Route: route, Method: method}.key()]; ok {
+		return rule
+	}
+	if rule, ok := s.routes[Rule{Route: route}.key()]; ok {
+		return rule
+	}
+	return s.global
+}
+
+func (s *Store) Set(rule Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rule.Route == "" {
+		s.global = rule
+		return
+	}
+	s.routes[rule.key()] = rule
+}
+
+func (s *Store) Delete(route string, method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.routes, Rule{Route: route, Method: method}.key())
+}
+
+// Reset drops every route rule and restores the configured global rule
+func (s *Store) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.global = s.defaults
+	s.routes = map[string]Rule{}
+}
+
+func (s *Store) Global() Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.global
+}
+
+func (s *Store) Routes() []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rules := []Rule{}
+	for _, rule := range s.routes {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].key() < rules[j].key()
+	})
+	return rules
+}
+
+// requestOverrides applies ?_delay, ?_fail, ?_drop, ?_truncate, ?_slow and the
+// X-Mock-Status / X-Mock-Delay headers on top of rule
+func requestOverrides(rule Rule, r *http.Request) (Rule, error) {
+	query := r.URL.Query()
+	if delay := firstOf(query.Get("_delay"), r.Header.Get("X-Mock-Delay")); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return rule, errors.New("invalid _delay: " + delay)
+		}
+		rule.Delay = Duration(d)
+	}
+	if slow := query.Get("_slow"); slow != "" {
+		d, err := time.ParseDuration(slow)
+		if err != nil {
+			return rule, errors.New("invalid _slow: " + slow)
+		}
+		rule.ChunkDelay = Duration(d)
+	}
+	rates := map[string]*float64{
+		"_fail":     &rule.FailRate,
+		"_drop":     &rule.DropRate,
+		"_truncate": &rule.TruncateRate,
+	}
+	for name, rate := range rates {
+		if value := query.Get(name); value != "" {
+			parsed, err := parseRate(value)
+			if err != nil {
+				return rule, errors.New("invalid " + name + ": " + value)
+			}
+			*rate = parsed
+		}
+	}
+	if status := firstOf(query.Get("_status"), r.Header.Get("X-Mock-Status")); status != "" {
+		code, err := parseStatus(status)
+		if err != nil {
+			return rule, err
+		}
+		rule.FailStatus = code
+		rule.FailRate = 1
+	}
+	return rule, rule.Validate()
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -2,11 +2,11 @@ package collections
 
 import (
 	"database/sql"
-	"encoding/json"
-	"fmt"
 	"net/http"
 	"nojoke/auth"
 	"nojoke/lib"
+	"nojoke/openapi"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
@@ -18,63 +18,98 @@ type CollectionType struct {
 	Description string `json:"description"`
 }
 
-func initializeDatabase(database *sql.DB, logger *lib.Logger) {
-	_, err := database.Exec(CreateCollectionTableQuery)
-	if err != nil {
-		logger.Error("Error creating collection table: " + err.Error())
-	}
-	logger.Info("Created collection table !")
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCollection(row rowScanner) (Collection, error) {
+	collection := Collection{}
+	err := row.Scan(&collection.Id, &collection.CreateAt, &collection.UserId, &collection.UpdatedAt)
+	return collection, err
 }
 
 func handleGet(
 	w http.ResponseWriter, r *http.Request,
-	database *sql.DB,
+	cq *CollectionQuery,
 	logger *lib.Logger,
 	admin *auth.Admin) {
 
 	limit := r.URL.Query().Get("limit")
 	page := r.URL.Query().Get("page")
-	total := r.URL.Query().Get("total")
 
-	limitInt, pageInt, totalInt, error := lib.PaginationParams(limit, page, total)
-
-	fmt.Println(limitInt, pageInt, totalInt)
+	w.Header().Set("Content-Type", "application/json")
 
+	limitInt, pageInt, _, error := lib.PaginationParams(limit, page, "")
+	if error != nil || limitInt < 1 || pageInt < 1 {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid query params"))
+		return
+	}
+	pagination := lib.Pagination{
+		Limit: limitInt,
+		Page:  pageInt,
+	}
+	lastModified, error := cq.LastModified(r.Context())
 	if error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid query params"))
+		logger.ErrorContext(r.Context(), "Error getting last modified", "error", error)
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting collections"))
 		return
 	}
-	tx, error := database.Begin()
+	collections, error := cq.List(r.Context(), &pagination)
 	if error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Error creating transition"))
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting collections"))
+		return
+	}
+
+	response := lib.DataResponse{
+		Status:     200,
+		Message:    "Success",
+		Data:       collections,
+		Pagination: pagination,
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlList)
+	if lib.NotModified(w, r, lib.WeakETag(response), lastModified) {
 		return
 	}
-	var count int
-	error = tx.QueryRow(CountCollectionsQuery).Scan(&count)
+	lib.Render(w, r, http.StatusOK, response)
+}
+
+func handleFindOne(
+	w http.ResponseWriter, r *http.Request,
+	cq *CollectionQuery,
+	admin *auth.Admin) {
+
+	w.Header().Set("Content-Type", "application/json")
+	id, error := strconv.Atoi(mux.Vars(r)["id"])
 	if error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Error getting count"))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid Id"))
+		return
+	}
+	collection, error := cq.FindOne(r.Context(), int64(id))
+	if error == sql.ErrNoRows {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "Collection not found"))
 		return
 	}
-	rows, error := tx.Query(GetCollectionsQuery, limitInt, pageInt)
 	if error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Error getting collections"))
+		cq.logger.ErrorContext(r.Context(), "Error getting collection", "error", error)
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting collection"))
 		return
 	}
-	collections := make([]ProductCollection, 0)
-	defer rows.Close()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "Success", collections))
-
+	w.Header().Set("Cache-Control", lib.CacheControlResource)
+	if lib.NotModified(w, r, lib.ETag(collection), collection.UpdatedAt) {
+		return
+	}
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "Success", collection))
 }
 
-func InitCollectionRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger) {
+func InitCollectionRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config) {
 	router := mux.PathPrefix("/api/collections").Subrouter()
-	initializeDatabase(database, logger)
-	router.Handle("", auth.Authenticated(func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
-		handleGet(w, r, database, logger, a)
-	})).Methods("GET")
+	router.Use(lib.Negotiate)
+	lib.RegisterRecordCount(database, "collections", CountCollectionsQuery)
+	cq := NewCollectionQuery(database, logger)
+	openapi.Describe(router.Handle("", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleGet(w, r, cq, logger, a)
+	})).Methods("GET"), openapi.Operation{Summary: "List collections", Response: Collection{}, List: true, Auth: true})
+	openapi.Describe(router.Handle("/{id}", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleFindOne(w, r, cq, a)
+	})).Methods("GET"), openapi.Operation{Summary: "Get a collection", Response: Collection{}, Auth: true})
 }
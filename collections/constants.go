@@ -1,9 +1,12 @@
 package collections
 
+import "time"
+
 type Collection struct {
-	Id       int64  `json:"id"`
-	CreateAt string `json:"create_at"`
-	UserId   int64  `json:"user_id"`
+	Id        int64     `json:"id"`
+	CreateAt  string    `json:"create_at"`
+	UserId    int64     `json:"user_id"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 type ProductCollection struct {
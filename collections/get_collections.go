@@ -0,0 +1,74 @@
+package collections
+
+import (
+	"context"
+	"database/sql"
+	"nojoke/lib"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type CollectionQuery struct {
+	database *sql.DB
+	logger   *lib.Logger
+}
+
+func NewCollectionQuery(database *sql.DB, logger *lib.Logger) *CollectionQuery {
+	return &CollectionQuery{database: database, logger: logger}
+}
+
+// List returns a page of collections and sets pagination.Total
+func (q *CollectionQuery) List(ctx context.Context, pagination *lib.Pagination) ([]Collection, error) {
+	err := lib.DB(ctx, q.database).QueryRowContext(ctx, CountCollectionsQuery).Scan(&pagination.Total)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error counting collections", "error", err)
+		return nil, err
+	}
+	rows, err := lib.DB(ctx, q.database).QueryContext(ctx, GetCollectionsQuery, pagination.Limit, (pagination.Page-1)*pagination.Limit)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error getting collections", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	collections := []Collection{}
+	for rows.Next() {
+		collection, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+	return collections, rows.Err()
+}
+
+// LastModified returns when a collection last changed
+func (q *CollectionQuery) LastModified(ctx context.Context) (time.Time, error) {
+	var lastModified time.Time
+	err := lib.DB(ctx, q.database).QueryRowContext(ctx, GetCollectionsLastModifiedQuery).Scan(&lastModified)
+	return lastModified, err
+}
+
+// FindOne returns sql.ErrNoRows when the collection does not exist
+func (q *CollectionQuery) FindOne(ctx context.Context, id int64) (Collection, error) {
+	return scanCollection(lib.DB(ctx, q.database).QueryRowContext(ctx, GetCollectionQuery, id))
+}
+
+// FindMany returns the collections in ids that exist, keyed by id
+func (q *CollectionQuery) FindMany(ctx context.Context, ids []int64) (map[int64]Collection, error) {
+	rows, err := lib.DB(ctx, q.database).QueryContext(ctx, GetCollectionsByIdsQuery, pq.Array(ids))
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error getting collections", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	collections := map[int64]Collection{}
+	for rows.Next() {
+		collection, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections[collection.Id] = collection
+	}
+	return collections, rows.Err()
+}
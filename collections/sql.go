@@ -13,5 +13,39 @@ const CountCollectionsQuery = `
 	SELECT COUNT(*) FROM collections;
 `
 const GetCollectionsQuery = `
-	SELECT id, create_at,  user_id FROM collections LIMIT $1 OFFSET $2;
+	SELECT id, created_at, COALESCE(user_id, 0), updated_at
+	FROM collections
+	ORDER BY id
+	LIMIT $1 OFFSET $2;
+`
+
+const GetCollectionQuery = `
+	SELECT id, created_at, COALESCE(user_id, 0), updated_at
+	FROM collections
+	WHERE id = $1;
+`
+
+const GetCollectionsByIdsQuery = `
+	SELECT id, created_at, COALESCE(user_id, 0), updated_at
+	FROM collections
+	WHERE id = ANY($1);
+`
+
+const GetCollectionsLastModifiedQuery = `
+	SELECT COALESCE(MAX(updated_at), 'epoch') FROM collections;
+`
+
+const DropCollectionTableQuery = `
+	DROP TABLE IF EXISTS collections;
+`
+
+const AddCollectionUpdatedAtQuery = `
+	ALTER TABLE collections ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+	CREATE TRIGGER collections_set_updated_at BEFORE UPDATE ON collections
+		FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+`
+
+const DropCollectionUpdatedAtQuery = `
+	DROP TRIGGER IF EXISTS collections_set_updated_at ON collections;
+	ALTER TABLE collections DROP COLUMN IF EXISTS updated_at;
 `
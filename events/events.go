@@ -0,0 +1,203 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Event describes a change to a resource, Type is resource.action such as
+// product.created
+type Event struct {
+	ID       uint64      `json:"id"`
+	Type     string      `json:"type"`
+	Channels []string    `json:"channels"`
+	Data     interface{} `json:"data"`
+	Time     time.Time   `json:"time"`
+	// synthetic changes that never touched the database
+	Simulated bool `json:"simulated,omitempty"`
+	// products inside a collection are hidden from guests like in the REST
+	// list
+	AdminOnly bool `json:"-"`
+	// changes made in a sandbox, which the shared feeds and webhooks skip
+	Sandbox string `json:"-"`
+}
+
+// Subscription receives the events published after it was created, C is
+// closed when the subscriber falls behind or is closed
+type Subscription struct {
+	C   <-chan Event
+	c   chan Event
+	bus *Bus
+}
+
+func (s *Subscription) Close() {
+	s.bus.remove(s)
+}
+
+// Bus fans events out to subscribers without blocking the publisher and
+// keeps the latest ones so clients can resume after a disconnect
+type Bus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[*Subscription]struct{}
+	log         []Event
+	logSize     int
+	// ID of the newest event dropped from the log
+	evicted uint64
+}
+
+func NewBus(logSize int) *Bus {
+	return &Bus{subscribers: map[*Subscription]struct{}{}, logSize: logSize}
+}
+
+// Default carries the changes made through the data layer of every
+// resource package
+var Default = NewBus(1000)
+
+// SetLogSize changes how many published events are kept for Since
+func (b *Bus) SetLogSize(size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logSize = size
+	if len(b.log) > size {
+		b.evicted = b.log[len(b.log)-size-1].ID
+		b.log = append([]Event(nil), b.log[len(b.log)-size:]...)
+	}
+}
+
+// Stamp assigns the next ID and the time without delivering the event, for
+// synthetic events sent to a single client
+func (b *Bus) Stamp(event Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stamp(event)
+}
+
+func (b *Bus) stamp(event Event) Event {
+	b.nextID++
+	event.ID = b.nextID
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	return event
+}
+
+// Publish assigns the event its ID and time and returns it
+func (b *Bus) Publish(event Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	event = b.stamp(event)
+	if b.logSize > 0 {
+		if len(b.log) >= b.logSize {
+			// drop the oldest event without growing the backing array
+			b.evicted = b.log[0].ID
+			copy(b.log, b.log[1:])
+			b.log = b.log[:len(b.log)-1]
+		}
+		b.log = append(b.log, event)
+	} else {
+		b.evicted = event.ID
+	}
+	for s := range b.subscribers {
+		select {
+		case s.c <- event:
+		default:
+			// a subscriber that cannot keep up is dropped rather than
+			// slowing down the request that made the change
+			delete(b.subscribers, s)
+			close(s.c)
+		}
+	}
+	return event
+}
+
+func (b *Bus) Subscribe(buffer int) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribe(buffer)
+}
+
+func (b *Bus) subscribe(buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, bus: b}
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+// SubscribeSince returns the logged events published after lastID together
+// with a subscription to the following ones, so none is missed or repeated.
+// complete is false when some events after lastID already left the log, or
+// when lastID comes from before a restart.
+func (b *Bus) SubscribeSince(lastID uint64, buffer int) (s *Subscription, missed []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, event := range b.log {
+		if event.ID > lastID {
+			missed = append(missed, event)
+		}
+	}
+	return b.subscribe(buffer), missed, lastID >= b.evicted && lastID <= b.nextID
+}
+
+func (b *Bus) remove(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.c)
+	}
+}
+
+type pendingKey struct{}
+
+type sandboxKey struct{}
+
+// WithSandbox marks the events published with ctx as changes of sandbox id
+func WithSandbox(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sandboxKey{}, id)
+}
+
+// Pending holds the events published with a context from Defer until the
+// changes they describe are committed
+type Pending struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Defer returns a context whose events PublishContext keeps in Pending
+// instead of delivering them
+func Defer(ctx context.Context) (context.Context, *Pending) {
+	p := &Pending{}
+	return context.WithValue(ctx, pendingKey{}, p), p
+}
+
+// PublishContext publishes event, or holds it when ctx comes from Defer
+func (b *Bus) PublishContext(ctx context.Context, event Event) {
+	if id, ok := ctx.Value(sandboxKey{}).(string); ok {
+		event.Sandbox = id
+	}
+	if p, ok := ctx.Value(pendingKey{}).(*Pending); ok {
+		p.mu.Lock()
+		p.events = append(p.events, event)
+		p.mu.Unlock()
+		return
+	}
+	b.Publish(event)
+}
+
+// Flush publishes the held events in order, Discard drops them
+func (p *Pending) Flush(b *Bus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, event := range p.events {
+		b.Publish(event)
+	}
+	p.events = nil
+}
+
+func (p *Pending) Discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = nil
+}
@@ -0,0 +1,292 @@
+package feed
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"nojoke/auth"
+	"nojoke/events"
+	"nojoke/lib"
+	"nojoke/openapi"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	// control messages are tiny, anything larger is a misbehaving client
+	maxMessageBytes = 4096
+)
+
+// checkOrigin accepts clients that send no Origin such as scripts, pages
+// served by this host and feed.allowed_origins, the token cookie would
+// otherwise let any site open a feed for a signed in browser
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Message is sent by clients to manage their subscriptions, Action is
+// subscribe, unsubscribe or simulate
+type Message struct {
+	Action  string `json:"action"`
+	Channel string `json:"channel"`
+	// synthetic events per second, 0 stops the simulation
+	Rate float64 `json:"rate"`
+}
+
+// Reply acknowledges a Message, its Type has no dot unlike event types
+type Reply struct {
+	Type     string   `json:"type"`
+	Channel  string   `json:"channel,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+	Rate     float64  `json:"rate,omitempty"`
+	Message  string   `json:"message,omitempty"`
+}
+
+var errCollectionsAdmin = errors.New("Sign in to subscribe to collections")
+
+// parseChannel accepts products, users and collections/{id}
+func parseChannel(channel string, admin *auth.Admin) error {
+	switch channel {
+	case "products", "users":
+		return nil
+	}
+	id, found := strings.CutPrefix(channel, "collections/")
+	if !found {
+		return errors.New("Unknown channel " + channel)
+	}
+	if n, err := strconv.ParseInt(id, 10, 64); err != nil || n < 1 {
+		return errors.New("Invalid collection id " + id)
+	}
+	if admin == nil {
+		return errCollectionsAdmin
+	}
+	return nil
+}
+
+// adminFromRequest verifies the JWT from signInHandler, browsers cannot set
+// headers on WebSocket requests so it may also come as ?token=
+func adminFromRequest(r *http.Request, config *lib.Config) (*auth.Admin, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = auth.TokenFromRequest(r)
+	}
+	if token == "" {
+		return nil, nil
+	}
+	claims, err := auth.ParseToken(token, config.Auth.JWTSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Admin{Username: claims.Username}, nil
+}
+
+// client is one WebSocket connection, only handleFeed writes to conn
+type client struct {
+	conn       *websocket.Conn
+	admin      *auth.Admin
+	channels   map[string]bool
+	simulator  *simulator
+	logger     *lib.Logger
+	maxRate    float64
+	mockConfig lib.MockConfig
+}
+
+func (c *client) write(v interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(v)
+}
+
+// visible reports whether event belongs to a subscribed channel the client
+// may see
+func (c *client) visible(event events.Event) bool {
+	if (event.AdminOnly && c.admin == nil) || event.Sandbox != "" {
+		return false
+	}
+	for _, channel := range event.Channels {
+		if c.channels[channel] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) subscribed() []string {
+	channels := []string{}
+	for channel := range c.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (c *client) handle(message Message) Reply {
+	switch message.Action {
+	case "subscribe":
+		if err := parseChannel(message.Channel, c.admin); err != nil {
+			return Reply{Type: "error", Channel: message.Channel, Message: err.Error()}
+		}
+		c.channels[message.Channel] = true
+		return Reply{Type: "subscribed", Channel: message.Channel, Channels: c.subscribed()}
+	case "unsubscribe":
+		delete(c.channels, message.Channel)
+		return Reply{Type: "unsubscribed", Channel: message.Channel, Channels: c.subscribed()}
+	case "simulate":
+		if message.Rate < 0 || message.Rate > c.maxRate {
+			return Reply{Type: "error", Message: "rate must be between 0 and " + strconv.FormatFloat(c.maxRate, 'f', -1, 64)}
+		}
+		c.simulator.setRate(message.Rate)
+		return Reply{Type: "simulating", Rate: message.Rate}
+	}
+	if message.Action == "" {
+		return Reply{Type: "error", Message: "Invalid message, expected an action"}
+	}
+	return Reply{Type: "error", Message: "Unknown action " + message.Action}
+}
+
+// readMessages forwards control messages until the connection fails or quit
+// is closed
+func (c *client) readMessages(messages chan<- Message, done chan<- struct{}, quit <-chan struct{}) {
+	defer close(done)
+	c.conn.SetReadLimit(maxMessageBytes)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		message := Message{}
+		if err := c.conn.ReadJSON(&message); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+				return
+			}
+			message = Message{}
+		}
+		select {
+		case messages <- message:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func handleFeed(w http.ResponseWriter, r *http.Request, upgrader *websocket.Upgrader, logger *lib.Logger, config *lib.Config) {
+	admin, err := adminFromRequest(r, config)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(401, "Invalid token"))
+		return
+	}
+	requested := []string{}
+	if channels := r.URL.Query().Get("channels"); channels != "" {
+		requested = strings.Split(channels, ",")
+	}
+	for _, channel := range requested {
+		if err := parseChannel(channel, admin); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered with an error status
+		logger.WarnContext(r.Context(), "WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	c := &client{
+		conn:       conn,
+		admin:      admin,
+		channels:   map[string]bool{},
+		simulator:  newSimulator(),
+		logger:     logger,
+		maxRate:    config.Feed.MaxSimulateRate,
+		mockConfig: config.Mock,
+	}
+	defer c.simulator.stop()
+	for _, channel := range requested {
+		c.channels[channel] = true
+	}
+
+	subscription := events.Default.Subscribe(config.Feed.Buffer)
+	defer subscription.Close()
+	messages := make(chan Message)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go c.readMessages(messages, done, quit)
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+	if err := c.write(Reply{Type: "welcome", Channels: c.subscribed()}); err != nil {
+		return
+	}
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case message := <-messages:
+			err = c.write(c.handle(message))
+		case event, ok := <-subscription.C:
+			if !ok {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client too slow"))
+				return
+			}
+			if c.visible(event) {
+				err = c.write(event)
+			}
+		case <-c.simulator.C():
+			if event, ok := c.simulate(); ok {
+				err = c.write(event)
+			}
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func InitFeedRouter(mux *mux.Router, logger *lib.Logger, config *lib.Config) {
+	upgrader := &websocket.Upgrader{CheckOrigin: checkOrigin(config.Feed.AllowedOrigins)}
+	openapi.Describe(mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleFeed(w, r, upgrader, logger, config)
+	}).Methods("GET"), openapi.Operation{
+		Summary: "WebSocket feed of product, collection and user changes, upgrade with ?channels=products,users&token=",
+		Tags:    []string{"realtime"},
+		Raw:     true,
+		Auth:    true,
+	})
+}
@@ -0,0 +1,168 @@
+package feed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"nojoke/auth"
+	"nojoke/events"
+	"nojoke/lib"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func signToken(t *testing.T, secret string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &lib.Claims{
+		Username:         "admin",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAdminFromRequest(t *testing.T) {
+	config := lib.DefaultConfig()
+	config.Auth.JWTSecret = "secret"
+	token := signToken(t, "secret")
+	tests := []struct {
+		name   string
+		target string
+		header string
+		cookie string
+		admin  bool
+		valid  bool
+	}{
+		{"guest", "/ws", "", "", false, true},
+		{"query", "/ws?token=" + token, "", "", true, true},
+		{"bearer header", "/ws", "Bearer " + token, "", true, true},
+		{"cookie", "/ws", "", token, true, true},
+		{"wrong secret", "/ws?token=" + signToken(t, "other"), "", "", false, false},
+		{"garbage", "/ws", "Bearer letmein", "", false, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "token", Value: tt.cookie})
+		}
+		admin, err := adminFromRequest(r, config)
+		if (err == nil) != tt.valid || (admin != nil) != tt.admin {
+			t.Errorf("%s: admin = %v, err = %v", tt.name, admin, err)
+		}
+		if admin != nil && admin.Username != "admin" {
+			t.Errorf("%s: username %q", tt.name, admin.Username)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		ok      bool
+	}{
+		{"no origin", "", nil, true},
+		{"same host", "http://nojoke.test", nil, true},
+		{"other site", "https://evil.example", nil, false},
+		{"allowed origin", "https://app.example", []string{"https://app.example/"}, true},
+		{"other scheme", "http://app.example", []string{"https://app.example"}, false},
+		{"any", "https://evil.example", []string{"*"}, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://nojoke.test/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := checkOrigin(tt.allowed)(r); got != tt.ok {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+}
+
+func TestParseChannel(t *testing.T) {
+	admin := &auth.Admin{Username: "admin"}
+	tests := []struct {
+		channel string
+		admin   *auth.Admin
+		valid   bool
+	}{
+		{"products", nil, true},
+		{"users", nil, true},
+		{"collections/1", admin, true},
+		{"collections/1", nil, false},
+		{"collections/0", admin, false},
+		{"orders", admin, false},
+	}
+	for _, tt := range tests {
+		if err := parseChannel(tt.channel, tt.admin); (err == nil) != tt.valid {
+			t.Errorf("parseChannel(%s, %v) = %v", tt.channel, tt.admin, err)
+		}
+	}
+}
+
+func TestVisible(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   events.Event
+		admin   *auth.Admin
+		visible bool
+	}{
+		{"subscribed channel", events.Event{Channels: []string{"products"}}, nil, true},
+		{"other channel", events.Event{Channels: []string{"users"}}, nil, false},
+		{"admin only for a guest", events.Event{Channels: []string{"products"}, AdminOnly: true}, nil, false},
+		{"admin only for an admin", events.Event{Channels: []string{"products"}, AdminOnly: true}, &auth.Admin{}, true},
+		{"sandbox", events.Event{Channels: []string{"products"}, Sandbox: "1"}, &auth.Admin{}, false},
+	}
+	for _, tt := range tests {
+		c := &client{admin: tt.admin, channels: map[string]bool{"products": true}}
+		if got := c.visible(tt.event); got != tt.visible {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.visible)
+		}
+	}
+}
+
+func TestFeed(t *testing.T) {
+	config := lib.DefaultConfig()
+	config.Auth.JWTSecret = "secret"
+	router := mux.NewRouter()
+	InitFeedRouter(router, lib.NewLogger(nil, lib.LogConfig{Level: "error"}), config)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	endpoint := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?channels=products"
+
+	_, response, err := websocket.DefaultDialer.Dial(endpoint, http.Header{"Origin": {"https://evil.example"}})
+	if err == nil || response == nil || response.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-origin upgrade: %v, %v", response, err)
+	}
+	_, response, err = websocket.DefaultDialer.Dial(endpoint+",collections/1", nil)
+	if err == nil || response == nil || response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("guest on a collection channel: %v, %v", response, err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(endpoint, http.Header{"Origin": {server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := Reply{}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "welcome" || len(reply.Channels) != 1 {
+		t.Fatalf("welcome: %+v, %v", reply, err)
+	}
+	if err := conn.WriteJSON(Message{Action: "subscribe", Channel: "collections/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "error" || reply.Message != errCollectionsAdmin.Error() {
+		t.Errorf("guest subscribing to a collection: %+v, %v", reply, err)
+	}
+}
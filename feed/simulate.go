@@ -0,0 +1,87 @@
+package feed
+
+import (
+	"math/rand"
+	"nojoke/events"
+	product "nojoke/products"
+	user "nojoke/users"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var actions = []string{"created", "updated", "deleted"}
+
+// simulator paces the synthetic events of one client, it is only used by
+// the goroutine that writes to the connection
+type simulator struct {
+	ticker *time.Ticker
+}
+
+func newSimulator() *simulator {
+	return &simulator{}
+}
+
+// setRate switches to rate events per second, 0 stops the simulation
+func (s *simulator) setRate(rate float64) {
+	s.stop()
+	if rate > 0 {
+		s.ticker = time.NewTicker(time.Duration(float64(time.Second) / rate))
+	}
+}
+
+// C is nil, and never ready, while the simulation is stopped
+func (s *simulator) C() <-chan time.Time {
+	if s.ticker == nil {
+		return nil
+	}
+	return s.ticker.C
+}
+
+func (s *simulator) stop() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+		s.ticker = nil
+	}
+}
+
+// simulate makes up a change on one of the subscribed channels with the
+// mock data generators, nothing is written to the database
+func (c *client) simulate() (events.Event, bool) {
+	channels := c.subscribed()
+	if len(channels) == 0 {
+		return events.Event{}, false
+	}
+	channel := channels[rand.Intn(len(channels))]
+	action := actions[rand.Intn(len(actions))]
+
+	var event events.Event
+	if channel == "users" {
+		u := user.GenerateUsers(1)[0]
+		u.Id = rand.Intn(c.mockConfig.Users) + 1
+		if action == "created" {
+			u.Id += c.mockConfig.Users
+		}
+		u.UpdatedAt = time.Now().UTC()
+		if action == "deleted" {
+			u = user.User{Id: u.Id}
+		}
+		event = user.ChangeEvent("user."+action, u)
+	} else {
+		p := product.GenerateProducts(1)[0]
+		p.Id = int64(rand.Intn(c.mockConfig.Products) + 1)
+		if action == "created" {
+			p.Id += int64(c.mockConfig.Products)
+		}
+		if id, found := strings.CutPrefix(channel, "collections/"); found {
+			p.Collection_id, _ = strconv.ParseInt(id, 10, 64)
+		}
+		p.UpdatedAt = time.Now().UTC()
+		if action == "deleted" {
+			p = product.Product{Id: p.Id, Collection_id: p.Collection_id}
+		}
+		event = product.ChangeEvent("product."+action, p)
+	}
+	event.Simulated = true
+	return events.Default.Stamp(event), true
+}
@@ -0,0 +1,104 @@
+package graph
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"nojoke/auth"
+	"nojoke/collections"
+	"nojoke/lib"
+	"nojoke/openapi"
+	product "nojoke/products"
+	user "nojoke/users"
+
+	"github.com/gorilla/mux"
+	"github.com/graph-gophers/graphql-go"
+)
+
+//go:embed schema.graphql
+var schemaSource string
+
+//go:embed graphiql.html
+var graphiqlPage []byte
+
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func handleGraphQL(w http.ResponseWriter, r *http.Request, admin *auth.Admin, schema *graphql.Schema, resolver *Resolver) {
+	w.Header().Set("Content-Type", "application/json")
+	request := Request{}
+	if r.Method == http.MethodGet {
+		request.Query = r.URL.Query().Get("query")
+		request.OperationName = r.URL.Query().Get("operationName")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid variables"))
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+	if request.Query == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Missing query"))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), adminKey, admin)
+	ctx = context.WithValue(ctx, readOnlyKey, r.Method == http.MethodGet)
+	ctx = context.WithValue(ctx, loadersKey, newLoaders(ctx, resolver.collections, resolver.products))
+	response := schema.Exec(ctx, request.Query, request.OperationName, request.Variables)
+	if response.Data == nil && len(response.Errors) > 0 {
+		// the query could not be parsed or validated
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func InitGraphRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config) {
+	resolver := &Resolver{
+		users:       user.NewUserQuery(database, logger),
+		products:    product.NewProductQuery(database, logger),
+		collections: collections.NewCollectionQuery(database, logger),
+	}
+	schema := graphql.MustParseSchema(schemaSource, resolver,
+		graphql.MaxDepth(10),
+		graphql.MaxParallelism(20),
+	)
+
+	handler := auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleGraphQL(w, r, a, schema, resolver)
+	})
+	openapi.Describe(mux.Handle("/graphql", handler).Methods("POST"), openapi.Operation{
+		Summary:  "Run a GraphQL query or mutation over users, products and collections",
+		Tags:     []string{"graphql"},
+		Request:  Request{},
+		Response: map[string]interface{}{},
+		Raw:      true,
+		Auth:     true,
+	})
+	openapi.Describe(mux.Handle("/graphql", handler).Methods("GET"), openapi.Operation{
+		Summary:  "Run a GraphQL query passed as the query, operationName and variables parameters",
+		Tags:     []string{"graphql"},
+		Response: map[string]interface{}{},
+		Raw:      true,
+		Auth:     true,
+	})
+	openapi.Describe(mux.HandleFunc("/graphiql", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(graphiqlPage)
+	}).Methods("GET"), openapi.Operation{Summary: "GraphiQL", Tags: []string{"graphql"}, Raw: true, ContentType: "text/html"})
+	openapi.Describe(mux.HandleFunc("/graphql/schema.graphql", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(schemaSource))
+	}).Methods("GET"), openapi.Operation{Summary: "GraphQL schema in SDL", Tags: []string{"graphql"}, Raw: true, ContentType: "text/plain"})
+}
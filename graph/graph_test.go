@@ -0,0 +1,104 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"nojoke/auth"
+	"nojoke/collections"
+	"nojoke/lib"
+	product "nojoke/products"
+	user "nojoke/users"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/graph-gophers/graphql-go"
+)
+
+func productRows(collectionId int64) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{
+		"id", "name", "price", "description", "discount", "rating", "stock", "brand", "category_id", "thumbnail", "image", "collection_id", "updated_at",
+	}).AddRow(7, "Mug", 12, "A mug", 0, 0, 3, "Nojoke", 1, "", "", collectionId, time.Now())
+}
+
+func TestAuth(t *testing.T) {
+	admin := &auth.Admin{Username: "admin"}
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		admin  *auth.Admin
+		expect func(sqlmock.Sqlmock)
+		data   string
+		err    string
+	}{
+		{"guest reads a product", "POST", `{ product(id: 7) { name } }`, nil,
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta(product.GetProductQuery)).WillReturnRows(productRows(0))
+			}, `{"product":{"name":"Mug"}}`, ""},
+		{"guest reads a product in a collection", "POST", `{ product(id: 7) { name } }`, nil,
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta(product.GetProductQuery)).WillReturnRows(productRows(3))
+			}, `{"product":null}`, ""},
+		{"admin reads a product in a collection", "POST", `{ product(id: 7) { name } }`, admin,
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta(product.GetProductQuery)).WillReturnRows(productRows(3))
+			}, `{"product":{"name":"Mug"}}`, ""},
+		{"guest reads the products of a collection", "POST", `{ collection(id: 3) { products { name } } }`, nil,
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta(collections.GetCollectionQuery)).WillReturnRows(
+					sqlmock.NewRows([]string{"id", "created_at", "user_id", "updated_at"}).AddRow(3, "2024-01-01", 1, time.Now()))
+			}, "", "Unauthorized"},
+		{"guest deletes a product", "POST", `mutation { deleteProduct(id: 7) }`, nil, nil, "", "Unauthorized"},
+		{"guest creates a user", "POST", `mutation { createUser(input: {firstName: "A", lastName: "B", email: "a@b.c"}) { id } }`, nil, nil, "", "Unauthorized"},
+		{"admin mutates over GET", "GET", `mutation { deleteProduct(id: 7) }`, admin, nil, "", "Mutations require a POST request"},
+	}
+	for _, tt := range tests {
+		database, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.expect != nil {
+			tt.expect(mock)
+		}
+		logger := lib.NewLogger(nil, lib.LogConfig{Level: "error"})
+		resolver := &Resolver{
+			users:       user.NewUserQuery(database, logger),
+			products:    product.NewProductQuery(database, logger),
+			collections: collections.NewCollectionQuery(database, logger),
+		}
+		schema := graphql.MustParseSchema(schemaSource, resolver)
+
+		body, _ := json.Marshal(Request{Query: tt.query})
+		r := httptest.NewRequest("POST", "/graphql", bytes.NewReader(body))
+		if tt.method == "GET" {
+			r = httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(tt.query), nil)
+		}
+		w := httptest.NewRecorder()
+		handleGraphQL(w, r, tt.admin, schema, resolver)
+
+		var response struct {
+			Data   json.RawMessage `json:"data"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %v in %s", tt.name, err, w.Body.String())
+		}
+		if tt.data != "" && string(response.Data) != tt.data {
+			t.Errorf("%s: data = %s, want %s", tt.name, response.Data, tt.data)
+		}
+		if tt.err == "" && len(response.Errors) > 0 || tt.err != "" && (len(response.Errors) == 0 || response.Errors[0].Message != tt.err) {
+			t.Errorf("%s: errors = %+v, want %q", tt.name, response.Errors, tt.err)
+		}
+		// guests are turned away before any query runs
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		database.Close()
+	}
+}
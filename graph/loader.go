@@ -0,0 +1,91 @@
+package graph
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// keys requested within this window are fetched together
+const batchWait = time.Millisecond
+
+const maxBatch = 100
+
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+type batch[K comparable, V any] struct {
+	keys       []K
+	calls      []*call[V]
+	dispatched bool
+}
+
+// Loader collects the keys resolvers of one request ask for, fetches them
+// with a single call and remembers the results, so listing 50 products and
+// their collections costs two queries instead of 51
+type Loader[K comparable, V any] struct {
+	ctx   context.Context
+	fetch func(ctx context.Context, keys []K) (map[K]V, error)
+	mu    sync.Mutex
+	cache map[K]*call[V]
+	batch *batch[K, V]
+}
+
+func NewLoader[K comparable, V any](ctx context.Context, fetch func(ctx context.Context, keys []K) (map[K]V, error)) *Loader[K, V] {
+	return &Loader[K, V]{ctx: ctx, fetch: fetch, cache: map[K]*call[V]{}}
+}
+
+// Load returns the value for key, the zero value when fetch did not return
+// one
+func (l *Loader[K, V]) Load(key K) (V, error) {
+	l.mu.Lock()
+	c, ok := l.cache[key]
+	if !ok {
+		c = &call[V]{done: make(chan struct{})}
+		l.cache[key] = c
+		if l.batch == nil {
+			b := &batch[K, V]{}
+			l.batch = b
+			time.AfterFunc(batchWait, func() { l.dispatch(b) })
+		}
+		l.batch.keys = append(l.batch.keys, key)
+		l.batch.calls = append(l.batch.calls, c)
+		if len(l.batch.keys) >= maxBatch {
+			b := l.batch
+			l.batch = nil
+			go l.dispatch(b)
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.value, c.err
+	case <-l.ctx.Done():
+		var zero V
+		return zero, l.ctx.Err()
+	}
+}
+
+func (l *Loader[K, V]) dispatch(b *batch[K, V]) {
+	l.mu.Lock()
+	// a full batch is dispatched early, its timer then finds nothing to do
+	if b.dispatched {
+		l.mu.Unlock()
+		return
+	}
+	b.dispatched = true
+	if l.batch == b {
+		l.batch = nil
+	}
+	l.mu.Unlock()
+
+	values, err := l.fetch(l.ctx, b.keys)
+	for i, key := range b.keys {
+		b.calls[i].value, b.calls[i].err = values[key], err
+		close(b.calls[i].done)
+	}
+}
@@ -0,0 +1,537 @@
+package graph
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"nojoke/auth"
+	"nojoke/cache"
+	"nojoke/collections"
+	"nojoke/lib"
+	product "nojoke/products"
+	user "nojoke/users"
+	"strconv"
+
+	"github.com/graph-gophers/graphql-go"
+)
+
+var errUnauthorized = errors.New("Unauthorized")
+
+type contextKey int
+
+const (
+	adminKey contextKey = iota
+	loadersKey
+	readOnlyKey
+)
+
+// loaders are created for every request so cached results never leak
+// between requests
+type loaders struct {
+	collections *Loader[int64, *collections.Collection]
+	products    *Loader[int64, []product.Product]
+}
+
+func newLoaders(ctx context.Context, cq *collections.CollectionQuery, pq *product.ProductQuery) *loaders {
+	return &loaders{
+		collections: NewLoader(ctx, func(ctx context.Context, ids []int64) (map[int64]*collections.Collection, error) {
+			found, err := cq.FindMany(ctx, ids)
+			loaded := map[int64]*collections.Collection{}
+			for id := range found {
+				collection := found[id]
+				loaded[id] = &collection
+			}
+			return loaded, err
+		}),
+		products: NewLoader(ctx, pq.ByCollections),
+	}
+}
+
+func adminFrom(ctx context.Context) *auth.Admin {
+	admin, _ := ctx.Value(adminKey).(*auth.Admin)
+	return admin
+}
+
+// canMutate requires an admin and a POST request, GET requests may be
+// replayed by browsers and caches
+func canMutate(ctx context.Context) error {
+	if adminFrom(ctx) == nil {
+		return errUnauthorized
+	}
+	if readOnly, _ := ctx.Value(readOnlyKey).(bool); readOnly {
+		return errors.New("Mutations require a POST request")
+	}
+	return nil
+}
+
+func loadersFrom(ctx context.Context) *loaders {
+	return ctx.Value(loadersKey).(*loaders)
+}
+
+func parseID(id graphql.ID) (int64, error) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid Id")
+	}
+	return n, nil
+}
+
+func toID(id int64) graphql.ID {
+	return graphql.ID(strconv.FormatInt(id, 10))
+}
+
+// pagination mirrors lib.PaginationParams, defaults come from the schema
+func pagination(limit int32, page int32) (*lib.Pagination, error) {
+	p := &lib.Pagination{Limit: int(limit), Page: int(page)}
+	if p.Limit < 1 || p.Page < 1 {
+		return nil, errors.New("Invalid query params")
+	}
+	return p, nil
+}
+
+type paginationResolver struct {
+	p *lib.Pagination
+}
+
+func (r paginationResolver) Total() int32 { return int32(r.p.Total) }
+func (r paginationResolver) Limit() int32 { return int32(r.p.Limit) }
+func (r paginationResolver) Page() int32  { return int32(r.p.Page) }
+
+type userResolver struct {
+	u user.User
+}
+
+func (r *userResolver) ID() graphql.ID          { return toID(int64(r.u.Id)) }
+func (r *userResolver) FirstName() string       { return r.u.FirstName }
+func (r *userResolver) LastName() string        { return r.u.LastName }
+func (r *userResolver) Email() string           { return r.u.Email }
+func (r *userResolver) Phone() string           { return r.u.Phone }
+func (r *userResolver) Age() int32              { return int32(r.u.Age) }
+func (r *userResolver) Image() string           { return r.u.Image }
+func (r *userResolver) UpdatedAt() graphql.Time { return graphql.Time{Time: r.u.UpdatedAt} }
+
+type userPageResolver struct {
+	users      []user.User
+	pagination *lib.Pagination
+}
+
+func (r *userPageResolver) Data() []*userResolver {
+	resolvers := []*userResolver{}
+	for _, u := range r.users {
+		resolvers = append(resolvers, &userResolver{u})
+	}
+	return resolvers
+}
+
+func (r *userPageResolver) Pagination() paginationResolver {
+	return paginationResolver{r.pagination}
+}
+
+type productResolver struct {
+	p product.Product
+}
+
+func (r *productResolver) ID() graphql.ID          { return toID(r.p.Id) }
+func (r *productResolver) Name() string            { return r.p.Name }
+func (r *productResolver) Price() int32            { return int32(r.p.Price) }
+func (r *productResolver) Description() string     { return r.p.Description }
+func (r *productResolver) Discount() float64       { return float64(r.p.Discount) }
+func (r *productResolver) Rating() float64         { return float64(r.p.Rating) }
+func (r *productResolver) Stock() int32            { return int32(r.p.Stock) }
+func (r *productResolver) Brand() string           { return r.p.Brand }
+func (r *productResolver) Category() int32         { return int32(r.p.Category_id) }
+func (r *productResolver) Thumbnail() string       { return r.p.Thumbnail }
+func (r *productResolver) Image() string           { return r.p.Image }
+func (r *productResolver) UpdatedAt() graphql.Time { return graphql.Time{Time: r.p.UpdatedAt} }
+
+func (r *productResolver) Collection(ctx context.Context) (*collectionResolver, error) {
+	if r.p.Collection_id == 0 {
+		return nil, nil
+	}
+	collection, err := loadersFrom(ctx).collections.Load(r.p.Collection_id)
+	if err != nil || collection == nil {
+		return nil, err
+	}
+	return &collectionResolver{*collection}, nil
+}
+
+type productPageResolver struct {
+	products   []product.Product
+	pagination *lib.Pagination
+}
+
+func (r *productPageResolver) Data() []*productResolver {
+	return productResolvers(r.products)
+}
+
+func (r *productPageResolver) Pagination() paginationResolver {
+	return paginationResolver{r.pagination}
+}
+
+func productResolvers(products []product.Product) []*productResolver {
+	resolvers := []*productResolver{}
+	for _, p := range products {
+		resolvers = append(resolvers, &productResolver{p})
+	}
+	return resolvers
+}
+
+type collectionResolver struct {
+	c collections.Collection
+}
+
+func (r *collectionResolver) ID() graphql.ID          { return toID(r.c.Id) }
+func (r *collectionResolver) CreatedAt() string       { return r.c.CreateAt }
+func (r *collectionResolver) UserId() int32           { return int32(r.c.UserId) }
+func (r *collectionResolver) UpdatedAt() graphql.Time { return graphql.Time{Time: r.c.UpdatedAt} }
+
+func (r *collectionResolver) Products(ctx context.Context) ([]*productResolver, error) {
+	if adminFrom(ctx) == nil {
+		return nil, errUnauthorized
+	}
+	products, err := loadersFrom(ctx).products.Load(r.c.Id)
+	if err != nil {
+		return nil, err
+	}
+	return productResolvers(products), nil
+}
+
+type collectionPageResolver struct {
+	collections []collections.Collection
+	pagination  *lib.Pagination
+}
+
+func (r *collectionPageResolver) Data() []*collectionResolver {
+	resolvers := []*collectionResolver{}
+	for _, c := range r.collections {
+		resolvers = append(resolvers, &collectionResolver{c})
+	}
+	return resolvers
+}
+
+func (r *collectionPageResolver) Pagination() paginationResolver {
+	return paginationResolver{r.pagination}
+}
+
+// Resolver is the root of the schema
+type Resolver struct {
+	users       *user.UserQuery
+	products    *product.ProductQuery
+	collections *collections.CollectionQuery
+}
+
+type pageArgs struct {
+	Limit int32
+	Page  int32
+}
+
+type idArgs struct {
+	ID graphql.ID
+}
+
+func (r *Resolver) Users(ctx context.Context, args pageArgs) (*userPageResolver, error) {
+	p, err := pagination(args.Limit, args.Page)
+	if err != nil {
+		return nil, err
+	}
+	count, _, err := r.users.LastModified(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.Total = count
+	users, err := r.users.List(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &userPageResolver{users, p}, nil
+}
+
+func (r *Resolver) User(ctx context.Context, args idArgs) (*userResolver, error) {
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	u, err := r.users.FindOne(ctx, int(id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &userResolver{u}, nil
+}
+
+func (r *Resolver) Products(ctx context.Context, args struct {
+	Limit        int32
+	Page         int32
+	CollectionId *graphql.ID
+}) (*productPageResolver, error) {
+	p, err := pagination(args.Limit, args.Page)
+	if err != nil {
+		return nil, err
+	}
+	var collectionId int64
+	if args.CollectionId != nil {
+		if collectionId, err = parseID(*args.CollectionId); err != nil {
+			return nil, err
+		}
+	}
+	products, err := r.products.List(ctx, adminFrom(ctx) == nil, collectionId, p)
+	if err != nil {
+		return nil, err
+	}
+	return &productPageResolver{products, p}, nil
+}
+
+func (r *Resolver) Product(ctx context.Context, args idArgs) (*productResolver, error) {
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := r.products.FindOne(ctx, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// guests only see the products outside of any collection, like the list
+	if adminFrom(ctx) == nil && p.Collection_id != 0 {
+		return nil, nil
+	}
+	return &productResolver{p}, nil
+}
+
+func (r *Resolver) Collections(ctx context.Context, args pageArgs) (*collectionPageResolver, error) {
+	p, err := pagination(args.Limit, args.Page)
+	if err != nil {
+		return nil, err
+	}
+	found, err := r.collections.List(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &collectionPageResolver{found, p}, nil
+}
+
+func (r *Resolver) Collection(ctx context.Context, args idArgs) (*collectionResolver, error) {
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	c, err := r.collections.FindOne(ctx, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &collectionResolver{c}, nil
+}
+
+type userInput struct {
+	FirstName string
+	LastName  string
+	Email     string
+	Phone     *string
+	Age       *int32
+	Image     *string
+	Password  *string
+}
+
+func (input userInput) user() user.User {
+	u := user.User{FirstName: input.FirstName, LastName: input.LastName, Email: input.Email}
+	if input.Phone != nil {
+		u.Phone = *input.Phone
+	}
+	if input.Age != nil {
+		u.Age = int(*input.Age)
+	}
+	if input.Image != nil {
+		u.Image = *input.Image
+	}
+	if input.Password != nil {
+		u.Password = *input.Password
+	}
+	return u
+}
+
+type productInput struct {
+	Name         string
+	Price        int32
+	Description  string
+	Discount     *float64
+	Rating       *float64
+	Stock        *int32
+	Brand        string
+	Category     *int32
+	Thumbnail    *string
+	Image        *string
+	CollectionId *graphql.ID
+}
+
+func (input productInput) product() (product.Product, error) {
+	p := product.Product{Name: input.Name, Price: int(input.Price), Description: input.Description, Brand: input.Brand}
+	if input.Discount != nil {
+		p.Discount = float32(*input.Discount)
+	}
+	if input.Rating != nil {
+		p.Rating = float32(*input.Rating)
+	}
+	if input.Stock != nil {
+		p.Stock = int(*input.Stock)
+	}
+	if input.Category != nil {
+		p.Category_id = int(*input.Category)
+	}
+	if input.Thumbnail != nil {
+		p.Thumbnail = *input.Thumbnail
+	}
+	if input.Image != nil {
+		p.Image = *input.Image
+	}
+	if input.CollectionId != nil {
+		id, err := parseID(*input.CollectionId)
+		if err != nil {
+			return p, err
+		}
+		p.Collection_id = id
+	}
+	return p, nil
+}
+
+// validate runs the same gookit rules as the REST handlers
+func validate[T interface{}](form T) error {
+	if isValid, message := lib.ValidateForm(form); !isValid {
+		return errors.New(message)
+	}
+	return nil
+}
+
+func (r *Resolver) CreateUser(ctx context.Context, args struct{ Input userInput }) (*userResolver, error) {
+	if err := canMutate(ctx); err != nil {
+		return nil, err
+	}
+	u := args.Input.user()
+	if err := validate(u); err != nil {
+		return nil, err
+	}
+	u, err := r.users.Create(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	cache.Invalidate(ctx, "/api/users")
+	return &userResolver{u}, nil
+}
+
+func (r *Resolver) UpdateUser(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input userInput
+}) (*userResolver, error) {
+	if err := canMutate(ctx); err != nil {
+		return nil, err
+	}
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	u := args.Input.user()
+	if err := validate(u); err != nil {
+		return nil, err
+	}
+	u.Id = int(id)
+	u, err = r.users.Update(ctx, u)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("User not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	cache.Invalidate(ctx, "/api/users")
+	return &userResolver{u}, nil
+}
+
+func (r *Resolver) DeleteUser(ctx context.Context, args idArgs) (graphql.ID, error) {
+	if err := canMutate(ctx); err != nil {
+		return "", err
+	}
+	id, err := parseID(args.ID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.users.FindOne(ctx, int(id)); err == sql.ErrNoRows {
+		return "", errors.New("User not found")
+	}
+	if err := r.users.Delete(ctx, int(id)); err != nil {
+		return "", err
+	}
+	cache.Invalidate(ctx, "/api/users")
+	return args.ID, nil
+}
+
+func (r *Resolver) CreateProduct(ctx context.Context, args struct{ Input productInput }) (*productResolver, error) {
+	if err := canMutate(ctx); err != nil {
+		return nil, err
+	}
+	p, err := args.Input.product()
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(p); err != nil {
+		return nil, err
+	}
+	p, err = r.products.Create(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	cache.Invalidate(ctx, "/api/products")
+	return &productResolver{p}, nil
+}
+
+func (r *Resolver) UpdateProduct(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input productInput
+}) (*productResolver, error) {
+	if err := canMutate(ctx); err != nil {
+		return nil, err
+	}
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := args.Input.product()
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(p); err != nil {
+		return nil, err
+	}
+	p.Id = id
+	p, err = r.products.Update(ctx, p)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Product not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	cache.Invalidate(ctx, "/api/products")
+	return &productResolver{p}, nil
+}
+
+func (r *Resolver) DeleteProduct(ctx context.Context, args idArgs) (graphql.ID, error) {
+	if err := canMutate(ctx); err != nil {
+		return "", err
+	}
+	id, err := parseID(args.ID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.products.FindOne(ctx, id); err == sql.ErrNoRows {
+		return "", errors.New("Product not found")
+	}
+	if err := r.products.Delete(ctx, id); err != nil {
+		return "", err
+	}
+	cache.Invalidate(ctx, "/api/products")
+	return args.ID, nil
+}
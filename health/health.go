@@ -0,0 +1,145 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"nojoke/lib"
+	"nojoke/migrations"
+	"nojoke/openapi"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Version is set at build time with -ldflags "-X nojoke/health.Version=..."
+var Version = "dev"
+
+const (
+	StatusUp       = "up"
+	StatusDown     = "down"
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+)
+
+type Readiness interface {
+	Ready() bool
+}
+
+type ComponentStatus struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+	Pending   int     `json:"pending,omitempty"`
+}
+
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Version    string                     `json:"version"`
+	Uptime     string                     `json:"uptime"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+var startedAt = time.Now()
+
+func checkDatabase(ctx context.Context, database *sql.DB) ComponentStatus {
+	start := time.Now()
+	err := database.PingContext(ctx)
+	status := ComponentStatus{
+		Status:    StatusUp,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		status.Status = StatusDown
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func checkMigrations(ctx context.Context, database *sql.DB) ComponentStatus {
+	start := time.Now()
+	pending, err := migrations.Pending(ctx, database)
+	status := ComponentStatus{
+		Status:    StatusUp,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		status.Status = StatusDown
+		status.Error = err.Error()
+		return status
+	}
+	if len(pending) > 0 {
+		status.Status = StatusDown
+		status.Pending = len(pending)
+		status.Error = "pending migrations"
+	}
+	return status
+}
+
+func checkServer(readiness Readiness) ComponentStatus {
+	if !readiness.Ready() {
+		return ComponentStatus{Status: StatusDown, Error: "shutting down"}
+	}
+	return ComponentStatus{Status: StatusUp}
+}
+
+func writeHealth(w http.ResponseWriter, response HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func handleLive(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, HealthResponse{
+		Status:  StatusOK,
+		Version: Version,
+		Uptime:  time.Since(startedAt).Round(time.Second).String(),
+	})
+}
+
+func handleReady(w http.ResponseWriter, r *http.Request, database *sql.DB, config *lib.Config, readiness Readiness) {
+	ctx, cancel := context.WithTimeout(r.Context(), config.Health.Timeout)
+	defer cancel()
+
+	components := map[string]ComponentStatus{
+		"server":   checkServer(readiness),
+		"database": checkDatabase(ctx, database),
+	}
+	if components["database"].Status == StatusUp {
+		components["migrations"] = checkMigrations(ctx, database)
+	} else {
+		components["migrations"] = ComponentStatus{Status: StatusDown, Error: "database unavailable"}
+	}
+
+	status := StatusOK
+	for _, component := range components {
+		if component.Status != StatusUp {
+			status = StatusDegraded
+		}
+	}
+	writeHealth(w, HealthResponse{
+		Status:     status,
+		Version:    Version,
+		Uptime:     time.Since(startedAt).Round(time.Second).String(),
+		Components: components,
+	})
+}
+
+func InitHealthRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config, readiness Readiness) {
+	ready := func(w http.ResponseWriter, r *http.Request) {
+		handleReady(w, r, database, config, readiness)
+	}
+	openapi.Describe(mux.HandleFunc("/health", ready).Methods("GET"),
+		openapi.Operation{Summary: "Readiness, kept for older probes", Response: HealthResponse{}, Raw: true})
+	router := mux.PathPrefix("/health").Subrouter()
+	openapi.Describe(router.HandleFunc("/live", handleLive).Methods("GET"),
+		openapi.Operation{Summary: "Liveness", Response: HealthResponse{}, Raw: true})
+	openapi.Describe(router.HandleFunc("/ready", ready).Methods("GET"),
+		openapi.Operation{Summary: "Readiness of the server and its dependencies", Response: HealthResponse{}, Raw: true})
+}
@@ -0,0 +1,318 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ImportRowError tells why a row was not imported, rows are counted from 1:
+// CSV records after the header, JSON array items and NDJSON lines
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+type ImportResult struct {
+	DryRun bool `json:"dry_run"`
+	// atomic imports store every row or none
+	Atomic   bool             `json:"atomic"`
+	Rows     int              `json:"rows"`
+	Valid    int              `json:"valid"`
+	Imported int              `json:"imported"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+// ImportStore stores values and returns how many were stored and the errors
+// by index into values. An atomic store stores all of them or none.
+type ImportStore[T any] func(ctx context.Context, values []T, atomic bool) (int, map[int]error)
+
+var ndjsonTypes = map[string]bool{
+	"application/x-ndjson": true,
+	"application/ndjson":   true,
+	"application/jsonl":    true,
+	"application/x-jsonl":  true,
+}
+
+// readRows calls each for every row of a CSV, JSON array or NDJSON body, a
+// row that cannot be parsed on its own is passed as an error
+func readRows(body io.Reader, mediaType string, each func(row int, value interface{}, err error) error) error {
+	switch {
+	case mediaType == "text/csv" || mediaType == "application/csv":
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err == io.EOF {
+			return errors.New("CSV body needs a header")
+		}
+		if err != nil {
+			return err
+		}
+		for row := 1; ; row++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if len(record) != len(header) {
+				err := errors.New("expected " + strconv.Itoa(len(header)) + " fields, got " + strconv.Itoa(len(record)))
+				if err := each(row, nil, err); err != nil {
+					return err
+				}
+				continue
+			}
+			value := map[string]interface{}{}
+			for i, column := range header {
+				value[strings.TrimSpace(column)] = record[i]
+			}
+			if err := each(row, value, nil); err != nil {
+				return err
+			}
+		}
+	case ndjsonTypes[mediaType]:
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for row := 1; scanner.Scan(); row++ {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			var value interface{}
+			err := json.Unmarshal(scanner.Bytes(), &value)
+			if err := each(row, value, err); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	case mediaType == "" || mediaType == "application/json":
+		decoder := json.NewDecoder(body)
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return errors.New("empty body")
+		}
+		if err != nil {
+			return err
+		}
+		if token != json.Delim('[') {
+			return errors.New("JSON body must be an array")
+		}
+		for row := 1; decoder.More(); row++ {
+			var value interface{}
+			if err := decoder.Decode(&value); err != nil {
+				return err
+			}
+			if err := each(row, value, nil); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+		return err
+	}
+	return errors.New("Unsupported Content-Type " + mediaType + ", expected CSV, JSON or NDJSON")
+}
+
+// storeError keeps the database's reason, such as a value that is too long,
+// and hides anything else
+func storeError(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Message
+	}
+	return "Error storing row"
+}
+
+// Import reads a CSV, JSON array or NDJSON body into T, validates every row
+// with validate and, unless ?dry_run=true, hands the valid rows to store.
+// ?mode=atomic (the default) imports nothing when any row is invalid,
+// ?mode=best_effort imports the valid rows and reports the others.
+func Import[T any](w http.ResponseWriter, r *http.Request, config ImportConfig, validate func(T) (bool, string), store ImportStore[T]) {
+	query := r.URL.Query()
+	result := ImportResult{DryRun: query.Get("dry_run") == "true" || query.Get("dry_run") == "1", Errors: []ImportRowError{}}
+	switch query.Get("mode") {
+	case "", "atomic":
+		result.Atomic = true
+	case "best_effort":
+	default:
+		Render(w, r, http.StatusBadRequest, NewErrorResponse(400, "Invalid mode, expected atomic or best_effort"))
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+
+	values := []T{}
+	rows := []int{}
+	body := http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
+	err = readRows(body, mediaType, func(row int, value interface{}, err error) error {
+		result.Rows++
+		if result.Rows > config.MaxRows {
+			return errors.New("Too many rows, at most " + strconv.Itoa(config.MaxRows) + " can be imported at once")
+		}
+		var data T
+		if err == nil {
+			err = DecodeValue(value, &data)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, ImportRowError{row, err.Error()})
+			return nil
+		}
+		if isValid, message := validate(data); !isValid {
+			result.Errors = append(result.Errors, ImportRowError{row, message})
+			return nil
+		}
+		values = append(values, data)
+		rows = append(rows, row)
+		return nil
+	})
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		Render(w, r, http.StatusRequestEntityTooLarge, NewErrorResponse(413, "Body larger than "+strconv.FormatInt(config.MaxBodyBytes, 10)+" bytes"))
+		return
+	}
+	if err != nil {
+		Render(w, r, http.StatusBadRequest, NewErrorResponse(400, err.Error()))
+		return
+	}
+	result.Valid = len(values)
+
+	if result.Atomic && len(result.Errors) > 0 {
+		Render(w, r, http.StatusUnprocessableEntity, NewDataResponse(422, "Import rejected, no rows were imported", result))
+		return
+	}
+	if result.DryRun || len(values) == 0 {
+		Render(w, r, http.StatusOK, NewDataResponse(200, "OK", result))
+		return
+	}
+	imported, failures := store(r.Context(), values, result.Atomic)
+	result.Imported = imported
+	for i, err := range failures {
+		result.Errors = append(result.Errors, ImportRowError{rows[i], storeError(err)})
+	}
+	sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].Row < result.Errors[j].Row })
+	if result.Atomic && len(failures) > 0 {
+		Render(w, r, http.StatusUnprocessableEntity, NewDataResponse(422, "Import rejected, no rows were imported", result))
+		return
+	}
+	w.Header().Set("Cache-Control", CacheControlNoStore)
+	Render(w, r, http.StatusOK, NewDataResponse(201, "OK", result))
+}
+
+// Exporter streams rows as CSV, with the JSON field names as the header, or
+// as NDJSON, flushing every few rows so nothing is held in memory
+type Exporter struct {
+	w       http.ResponseWriter
+	ndjson  bool
+	csv     *csv.Writer
+	columns []string
+	rows    int
+}
+
+// ExportFormat reads csv or ndjson from ?format= or the Accept header, CSV
+// when neither asks for NDJSON
+func ExportFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if format != "csv" && format != "ndjson" {
+			return "", errors.New("Unsupported format " + format + ", expected csv or ndjson")
+		}
+		return format, nil
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && ndjsonTypes[mediaType] {
+			return "ndjson", nil
+		}
+	}
+	return "csv", nil
+}
+
+// NewExporter writes the headers of a download named name plus the
+// extension, the CSV columns are the fields of sample
+func NewExporter(w http.ResponseWriter, format string, name string, sample interface{}) (*Exporter, error) {
+	e := &Exporter{w: w, ndjson: format == "ndjson"}
+	if e.ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.ndjson"`)
+	} else {
+		doc, err := document(sample)
+		if err != nil {
+			return nil, err
+		}
+		o, ok := doc.(object)
+		if !ok {
+			return nil, errors.New("export: sample is not an object")
+		}
+		for _, m := range o {
+			e.columns = append(e.columns, m.key)
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	}
+	w.Header().Set("Cache-Control", CacheControlNoStore)
+	w.WriteHeader(http.StatusOK)
+	if !e.ndjson {
+		e.csv = csv.NewWriter(w)
+		e.csv.Write(e.columns)
+	}
+	return e, nil
+}
+
+func (e *Exporter) Write(v interface{}) error {
+	if e.ndjson {
+		if err := json.NewEncoder(e.w).Encode(v); err != nil {
+			return err
+		}
+	} else {
+		doc, err := document(v)
+		if err != nil {
+			return err
+		}
+		record := make([]string, len(e.columns))
+		if o, ok := doc.(object); ok {
+			for _, m := range o {
+				for i, column := range e.columns {
+					if column == m.key {
+						record[i] = scalar(m.value)
+					}
+				}
+			}
+		}
+		if err := e.csv.Write(record); err != nil {
+			return err
+		}
+	}
+	e.rows++
+	if e.rows%100 == 0 {
+		e.flush()
+	}
+	return nil
+}
+
+func (e *Exporter) flush() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+	if flusher, ok := e.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes out the last rows
+func (e *Exporter) Close() error {
+	e.flush()
+	if e.csv != nil {
+		return e.csv.Error()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRows(t *testing.T) {
+	type row struct {
+		Row   int
+		Value interface{}
+		Error bool
+	}
+	tests := []struct {
+		name      string
+		mediaType string
+		body      string
+		rows      []row
+		err       string
+	}{
+		{"csv", "text/csv", "name, price\nmug,12\ncup,3\n", []row{
+			{1, map[string]interface{}{"name": "mug", "price": "12"}, false},
+			{2, map[string]interface{}{"name": "cup", "price": "3"}, false},
+		}, ""},
+		{"csv row with missing fields", "application/csv", "name,price\nmug\ncup,3\n", []row{
+			{1, nil, true},
+			{2, map[string]interface{}{"name": "cup", "price": "3"}, false},
+		}, ""},
+		{"csv without a header", "text/csv", "", nil, "CSV body needs a header"},
+		{"csv with a broken quote", "text/csv", "name\n\"mug\n", nil, "extraneous or missing"},
+		{"json array", "application/json", `[{"name": "mug"}, {"name": "cup"}]`, []row{
+			{1, map[string]interface{}{"name": "mug"}, false},
+			{2, map[string]interface{}{"name": "cup"}, false},
+		}, ""},
+		{"json without a content type", "", `[]`, nil, ""},
+		{"json object", "application/json", `{"name": "mug"}`, nil, "JSON body must be an array"},
+		{"empty json", "application/json", ``, nil, "empty body"},
+		{"truncated json", "application/json", `[{"name": "mug"}, {"name"`, []row{
+			{1, map[string]interface{}{"name": "mug"}, false},
+		}, "unexpected EOF"},
+		{"ndjson", "application/x-ndjson", "{\"name\": \"mug\"}\n\n{broken\n{\"name\": \"cup\"}\n", []row{
+			{1, map[string]interface{}{"name": "mug"}, false},
+			{3, nil, true},
+			{4, map[string]interface{}{"name": "cup"}, false},
+		}, ""},
+		{"unsupported", "application/xml", `<users/>`, nil, "Unsupported Content-Type application/xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := []row{}
+			err := readRows(strings.NewReader(tt.body), tt.mediaType, func(n int, value interface{}, err error) error {
+				rows = append(rows, row{n, value, err != nil})
+				return nil
+			})
+			if tt.err == "" && err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+			if tt.rows == nil {
+				tt.rows = []row{}
+			}
+			if !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("rows = %#v, want %#v", rows, tt.rows)
+			}
+		})
+	}
+}
+
+func TestReadRowsStopsOnCallbackError(t *testing.T) {
+	stop := errors.New("too many rows")
+	calls := 0
+	err := readRows(strings.NewReader("a\n1\n2\n3\n"), "text/csv", func(int, interface{}, error) error {
+		calls++
+		if calls == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || calls != 2 {
+		t.Errorf("err = %v after %d rows", err, calls)
+	}
+}
@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CacheControlResource = "public, max-age=60, must-revalidate"
+	CacheControlList     = "public, max-age=30, must-revalidate"
+	CacheControlPrivate  = "private, max-age=30, must-revalidate"
+	CacheControlNoStore  = "no-store"
+)
+
+func hashJSON(v interface{}) string {
+	content, _ := json.Marshal(v)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:16])
+}
+
+// ETag returns a strong validator for the JSON representation of v, used
+// for single resources where byte equality is meaningful
+func ETag(v interface{}) string {
+	return `"` + hashJSON(v) + `"`
+}
+
+// WeakETag returns a weak validator for v, used for list responses
+func WeakETag(v interface{}) string {
+	return `W/"` + hashJSON(v) + `"`
+}
+
+func parseETags(header string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func opaqueTag(tag string) string {
+	return strings.TrimPrefix(tag, "W/")
+}
+
+// formatETag tells the representations of a resource apart, a strong
+// ETag promises identical bytes and the XML of a user is not its JSON. JSON
+// keeps the plain ETag.
+func formatETag(r *http.Request, etag string) string {
+	f, ok := r.Context().Value(formatKey{}).(format)
+	if !ok {
+		f, _ = negotiate(r)
+	}
+	if etag == "" || f.name == "" || f.name == "json" {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + f.name + `"`
+}
+
+// SetValidators writes the ETag of the negotiated format and the
+// Last-Modified headers, a zero lastModified is omitted
+func SetValidators(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) {
+	varyAccept(w)
+	if etag != "" {
+		w.Header().Set("ETag", formatETag(r, etag))
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// NotModified sets the validators and answers 304 when If-None-Match (weak
+// comparison) or, in its absence, If-Modified-Since matches
+func NotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	SetValidators(w, r, etag, lastModified)
+	return NotModifiedAs(w, r, formatETag(r, etag), lastModified)
+}
+
+// NotModifiedAs answers 304 like NotModified for an etag that is already
+// formatted, such as the one stored with a cached response, and leaves the
+// validator headers to the caller
+func NotModifiedAs(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	notModified := false
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, tag := range parseETags(header) {
+			if tag == "*" || opaqueTag(tag) == opaqueTag(etag) {
+				notModified = true
+			}
+		}
+	} else if header := r.Header.Get("If-Modified-Since"); header != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(header)
+		if err == nil && !lastModified.Truncate(time.Second).After(since) {
+			notModified = true
+		}
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// PreconditionFailed answers 412 when If-Match (strong comparison) does not
+// match the current etag, or when If-Unmodified-Since is older than
+// lastModified
+func PreconditionFailed(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	etag = formatETag(r, etag)
+	failed := false
+	if header := r.Header.Get("If-Match"); header != "" {
+		failed = true
+		for _, tag := range parseETags(header) {
+			if tag == "*" || (!strings.HasPrefix(tag, "W/") && tag == etag) {
+				failed = false
+			}
+		}
+	} else if header := r.Header.Get("If-Unmodified-Since"); header != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(header)
+		if err == nil && lastModified.Truncate(time.Second).After(since) {
+			failed = true
+		}
+	}
+	if failed {
+		w.Header().Set("ETag", etag)
+		Render(w, r, http.StatusPreconditionFailed, NewErrorResponse(412, "Precondition failed"))
+	}
+	return failed
+}
@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	etag := `"abc"`
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    bool
+	}{
+		{"no validators", "GET", nil, false},
+		{"matching etag", "GET", map[string]string{"If-None-Match": `"abc"`}, true},
+		{"weak comparison", "GET", map[string]string{"If-None-Match": `W/"abc"`}, true},
+		{"one of several", "GET", map[string]string{"If-None-Match": `"x", "abc"`}, true},
+		{"star", "GET", map[string]string{"If-None-Match": "*"}, true},
+		{"other etag", "GET", map[string]string{"If-None-Match": `"x"`}, false},
+		{"etag wins over date", "GET", map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": modified.Format(http.TimeFormat)}, false},
+		{"same second", "GET", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, true},
+		{"modified since", "GET", map[string]string{"If-Modified-Since": modified.Add(-time.Second).Format(http.TimeFormat)}, false},
+		{"bad date", "GET", map[string]string{"If-Modified-Since": "yesterday"}, false},
+		{"head", "HEAD", map[string]string{"If-None-Match": `"abc"`}, true},
+		{"not for writes", "PUT", map[string]string{"If-None-Match": `"abc"`}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			if got := NotModified(w, r, etag, modified.Add(500*time.Millisecond)); got != tt.want {
+				t.Fatalf("NotModified = %v, want %v", got, tt.want)
+			}
+			if w.Header().Get("ETag") != etag {
+				t.Errorf("ETag header = %q", w.Header().Get("ETag"))
+			}
+			if tt.want && w.Code != http.StatusNotModified {
+				t.Errorf("status = %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestPreconditionFailed(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	etag := `"abc"`
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no preconditions", nil, false},
+		{"matching etag", map[string]string{"If-Match": `"abc"`}, false},
+		{"star", map[string]string{"If-Match": "*"}, false},
+		{"weak tags never match", map[string]string{"If-Match": `W/"abc"`}, true},
+		{"other etag", map[string]string{"If-Match": `"x"`}, true},
+		{"unmodified", map[string]string{"If-Unmodified-Since": modified.Format(http.TimeFormat)}, false},
+		{"modified after", map[string]string{"If-Unmodified-Since": modified.Add(-time.Second).Format(http.TimeFormat)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/", nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			if got := PreconditionFailed(w, r, etag, modified); got != tt.want {
+				t.Fatalf("PreconditionFailed = %v, want %v", got, tt.want)
+			}
+			if tt.want && w.Code != http.StatusPreconditionFailed {
+				t.Errorf("status = %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestETags(t *testing.T) {
+	a := map[string]int{"id": 1}
+	if ETag(a) != ETag(map[string]int{"id": 1}) {
+		t.Error("equal values need equal etags")
+	}
+	if ETag(a) == ETag(map[string]int{"id": 2}) {
+		t.Error("different values need different etags")
+	}
+	if WeakETag(a) != "W/"+ETag(a) {
+		t.Errorf("weak etag = %s", WeakETag(a))
+	}
+}
+
+func TestETagVariesByFormat(t *testing.T) {
+	tests := []struct {
+		query  string
+		accept string
+		want   string
+	}{
+		{"", "", `"abc"`},
+		{"", "application/json", `"abc"`},
+		{"", "application/xml", `"abc-xml"`},
+		{"format=yaml", "application/json", `"abc-yaml"`},
+		{"format=bogus", "", `"abc"`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		SetValidators(w, r, `"abc"`, time.Time{})
+		if got := w.Header().Get("ETag"); got != tt.want {
+			t.Errorf("%s %s: ETag = %s, want %s", tt.query, tt.accept, got, tt.want)
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("Vary = %q", w.Header().Get("Vary"))
+		}
+	}
+
+	// a JSON ETag does not validate the XML representation
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/xml")
+	r.Header.Set("If-None-Match", `"abc"`)
+	if NotModified(httptest.NewRecorder(), r, `"abc"`, time.Time{}) {
+		t.Error("the JSON ETag matched the XML representation")
+	}
+	r.Header.Set("If-None-Match", `"abc-xml"`)
+	if !NotModified(httptest.NewRecorder(), r, `"abc"`, time.Time{}) {
+		t.Error("the XML ETag did not match")
+	}
+	r = httptest.NewRequest("PUT", "/", nil)
+	r.Header.Set("Accept", "application/xml")
+	r.Header.Set("If-Match", `"abc-xml"`)
+	if PreconditionFailed(httptest.NewRecorder(), r, `"abc"`, time.Time{}) {
+		t.Error("If-Match with the XML ETag failed")
+	}
+}
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFormats(t *testing.T) {
+	// empty variables are ignored, so the environment cannot override the file
+	for _, name := range []string{"PORT", "JWT_SECRET"} {
+		t.Setenv(name, "")
+	}
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"yaml", "config.yaml", "server:\n  port: \"8080\"\n  read_timeout: 3s\nauth:\n  jwt_secret: secret\nbatch:\n  max_requests: 7\n"},
+		{"toml", "config.toml", "[server]\nport = \"8080\"\nread_timeout = \"3s\"\n[auth]\njwt_secret = \"secret\"\n[batch]\nmax_requests = 7\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := LoadConfig(path, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Server.Port != "8080" || config.Server.ReadTimeout != 3*time.Second {
+				t.Errorf("server = %+v", config.Server)
+			}
+			if config.Auth.JWTSecret != "secret" || config.Batch.MaxRequests != 7 {
+				t.Errorf("auth = %+v, batch = %+v", config.Auth, config.Batch)
+			}
+			// keys missing from the file keep their defaults
+			if config.Batch.MaxBodyBytes != DefaultConfig().Batch.MaxBodyBytes {
+				t.Errorf("batch max_body_bytes = %d", config.Batch.MaxBodyBytes)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidTOML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("[server\nport = 1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path, ""); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,223 @@
+package lib
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// DecodeBody decodes the body of r into v according to its Content-Type,
+// JSON when it has none. XML, CSV, YAML and MessagePack bodies are mapped
+// onto the JSON field names of v, so the same struct tags apply.
+func DecodeBody(r *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+	f := formats[0]
+	if mediaType != "" {
+		var ok bool
+		if f, ok = formatByMediaType(mediaType); !ok {
+			return errors.New("Unsupported Content-Type " + mediaType + ", expected JSON, XML, CSV, YAML or MessagePack")
+		}
+	}
+	var value interface{}
+	switch f.name {
+	case "json":
+		return json.NewDecoder(r.Body).Decode(v)
+	case "xml":
+		value, err = decodeXML(r.Body)
+	case "csv":
+		value, err = decodeCSV(r.Body)
+	case "yaml":
+		err = yaml.NewDecoder(r.Body).Decode(&value)
+	case "msgpack":
+		err = msgpack.NewDecoder(r.Body).Decode(&value)
+	}
+	if err == io.EOF {
+		return errors.New("empty body")
+	}
+	if err != nil {
+		return err
+	}
+	return DecodeValue(value, v)
+}
+
+// DecodeValue stores a decoded document in v through its JSON encoding,
+// converting text such as "42" or "true" where v has a number or a boolean
+func DecodeValue(value interface{}, v interface{}) error {
+	content, err := json.Marshal(coerce(value, reflect.TypeOf(v)))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// jsonFields maps the lower case JSON names of the fields of t, embedded
+// structs included, to their types
+func jsonFields(t reflect.Type, fields map[string]reflect.Type) map[string]reflect.Type {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			jsonFields(field.Type, fields)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field.Type
+	}
+	return fields
+}
+
+func coerce(value interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil {
+		return value
+	}
+	switch v := value.(type) {
+	case string:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			// an empty CSV cell or XML element leaves the zero value
+			if v == "" {
+				return nil
+			}
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				return json.Number(v)
+			}
+		case reflect.Bool:
+			if v == "" {
+				return nil
+			}
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		case reflect.Slice:
+			// a single XML element or CSV cell for a list
+			if t.Elem().Kind() != reflect.Uint8 && v != "" {
+				return []interface{}{coerce(v, t.Elem())}
+			}
+		}
+		return v
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return v
+		}
+		fields := jsonFields(t, map[string]reflect.Type{})
+		for key, item := range v {
+			if fieldType, ok := fields[strings.ToLower(key)]; ok {
+				v[key] = coerce(item, fieldType)
+			}
+		}
+		return v
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return v
+		}
+		for i := range v {
+			v[i] = coerce(v[i], t.Elem())
+		}
+		return v
+	}
+	return value
+}
+
+// decodeXML reads the children of the root element, the element name is
+// not checked. Repeated elements and <item> children become lists.
+func decodeXML(r io.Reader) (interface{}, error) {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := token.(xml.StartElement); ok {
+			return readElement(decoder)
+		}
+	}
+}
+
+func readElement(decoder *xml.Decoder) (interface{}, error) {
+	children := map[string]interface{}{}
+	repeated := map[string]bool{}
+	items := []interface{}{}
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			child, err := readElement(decoder)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			if name == "item" {
+				items = append(items, child)
+				continue
+			}
+			existing, ok := children[name]
+			switch {
+			case !ok:
+				children[name] = child
+			case repeated[name]:
+				children[name] = append(existing.([]interface{}), child)
+			default:
+				repeated[name] = true
+				children[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if len(items) > 0 && len(children) == 0 {
+				return items, nil
+			}
+			if len(children) > 0 {
+				return children, nil
+			}
+			return strings.TrimSpace(text.String()), nil
+		}
+	}
+}
+
+// decodeCSV reads a header and one record into an object
+func decodeCSV(r io.Reader) (interface{}, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	record, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV body needs a header and a record")
+	}
+	if err != nil {
+		return nil, err
+	}
+	value := map[string]interface{}{}
+	for i, column := range header {
+		value[strings.TrimSpace(column)] = record[i]
+	}
+	return value, nil
+}
@@ -1,35 +1,169 @@
 package lib
 
 import (
-	"log"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// Logger is a leveled slog logger that also acts as the request logging
+// middleware in front of handler
 type Logger struct {
-	logger  *log.Logger
+	*slog.Logger
 	handler http.Handler
 }
 
-func NewLogger(handler http.Handler) *Logger {
-	logger := log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	logger.SetPrefix("INFO: ")
-	logger.SetFlags(log.Ldate | log.Lmicroseconds | log.Llongfile)
-	return &Logger{logger, handler}
+func NewLogger(handler http.Handler, config LogConfig) *Logger {
+	options := &slog.HandlerOptions{Level: parseLevel(config.Level)}
+	var base slog.Handler
+	if config.Format == "text" {
+		base = slog.NewTextHandler(os.Stdout, options)
+	} else {
+		base = slog.NewJSONHandler(os.Stdout, options)
+	}
+	return &Logger{slog.New(&contextHandler{base}), handler}
+}
+
+func parseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// contextHandler adds the request id stored in the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
 }
 
-func (l *Logger) Info(message string) {
-	l.logger.Println(message)
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
 }
 
-func (l *Logger) Error(message string) {
-	l.logger.SetPrefix(" ERROR: ")
-	l.logger.Println(message)
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ResponseWriter records the status code and body size written by a handler
+type ResponseWriter struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int
+}
+
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	if rw, ok := w.(*ResponseWriter); ok {
+		return rw
+	}
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.Status == 0 {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += n
+	return n, err
+}
+
+func (w *ResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return hijacker.Hijack()
+}
+
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 func (l *Logger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	l.handler.ServeHTTP(w, r)
-	log.Printf("%s %s %v", r.Method, r.URL.Path, time.Since(start))
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > 128 {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	ctx := WithRequestID(r.Context(), id)
+
+	rw := NewResponseWriter(w)
+	l.handler.ServeHTTP(rw, r.WithContext(ctx))
+
+	status := rw.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	} else if status >= 400 {
+		level = slog.LevelWarn
+	}
+	l.LogAttrs(ctx, level, "request",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", status),
+		slog.Int("bytes", rw.Bytes),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("remote_addr", r.RemoteAddr),
+	)
 }
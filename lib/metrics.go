@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nojoke_http_requests_total",
+		Help: "Number of HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nojoke_http_request_duration_seconds",
+		Help:    "HTTP request latency by route template, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+)
+
+// Metrics records request counts and latency for handler, labelled with the
+// route template found by Routes
+type Metrics struct {
+	handler http.Handler
+}
+
+func NewMetrics(handler http.Handler) *Metrics {
+	return &Metrics{handler}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	route := Route(r)
+	if route == "" {
+		route = "unmatched"
+	}
+	rw := NewResponseWriter(w)
+	m.handler.ServeHTTP(rw, r)
+
+	status := rw.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	labels := prometheus.Labels{
+		"route":  route,
+		"method": r.Method,
+		"status": strconv.Itoa(status),
+	}
+	httpRequests.With(labels).Inc()
+	httpLatency.With(labels).Observe(time.Since(start).Seconds())
+}
+
+// RegisterDatabaseMetrics exposes the connection pool statistics of database
+func RegisterDatabaseMetrics(database *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(database, "nojoke"))
+}
+
+// RegisterRecordCount exposes the number of rows returned by countQuery as
+// nojoke_records{resource="..."}, evaluated on every scrape
+func RegisterRecordCount(database *sql.DB, resource string, countQuery string) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "nojoke_records",
+		Help:        "Number of records stored per resource.",
+		ConstLabels: prometheus.Labels{"resource": resource},
+	}, func() float64 {
+		var count int
+		err := database.QueryRow(countQuery).Scan(&count)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(count)
+	})
+}
@@ -0,0 +1,337 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+	// a patch of a single record never needs more
+	MaxPatchBytes = 1 << 20
+)
+
+// PatchError is a patch that cannot be applied, Status is the response
+// code it calls for
+type PatchError struct {
+	Status  int
+	Message string
+}
+
+func (e *PatchError) Error() string {
+	return e.Message
+}
+
+func patchError(status int, message string) *PatchError {
+	return &PatchError{Status: status, Message: message}
+}
+
+// PatchOperation is one operation of an RFC 6902 JSON Patch
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Patch applies the body of r to the JSON representation of current and
+// returns the result, decoded like a request body. The body is a JSON Merge
+// Patch (RFC 7396) when sent as application/merge-patch+json or
+// application/json, or a JSON Patch (RFC 6902) as
+// application/json-patch+json and at most MaxPatchBytes long. Errors are a
+// *PatchError.
+func Patch[T any](r *http.Request, current T) (T, error) {
+	var patched T
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+	if mediaType != MergePatchType && mediaType != JSONPatchType && mediaType != "application/json" {
+		return patched, patchError(http.StatusUnsupportedMediaType, "Unsupported Content-Type "+mediaType+", expected "+MergePatchType+" or "+JSONPatchType)
+	}
+	content, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, MaxPatchBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return patched, patchError(http.StatusRequestEntityTooLarge, "Body larger than "+strconv.Itoa(MaxPatchBytes)+" bytes")
+	}
+	if err != nil {
+		return patched, patchError(http.StatusBadRequest, err.Error())
+	}
+	original, err := json.Marshal(current)
+	if err != nil {
+		return patched, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(original, &doc); err != nil {
+		return patched, err
+	}
+
+	if mediaType == JSONPatchType {
+		operations := []PatchOperation{}
+		if err := json.Unmarshal(content, &operations); err != nil {
+			return patched, patchError(http.StatusBadRequest, "A JSON Patch is an array of operations: "+err.Error())
+		}
+		for i, operation := range operations {
+			var failure *PatchError
+			doc, failure = applyOperation(doc, operation)
+			if failure != nil {
+				failure.Message = "operation " + strconv.Itoa(i) + " (" + operation.Op + " " + operation.Path + "): " + failure.Message
+				return patched, failure
+			}
+		}
+	} else {
+		var patch interface{}
+		if err := json.Unmarshal(content, &patch); err != nil {
+			return patched, patchError(http.StatusBadRequest, err.Error())
+		}
+		doc = mergePatch(doc, patch)
+	}
+
+	result, err := json.Marshal(doc)
+	if err != nil {
+		return patched, err
+	}
+	if err := json.Unmarshal(result, &patched); err != nil {
+		return patched, patchError(http.StatusBadRequest, err.Error())
+	}
+	return patched, nil
+}
+
+// mergePatch applies an RFC 7396 merge patch: objects are merged member by
+// member, null removes a member and anything else replaces the target
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+	}
+	for key, value := range members {
+		if value == nil {
+			delete(object, key)
+		} else {
+			object[key] = mergePatch(object[key], value)
+		}
+	}
+	return object
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped tokens
+func parsePointer(pointer string) ([]string, *PatchError) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, patchError(http.StatusBadRequest, "invalid pointer "+pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// index reads an array index, "-" is the end of the array when allowed
+func index(token string, length int, end bool) (int, *PatchError) {
+	if token == "-" && end {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, patchError(http.StatusBadRequest, "invalid array index "+token)
+	}
+	limit := length - 1
+	if end {
+		limit = length
+	}
+	if i > limit {
+		return 0, patchError(http.StatusUnprocessableEntity, "array index "+token+" out of range")
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, tokens []string) (interface{}, *PatchError) {
+	for _, token := range tokens {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			value, ok := v[token]
+			if !ok {
+				return nil, patchError(http.StatusUnprocessableEntity, "member "+token+" does not exist")
+			}
+			doc = value
+		case []interface{}:
+			i, err := index(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[i]
+		default:
+			return nil, patchError(http.StatusUnprocessableEntity, token+" is below a value that is neither an object nor an array")
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd returns doc with value added at tokens: a member is set, an
+// array element is inserted
+func pointerAdd(doc interface{}, tokens []string, value interface{}) (interface{}, *PatchError) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		v[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := index(last, len(v), true)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v[:i], append([]interface{}{value}, v[i:]...)...)
+		return pointerReplaceContainer(doc, tokens[:len(tokens)-1], v)
+	}
+	return nil, patchError(http.StatusUnprocessableEntity, "the parent of "+last+" is neither an object nor an array")
+}
+
+func pointerRemove(doc interface{}, tokens []string) (interface{}, *PatchError) {
+	if len(tokens) == 0 {
+		return nil, patchError(http.StatusUnprocessableEntity, "the whole document cannot be removed")
+	}
+	parent, err := pointerGet(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := v[last]; !ok {
+			return nil, patchError(http.StatusUnprocessableEntity, "member "+last+" does not exist")
+		}
+		delete(v, last)
+		return doc, nil
+	case []interface{}:
+		i, err := index(last, len(v), false)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v[:i:i], v[i+1:]...)
+		return pointerReplaceContainer(doc, tokens[:len(tokens)-1], v)
+	}
+	return nil, patchError(http.StatusUnprocessableEntity, "the parent of "+last+" is neither an object nor an array")
+}
+
+// pointerReplaceContainer stores a grown or shrunk array back at tokens,
+// since slices cannot change length in place
+func pointerReplaceContainer(doc interface{}, tokens []string, array []interface{}) (interface{}, *PatchError) {
+	if len(tokens) == 0 {
+		return array, nil
+	}
+	parent, err := pointerGet(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		v[last] = array
+	case []interface{}:
+		i, err := index(last, len(v), false)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = array
+	}
+	return doc, nil
+}
+
+// copyValue returns a deep copy so copied values do not share arrays or
+// objects with their source
+func copyValue(value interface{}) interface{} {
+	content, _ := json.Marshal(value)
+	var copied interface{}
+	json.Unmarshal(content, &copied)
+	return copied
+}
+
+func applyOperation(doc interface{}, operation PatchOperation) (interface{}, *PatchError) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if len(operation.Value) == 0 {
+			return nil, patchError(http.StatusBadRequest, "value is required")
+		}
+		if err := json.Unmarshal(operation.Value, &value); err != nil {
+			return nil, patchError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	switch operation.Op {
+	case "add":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		return pointerRemove(doc, path)
+	case "replace":
+		if _, err := pointerGet(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, err = pointerRemove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		moved, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if operation.Op == "copy" {
+			return pointerAdd(doc, path, copyValue(moved))
+		}
+		if operation.Path == operation.From {
+			return doc, nil
+		}
+		if strings.HasPrefix(operation.Path, operation.From+"/") {
+			return nil, patchError(http.StatusUnprocessableEntity, "a value cannot be moved into itself")
+		}
+		doc, err = pointerRemove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, moved)
+	case "test":
+		actual, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, patchError(http.StatusConflict, "test failed, "+err.Message)
+		}
+		if !reflect.DeepEqual(actual, value) {
+			return nil, patchError(http.StatusConflict, "test failed, the value differs")
+		}
+		return doc, nil
+	}
+	return nil, patchError(http.StatusBadRequest, "unknown op "+operation.Op+", expected add, remove, replace, move, copy or test")
+}
@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// applyPatch runs Patch on the JSON document doc and returns the result as
+// JSON, or the status of the *PatchError
+func applyPatch(t *testing.T, contentType string, doc string, patch string) (interface{}, int) {
+	t.Helper()
+	var current interface{}
+	if err := json.Unmarshal([]byte(doc), &current); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("PATCH", "/", strings.NewReader(patch))
+	r.Header.Set("Content-Type", contentType)
+	patched, err := Patch(r, current)
+	if patchErr, ok := err.(*PatchError); ok {
+		return nil, patchErr.Status
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patched, http.StatusOK
+}
+
+func decode(t *testing.T, content string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// the examples of RFC 7396, appendix A
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, contentType := range []string{MergePatchType, "application/json"} {
+		for _, tt := range tests {
+			got, status := applyPatch(t, contentType, tt.target, tt.patch)
+			if status != http.StatusOK || !reflect.DeepEqual(got, decode(t, tt.result)) {
+				t.Errorf("%s %s with %s: %v (%d), want %s", contentType, tt.target, tt.patch, got, status, tt.result)
+			}
+		}
+	}
+}
+
+// the examples of RFC 6902, appendix A, and the errors Patch tells apart
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		patch  string
+		result string
+		status int
+	}{
+		{"A.1 add an object member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, 200},
+		{"A.2 add an array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, 200},
+		{"A.3 remove an object member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, 200},
+		{"A.4 remove an array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, 200},
+		{"A.5 replace a value", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, 200},
+		{"A.6 move a value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, 200},
+		{"A.7 move an array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, 200},
+		{"A.8 test a value", `{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`, 200},
+		{"A.9 failed test", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, "", 409},
+		{"A.10 add a nested member", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`, 200},
+		{"A.11 unknown members are ignored", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`, `{"foo":"bar","baz":"qux"}`, 200},
+		{"A.12 add to a missing parent", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, "", 422},
+		{"A.14 escaped pointer", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`, 200},
+		{"A.15 strings are not numbers", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":"10"}]`, "", 409},
+		{"A.16 add an array value", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`, 200},
+		{"copy is deep", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`, 200},
+		{"replace the whole document", `{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`, 200},
+		{"operations apply in order", `{"a":1}`, `[{"op":"add","path":"/b","value":2},{"op":"remove","path":"/a"}]`, `{"b":2}`, 200},
+		{"replace a missing member", `{"a":1}`, `[{"op":"replace","path":"/b","value":2}]`, "", 422},
+		{"index out of range", `{"a":[1]}`, `[{"op":"remove","path":"/a/1"}]`, "", 422},
+		{"index with a leading zero", `{"a":[1,2]}`, `[{"op":"remove","path":"/a/01"}]`, "", 400},
+		{"move into itself", `{"a":{"b":{}}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`, "", 422},
+		{"remove the document", `{"a":1}`, `[{"op":"remove","path":""}]`, "", 422},
+		{"missing value", `{"a":1}`, `[{"op":"add","path":"/b"}]`, "", 400},
+		{"pointer without a slash", `{"a":1}`, `[{"op":"remove","path":"a"}]`, "", 400},
+		{"unknown op", `{"a":1}`, `[{"op":"increment","path":"/a"}]`, "", 400},
+		{"not an array", `{"a":1}`, `{"op":"remove","path":"/a"}`, "", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, status := applyPatch(t, JSONPatchType, tt.doc, tt.patch)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if tt.status == http.StatusOK && !reflect.DeepEqual(got, decode(t, tt.result)) {
+				t.Errorf("result = %v, want %s", got, tt.result)
+			}
+		})
+	}
+}
+
+func TestPatchRequest(t *testing.T) {
+	if _, status := applyPatch(t, "text/plain", `{}`, `{}`); status != http.StatusUnsupportedMediaType {
+		t.Errorf("text/plain: status = %d", status)
+	}
+	large := `{"a":"` + strings.Repeat("x", MaxPatchBytes) + `"}`
+	if _, status := applyPatch(t, MergePatchType, `{}`, large); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body: status = %d", status)
+	}
+	if _, status := applyPatch(t, MergePatchType, `{}`, `{"a":`); status != http.StatusBadRequest {
+		t.Errorf("broken JSON: status = %d", status)
+	}
+}
@@ -0,0 +1,454 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// format is a representation Render and DecodeBody support, the first
+// media type is the one responses are sent with
+type format struct {
+	name       string
+	mediaTypes []string
+}
+
+var formats = []format{
+	{"json", []string{"application/json", "text/json"}},
+	{"xml", []string{"application/xml", "text/xml"}},
+	{"csv", []string{"text/csv", "application/csv"}},
+	{"yaml", []string{"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"}},
+	{"msgpack", []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}},
+}
+
+func formatByName(name string) (format, bool) {
+	for _, f := range formats {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return format{}, false
+}
+
+func formatByMediaType(mediaType string) (format, bool) {
+	if strings.HasSuffix(mediaType, "+json") {
+		return formats[0], true
+	}
+	for _, f := range formats {
+		for _, t := range f.mediaTypes {
+			if t == mediaType {
+				return f, true
+			}
+		}
+	}
+	return format{}, false
+}
+
+// negotiate picks the format from ?format= or the Accept header, JSON when
+// the client accepts anything or nothing we support
+func negotiate(r *http.Request) (format, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		f, ok := formatByName(strings.ToLower(name))
+		if !ok {
+			return f, errors.New("Unsupported format " + name + ", expected json, xml, csv, yaml or msgpack")
+		}
+		return f, nil
+	}
+	type candidate struct {
+		mediaType string
+		q         float64
+	}
+	candidates := []candidate{}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{mediaType, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	for _, c := range candidates {
+		if f, ok := formatByMediaType(c.mediaType); ok {
+			return f, nil
+		}
+		if c.mediaType == "*/*" || c.mediaType == "application/*" {
+			return formats[0], nil
+		}
+	}
+	return formats[0], nil
+}
+
+type formatKey struct{}
+
+func varyAccept(w http.ResponseWriter) {
+	if !strings.Contains(w.Header().Get("Vary"), "Accept") {
+		w.Header().Add("Vary", "Accept")
+	}
+}
+
+func notAcceptable(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotAcceptable)
+	json.NewEncoder(w).Encode(NewErrorResponse(406, err.Error()))
+}
+
+// Negotiate answers 406 before next runs when the client asks for a format
+// Render cannot write, so a request that is refused never changes anything.
+// Routers whose handlers Render use it as a middleware.
+func Negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		varyAccept(w)
+		f, err := negotiate(r)
+		if err != nil {
+			notAcceptable(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), formatKey{}, f)))
+	})
+}
+
+// Render writes v with status in the format the client asked for, see
+// negotiate. Handlers pass a DataResponse or an ErrorResponse; as CSV only
+// the data of a DataResponse is written, one row per item of a list.
+func Render(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	varyAccept(w)
+	f, ok := r.Context().Value(formatKey{}).(format)
+	if !ok {
+		var err error
+		if f, err = negotiate(r); err != nil {
+			notAcceptable(w, err)
+			return
+		}
+	}
+	if f.name == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+
+	if f.name == "csv" {
+		if response, ok := v.(DataResponse); ok && response.Data != nil {
+			if response.Pagination.Limit > 0 {
+				w.Header().Set("X-Total-Count", strconv.Itoa(response.Pagination.Total))
+				w.Header().Set("X-Page", strconv.Itoa(response.Pagination.Page))
+				w.Header().Set("X-Limit", strconv.Itoa(response.Pagination.Limit))
+			}
+			v = response.Data
+		}
+	}
+	doc, err := document(v)
+	var body bytes.Buffer
+	if err == nil {
+		switch f.name {
+		case "xml":
+			err = writeXML(&body, doc)
+		case "csv":
+			err = writeCSV(&body, doc)
+		case "yaml":
+			err = writeYAML(&body, doc)
+		case "msgpack":
+			err = encodeMsgpack(msgpack.NewEncoder(&body), doc)
+		}
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(NewErrorResponse(500, "Error rendering "+f.name+": "+err.Error()))
+		return
+	}
+	contentType := f.mediaTypes[0]
+	if f.name != "msgpack" {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// member and object keep JSON objects in the order of the struct fields,
+// which maps would lose
+type member struct {
+	key   string
+	value interface{}
+}
+
+type object []member
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.key)
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// document turns v into objects, []interface{}, json.Number, string, bool
+// and nil through its JSON encoding, so every format uses the JSON field
+// names
+func document(v interface{}) (interface{}, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	return readValue(decoder)
+}
+
+func readValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		o := object{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, member{key.(string), value})
+		}
+		_, err = decoder.Token()
+		return o, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for decoder.More() {
+			value, err := readValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = decoder.Token()
+		return list, err
+	}
+	return token, nil
+}
+
+// xmlName makes a JSON key usable as an element name
+func xmlName(key string) string {
+	name := []rune(key)
+	for i, c := range name {
+		if !(c == '_' || c == '-' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || !(name[0] == '_' || (name[0] >= 'a' && name[0] <= 'z') || (name[0] >= 'A' && name[0] <= 'Z')) {
+		return "_" + string(name)
+	}
+	return string(name)
+}
+
+// writeXML renders doc as a <response> element, list items become <item>
+// elements
+func writeXML(b *bytes.Buffer, doc interface{}) error {
+	b.WriteString(xml.Header)
+	encoder := xml.NewEncoder(b)
+	encoder.Indent("", "  ")
+	if err := writeElement(encoder, "response", doc); err != nil {
+		return err
+	}
+	if err := encoder.Flush(); err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	return nil
+}
+
+func writeElement(encoder *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: xmlName(name)}}
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case object:
+		for _, m := range v {
+			if err := writeElement(encoder, m.key, m.value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := writeElement(encoder, "item", item); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := encoder.EncodeToken(xml.CharData(scalar(v))); err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+// scalar formats a leaf of a document as text
+func scalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	content, _ := json.Marshal(value)
+	return string(content)
+}
+
+// writeCSV writes a row per item of a list, or a single row, with the
+// object keys as the header; nested values are written as JSON
+func writeCSV(b *bytes.Buffer, doc interface{}) error {
+	rows, ok := doc.([]interface{})
+	if !ok {
+		rows = []interface{}{doc}
+	}
+	columns := []string{}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		o, ok := row.(object)
+		if !ok {
+			columns = []string{"value"}
+			break
+		}
+		for _, m := range o {
+			if !seen[m.key] {
+				seen[m.key] = true
+				columns = append(columns, m.key)
+			}
+		}
+	}
+	writer := csv.NewWriter(b)
+	writer.Write(columns)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		if o, ok := row.(object); ok {
+			for _, m := range o {
+				for i, column := range columns {
+					if column == m.key {
+						record[i] = scalar(m.value)
+					}
+				}
+			}
+		} else {
+			record[0] = scalar(row)
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeYAML(b *bytes.Buffer, doc interface{}) error {
+	encoder := yaml.NewEncoder(b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(yamlNode(doc)); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func yamlNode(value interface{}) *yaml.Node {
+	switch v := value.(type) {
+	case object:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, m := range v {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: m.key}, yamlNode(m.value))
+		}
+		return node
+	case []interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range v {
+			node.Content = append(node.Content, yamlNode(item))
+		}
+		return node
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: v.String()}
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: v.String()}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: scalar(value)}
+}
+
+func encodeMsgpack(encoder *msgpack.Encoder, value interface{}) error {
+	switch v := value.(type) {
+	case object:
+		if err := encoder.EncodeMapLen(len(v)); err != nil {
+			return err
+		}
+		for _, m := range v {
+			if err := encoder.EncodeString(m.key); err != nil {
+				return err
+			}
+			if err := encodeMsgpack(encoder, m.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		if err := encoder.EncodeArrayLen(len(v)); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := encodeMsgpack(encoder, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return encoder.EncodeInt(n)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return encoder.EncodeFloat64(f)
+	}
+	return encoder.Encode(value)
+}
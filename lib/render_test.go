@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"default", "", "", http.StatusCreated, "application/json"},
+		{"any", "", "*/*", http.StatusCreated, "application/json"},
+		{"accept xml", "", "text/html, application/xml;q=0.9", http.StatusCreated, "application/xml; charset=utf-8"},
+		{"query wins", "format=yaml", "application/xml", http.StatusCreated, "application/yaml; charset=utf-8"},
+		{"unknown format", "format=bogus", "", http.StatusNotAcceptable, "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			handler := Negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ran = true
+				Render(w, r, http.StatusCreated, NewDataResponse(201, "Created", map[string]int{"id": 1}))
+			}))
+			r := httptest.NewRequest("POST", "/api/users?"+tt.query, strings.NewReader(`{}`))
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status || w.Header().Get("Content-Type") != tt.contentType {
+				t.Fatalf("%d %s, want %d %s", w.Code, w.Header().Get("Content-Type"), tt.status, tt.contentType)
+			}
+			// a refused request never reaches the handler
+			if ran != (tt.status != http.StatusNotAcceptable) {
+				t.Errorf("handler ran = %v", ran)
+			}
+			if w.Header().Get("Vary") != "Accept" {
+				t.Errorf("Vary = %q", w.Header().Get("Vary"))
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type routeKey struct{}
+
+// Routes matches each request against router once and keeps the route
+// template in its context, for the metrics, rate limiter and chaos
+// middleware wrapped in it
+type Routes struct {
+	handler http.Handler
+	router  *mux.Router
+}
+
+func NewRoutes(handler http.Handler, router *mux.Router) *Routes {
+	return &Routes{handler, router}
+}
+
+func (rt *Routes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	template := ""
+	var match mux.RouteMatch
+	if rt.router.Match(r, &match) && match.Route != nil {
+		template, _ = match.Route.GetPathTemplate()
+	}
+	rt.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, template)))
+}
+
+// Route returns the route template of r, empty when it matched no route or
+// did not go through Routes
+func Route(r *http.Request) string {
+	template, _ := r.Context().Value(routeKey{}).(string)
+	return template
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Server wraps http.Server with timeouts, a readiness state and an orderly
+// shutdown that drains in-flight requests before closing the database pool
+type Server struct {
+	httpServer *http.Server
+	database   *sql.DB
+	logger     *Logger
+	config     ServerConfig
+	ready      atomic.Bool
+	onShutdown []func(ctx context.Context) error
+}
+
+func NewServer(config *Config, handler http.Handler, database *sql.DB, logger *Logger) *Server {
+	return &Server{
+		httpServer: &http.Server{
+			Addr:              ":" + config.Server.Port,
+			Handler:           handler,
+			ReadTimeout:       config.Server.ReadTimeout,
+			ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+			WriteTimeout:      config.Server.WriteTimeout,
+			IdleTimeout:       config.Server.IdleTimeout,
+		},
+		database: database,
+		logger:   logger,
+		config:   config.Server,
+	}
+}
+
+// Ready reports whether the server accepts new traffic, unlike liveness it
+// turns false as soon as shutdown starts
+func (s *Server) Ready() bool {
+	return s.ready.Load()
+}
+
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// OnShutdown registers f to stop another listener, such as the gRPC server,
+// after HTTP connections are drained and before the database pool closes
+func (s *Server) OnShutdown(f func(ctx context.Context) error) {
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// Run serves until ctx is cancelled and then shuts the server down. The
+// server is only ready once its socket is bound.
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		s.database.Close()
+		return err
+	}
+	s.logger.Info("Server running", "addr", listener.Addr().String())
+	s.SetReady(true)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.httpServer.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		s.SetReady(false)
+		s.database.Close()
+		return err
+	case <-ctx.Done():
+	}
+	return s.Shutdown()
+}
+
+func (s *Server) Shutdown() error {
+	s.SetReady(false)
+	s.logger.Info("Shutting down server")
+
+	// give load balancers time to observe the failing readiness probe
+	time.Sleep(s.config.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.logger.Error("Error draining connections", "error", err)
+		s.httpServer.Close()
+	}
+	for _, f := range s.onShutdown {
+		if stopErr := f(ctx); stopErr != nil {
+			s.logger.Error("Error stopping listener", "error", stopErr)
+			err = errors.Join(err, stopErr)
+		}
+	}
+
+	dbErr := s.database.Close()
+	if dbErr != nil {
+		s.logger.Error("Error closing database", "error", dbErr)
+	}
+	s.logger.Info("Server stopped")
+	return errors.Join(err, dbErr)
+}
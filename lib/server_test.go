@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, port int) *Server {
+	t.Helper()
+	database, err := sql.Open("postgres", "postgres://localhost/none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.Server.Port = strconv.Itoa(port)
+	config.Log.Level = "error"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	return NewServer(config, handler, database, NewLogger(nil, config.Log))
+}
+
+func TestServerRunPortInUse(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	s := newTestServer(t, taken.Addr().(*net.TCPAddr).Port)
+	s.httpServer.Addr = taken.Addr().String()
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("expected the bind to fail")
+	}
+	if s.Ready() {
+		t.Error("a server that failed to bind must not be ready")
+	}
+}
+
+func TestServerReadyOnceBound(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+	s := newTestServer(t, free.Addr().(*net.TCPAddr).Port)
+	s.httpServer.Addr = addr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.Ready() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !s.Ready() {
+		t.Fatal("server never became ready")
+	}
+	// ready implies the socket accepts connections
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("ready but not listening: %v", err)
+	}
+	conn.Close()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s.Ready() {
+		t.Error("server still ready after shutdown")
+	}
+}
@@ -1,40 +1,180 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"log"
 	"net/http"
 	auth "nojoke/auth"
+	"nojoke/batch"
+	"nojoke/bins"
+	"nojoke/cache"
+	"nojoke/chaos"
 	"nojoke/collections"
+	"nojoke/events"
+	"nojoke/feed"
+	"nojoke/graph"
+	"nojoke/health"
 	"nojoke/lib"
+	"nojoke/migrations"
+	"nojoke/mock"
+	"nojoke/openapi"
 	product "nojoke/products"
+	"nojoke/ratelimit"
+	"nojoke/recorder"
+	"nojoke/rpc"
+	"nojoke/sandbox"
+	"nojoke/stream"
 	users "nojoke/users"
+	"nojoke/webhooks"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	db := lib.ConnectDB()
-	if port == "" {
-		port = "1337"
+	configFile := os.Getenv("CONFIG_FILE")
+	if configFile == "" {
+		configFile = "config.yaml"
+	}
+	config, err := lib.LoadConfig(configFile, ".env")
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := lib.NewLogger(nil, config.Log)
+	shutdownTracing, err := lib.InitTracing(context.Background(), config.Tracing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+	db := lib.ConnectDB(config.Database.URL)
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := migrations.Command(db, logger, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	r := mux.NewRouter()
-	loggerMux := lib.NewLogger(r)
+	r.Use(otelmux.Middleware(config.Tracing.ServiceName))
+	var sandboxes *sandbox.Manager
+	if config.Sandbox.Enabled {
+		sandboxes = sandbox.NewManager(db, logger, config)
+		r.Use(sandboxes.Middleware)
+	}
+	var responseCache *cache.Cache
+	if config.Cache.Enabled {
+		responseCache = cache.NewCache(logger, config)
+		r.Use(responseCache.Middleware)
+	}
+	chaosStore := chaos.NewStoreFromConfig(config)
+	chaosMux := chaos.NewChaos(r, chaosStore, logger, config)
+	var limited http.Handler = chaosMux
+	if config.RateLimit.Enabled {
+		limited = ratelimit.NewLimiter(chaosMux, ratelimit.NewMemoryStore(), logger, config)
+	}
+	var recording *recorder.Recorder
+	switch config.Recorder.Mode {
+	case "record":
+		recording, err = recorder.NewRecorder(limited, logger, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limited = recording
+	case "replay":
+		replayer, err := recorder.NewReplayer(limited, logger, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limited = replayer
+	}
+	metrics := lib.NewMetrics(limited)
+	loggerMux := lib.NewLogger(lib.NewRoutes(metrics, r), config.Log)
+
+	err = migrations.Up(db, loggerMux)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := lib.NewServer(config, loggerMux, db, loggerMux)
+	if recording != nil {
+		server.OnShutdown(recording.Close)
+	}
+
+	health.InitHealthRouter(r, db, loggerMux, config, server)
+
+	lib.RegisterDatabaseMetrics(db)
+	openapi.Describe(r.Handle("/metrics", promhttp.Handler()).Methods("GET"),
+		openapi.Operation{Summary: "Prometheus metrics", Tags: []string{"metrics"}, Raw: true, ContentType: "text/plain"})
+
+	openapi.InitOpenAPIRouter(r, loggerMux, config, health.Version)
 
-	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("OK"))
-	})
-	auth.InitAuthRouter(r, db, loggerMux)
+	auth.InitAuthRouter(r, db, loggerMux, config)
 
-	users.InitUserRouter(r, db, loggerMux)
+	chaos.InitChaosRouter(r, loggerMux, config, chaosMux)
 
-	product.InitProductRouter(r, db, loggerMux)
+	users.InitUserRouter(r, db, loggerMux, config)
 
-	collections.InitCollectionRouter(r, db, loggerMux)
+	product.InitProductRouter(r, db, loggerMux, config)
 
-	fmt.Println("Server running on port", port)
-	http.ListenAndServe(":"+port, loggerMux)
+	collections.InitCollectionRouter(r, db, loggerMux, config)
 
+	if sandboxes != nil {
+		// the seed is taken once the mock data is in
+		if err := sandboxes.EnsureSeed(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+		server.OnShutdown(sandboxes.Shutdown)
+		go sandboxes.Run()
+		sandbox.InitSandboxRouter(r, db, loggerMux, config, sandboxes)
+	}
+
+	graph.InitGraphRouter(r, db, loggerMux, config)
+
+	mock.InitMockRouter(r, loggerMux, config)
+
+	events.Default.SetLogSize(config.Stream.LogSize)
+
+	feed.InitFeedRouter(r, loggerMux, config)
+
+	stream.InitStreamRouter(r, db, loggerMux, config)
+
+	var dispatcher *webhooks.Dispatcher
+	if config.Webhooks.Enabled {
+		dispatcher = webhooks.NewDispatcher(db, loggerMux, config, nil)
+		server.OnShutdown(dispatcher.Shutdown)
+		go dispatcher.Run()
+	}
+	webhooks.InitWebhookRouter(r, db, loggerMux, config, dispatcher)
+
+	bins.InitBinRouter(r, db, loggerMux, config)
+
+	batch.InitBatchRouter(r, db, loggerMux, config)
+
+	if config.GRPC.Enabled || config.GRPC.Transcoding {
+		grpcServer := rpc.NewServer(db, loggerMux, config, responseCache)
+		if config.GRPC.Transcoding {
+			rpc.InitTranscodingRouter(r, grpcServer, loggerMux, config)
+		}
+		if config.GRPC.Enabled {
+			server.OnShutdown(grpcServer.Shutdown)
+			go func() {
+				if err := grpcServer.Run(); err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = server.Run(ctx)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
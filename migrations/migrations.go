@@ -0,0 +1,216 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"nojoke/lib"
+	"strconv"
+	"time"
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+func ensureMigrationsTable(ctx context.Context, database lib.Queryer) error {
+	_, err := database.ExecContext(ctx, CreateSchemaMigrationsTableQuery)
+	return err
+}
+
+// lock holds the migration lock on a connection of its own until unlock is
+// called, so replicas starting together apply each version once
+func lock(ctx context.Context, database *sql.DB) (conn *sql.Conn, unlock func(), err error) {
+	conn, err = database.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.ExecContext(ctx, LockMigrationsQuery); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, func() {
+		conn.ExecContext(context.Background(), UnlockMigrationsQuery)
+		conn.Close()
+	}, nil
+}
+
+func getAppliedMigrations(ctx context.Context, database lib.Queryer) (map[int]time.Time, error) {
+	rows, err := database.QueryContext(ctx, GetAppliedMigrationsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func apply(ctx context.Context, conn *sql.Conn, migration Migration, query string, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, InsertMigrationQuery, migration.Version, migration.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, DeleteMigrationQuery, migration.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Up applies every pending migration in version order
+func Up(database *sql.DB, logger *lib.Logger) error {
+	ctx := context.Background()
+	conn, unlock, err := lock(ctx, database)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return err
+	}
+	applied, err := getAppliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := apply(ctx, conn, migration, migration.Up, true); err != nil {
+			return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		logger.Info("Applied migration", "version", migration.Version, "name", migration.Name)
+	}
+	return nil
+}
+
+// Down reverts the last `steps` applied migrations
+func Down(database *sql.DB, logger *lib.Logger, steps int) error {
+	ctx := context.Background()
+	conn, unlock, err := lock(ctx, database)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return err
+	}
+	applied, err := getAppliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if err := apply(ctx, conn, migration, migration.Down, false); err != nil {
+			return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		logger.Info("Reverted migration", "version", migration.Version, "name", migration.Name)
+		steps--
+	}
+	return nil
+}
+
+func Status(database *sql.DB) ([]MigrationStatus, error) {
+	if err := ensureMigrationsTable(context.Background(), database); err != nil {
+		return nil, err
+	}
+	applied, err := getAppliedMigrations(context.Background(), database)
+	if err != nil {
+		return nil, err
+	}
+	statusList := []MigrationStatus{}
+	for _, migration := range migrations {
+		status := MigrationStatus{
+			Version: migration.Version,
+			Name:    migration.Name,
+		}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &appliedAt
+		}
+		statusList = append(statusList, status)
+	}
+	return statusList, nil
+}
+
+// Pending returns the migrations that have not been applied yet, giving up
+// when ctx is done
+func Pending(ctx context.Context, database *sql.DB) ([]Migration, error) {
+	applied, err := getAppliedMigrations(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+	pending := []Migration{}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Command runs the `migrate up|down [steps]|status` subcommand
+func Command(database *sql.DB, logger *lib.Logger, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down [steps]|status")
+	}
+	switch args[0] {
+	case "up":
+		return Up(database, logger)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return errors.New("invalid number of steps: " + args[1])
+			}
+			steps = n
+		}
+		return Down(database, logger, steps)
+	case "status":
+		statusList, err := Status(database)
+		if err != nil {
+			return err
+		}
+		for _, status := range statusList {
+			appliedAt := "pending"
+			if status.Applied {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s %s\n", status.Version, status.Name, appliedAt)
+		}
+		return nil
+	}
+	return errors.New("unknown migrate command: " + args[0])
+}
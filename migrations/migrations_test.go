@@ -0,0 +1,69 @@
+package migrations
+
+import (
+	"nojoke/lib"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUpHoldsTheLock(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	registry := migrations
+	defer func() { migrations = registry }()
+	migrations = []Migration{
+		{Version: 1, Name: "one", Up: "CREATE TABLE one ();"},
+		{Version: 2, Name: "two", Up: "CREATE TABLE two ();"},
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta(LockMigrationsQuery)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(CreateSchemaMigrationsTableQuery)).WillReturnResult(sqlmock.NewResult(0, 0))
+	// another replica applied the first migration while this one waited
+	mock.ExpectQuery(regexp.QuoteMeta(GetAppliedMigrationsQuery)).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE two ();")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(InsertMigrationQuery)).WithArgs(2, "two").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta(UnlockMigrationsQuery)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := Up(database, lib.NewLogger(nil, lib.LogConfig{Level: "error"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownReleasesTheLockOnError(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	registry := migrations
+	defer func() { migrations = registry }()
+	migrations = []Migration{{Version: 1, Name: "one", Down: "DROP TABLE one;"}}
+
+	mock.ExpectExec(regexp.QuoteMeta(LockMigrationsQuery)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(CreateSchemaMigrationsTableQuery)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(GetAppliedMigrationsQuery)).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE one;")).WillReturnError(sqlmock.ErrCancelled)
+	mock.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta(UnlockMigrationsQuery)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := Down(database, lib.NewLogger(nil, lib.LogConfig{Level: "error"}), 1); err == nil {
+		t.Fatal("Down succeeded")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,100 @@
+package migrations
+
+import (
+	"nojoke/auth"
+	"nojoke/bins"
+	"nojoke/collections"
+	product "nojoke/products"
+	"nojoke/sandbox"
+	user "nojoke/users"
+	"nojoke/webhooks"
+)
+
+// migrations are applied in slice order, the version numbers must be
+// increasing and must never be reused once released
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_admin_table",
+		Up:      auth.CreateAdminTableQuery,
+		Down:    auth.DropAdminTableQuery,
+	},
+	{
+		Version: 2,
+		Name:    "create_collections_table",
+		Up:      collections.CreateCollectionTableQuery,
+		Down:    collections.DropCollectionTableQuery,
+	},
+	{
+		Version: 3,
+		Name:    "create_products_table",
+		Up:      product.CreateProductTableQuery,
+		Down:    product.DropProductTableQuery,
+	},
+	{
+		Version: 4,
+		Name:    "create_users_table",
+		Up:      user.CreateUserTableQuery,
+		Down:    user.DropUserTableQuery,
+	},
+	{
+		Version: 5,
+		Name:    "rename_admin_create_at",
+		Up:      auth.RenameAdminCreateAtQuery,
+		Down:    auth.RevertAdminCreateAtQuery,
+	},
+	{
+		Version: 6,
+		Name:    "create_set_updated_at_function",
+		Up:      CreateSetUpdatedAtFunctionQuery,
+		Down:    DropSetUpdatedAtFunctionQuery,
+	},
+	{
+		Version: 7,
+		Name:    "add_admin_updated_at",
+		Up:      auth.AddAdminUpdatedAtQuery,
+		Down:    auth.DropAdminUpdatedAtQuery,
+	},
+	{
+		Version: 8,
+		Name:    "add_collections_updated_at",
+		Up:      collections.AddCollectionUpdatedAtQuery,
+		Down:    collections.DropCollectionUpdatedAtQuery,
+	},
+	{
+		Version: 9,
+		Name:    "add_products_updated_at",
+		Up:      product.AddProductUpdatedAtQuery,
+		Down:    product.DropProductUpdatedAtQuery,
+	},
+	{
+		Version: 10,
+		Name:    "add_users_updated_at",
+		Up:      user.AddUserUpdatedAtQuery,
+		Down:    user.DropUserUpdatedAtQuery,
+	},
+	{
+		Version: 11,
+		Name:    "create_webhook_tables",
+		Up:      webhooks.CreateWebhookTablesQuery,
+		Down:    webhooks.DropWebhookTablesQuery,
+	},
+	{
+		Version: 12,
+		Name:    "create_bin_tables",
+		Up:      bins.CreateBinTablesQuery,
+		Down:    bins.DropBinTablesQuery,
+	},
+	{
+		Version: 13,
+		Name:    "create_sandbox_tables",
+		Up:      sandbox.CreateSandboxTableQuery,
+		Down:    sandbox.DropSandboxTableQuery,
+	},
+	{
+		Version: 14,
+		Name:    "add_sandbox_creator",
+		Up:      sandbox.AddSandboxCreatorQuery,
+		Down:    sandbox.DropSandboxCreatorQuery,
+	},
+}
@@ -0,0 +1,45 @@
+package migrations
+
+const CreateSchemaMigrationsTableQuery = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+`
+
+// the lock is held by the session running up or down, any key would do as
+// long as every replica uses the same one
+const LockMigrationsQuery = `
+	SELECT pg_advisory_lock(hashtext('schema_migrations'));
+`
+
+const UnlockMigrationsQuery = `
+	SELECT pg_advisory_unlock(hashtext('schema_migrations'));
+`
+
+const GetAppliedMigrationsQuery = `
+	SELECT version, applied_at FROM schema_migrations ORDER BY version;
+`
+
+const InsertMigrationQuery = `
+	INSERT INTO schema_migrations (version, name) VALUES ($1, $2);
+`
+
+const DeleteMigrationQuery = `
+	DELETE FROM schema_migrations WHERE version = $1;
+`
+
+// set_updated_at is shared by the updated_at triggers of every table
+const CreateSetUpdatedAtFunctionQuery = `
+	CREATE OR REPLACE FUNCTION set_updated_at() RETURNS TRIGGER AS $$
+	BEGIN
+		NEW.updated_at = CURRENT_TIMESTAMP;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+`
+
+const DropSetUpdatedAtFunctionQuery = `
+	DROP FUNCTION IF EXISTS set_updated_at();
+`
@@ -0,0 +1,282 @@
+package mock
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	faker "github.com/bxcodec/faker/v3"
+)
+
+// schemas nested deeper than this are cut off so recursive types terminate
+const maxDepth = 8
+
+// generated arrays and strings stay below these sizes whatever the schema
+// asks for
+const (
+	maxGeneratedItems  = 100
+	maxGeneratedLength = 4096
+)
+
+// integers are generated within the float64 values that convert to int64
+const maxGeneratedInteger = float64(math.MaxInt64 - 1023)
+
+// fakeByFormat follows the OpenAPI string formats
+var fakeByFormat = map[string]func() string{
+	"email":     faker.Email,
+	"uri":       faker.URL,
+	"url":       faker.URL,
+	"uuid":      faker.UUIDHyphenated,
+	"hostname":  faker.DomainName,
+	"ipv4":      faker.IPv4,
+	"ipv6":      faker.IPv6,
+	"password":  faker.Password,
+	"date":      faker.Date,
+	"date-time": func() string { return time.Unix(faker.UnixTime(), 0).UTC().Format(time.RFC3339) },
+	"byte":      func() string { return "bm9qb2tl" },
+}
+
+// fakeByName guesses from the property name when no format is declared,
+// the same fakers GenerateUsers and GenerateProducts use
+var fakeByName = []struct {
+	suffix string
+	fake   func() string
+}{
+	{"email", faker.Email},
+	{"first_name", faker.FirstName},
+	{"firstname", faker.FirstName},
+	{"last_name", faker.LastName},
+	{"lastname", faker.LastName},
+	{"username", faker.Username},
+	{"name", faker.Name},
+	{"phone", faker.Phonenumber},
+	{"url", faker.URL},
+	{"image", faker.URL},
+	{"thumbnail", faker.URL},
+	{"avatar", faker.URL},
+	{"website", faker.URL},
+	{"password", faker.Password},
+	{"description", faker.Paragraph},
+	{"title", faker.Sentence},
+	{"summary", faker.Sentence},
+	{"currency", faker.Currency},
+	{"brand", faker.FirstName},
+	{"uuid", faker.UUIDHyphenated},
+}
+
+// Generate builds a random value conforming to schema, name is the property
+// the value is generated for and helps pick a realistic faker
+func (s *Spec) Generate(schema *Schema, name string) interface{} {
+	return s.generate(schema, name, 0, map[string]bool{})
+}
+
+// recursive reports whether schema, or the items of an array schema, refers
+// back to a component that is already being generated
+func recursive(schema *Schema, visiting map[string]bool) bool {
+	for schema != nil {
+		if schema.Ref != "" {
+			return visiting[schema.Ref]
+		}
+		schema = schema.Items
+	}
+	return false
+}
+
+func (s *Spec) generate(schema *Schema, name string, depth int, visiting map[string]bool) interface{} {
+	if schema != nil && schema.Ref != "" && !visiting[schema.Ref] {
+		visiting[schema.Ref] = true
+		defer delete(visiting, schema.Ref)
+	}
+	schema = s.resolve(schema)
+	if schema.Example != nil {
+		return schema.Example
+	}
+	if len(schema.Enum) > 0 {
+		return schema.Enum[rand.Intn(len(schema.Enum))]
+	}
+	if len(schema.AllOf) > 0 {
+		return s.generateAllOf(schema, name, depth, visiting)
+	}
+	if len(schema.OneOf) > 0 {
+		return s.generate(schema.OneOf[0], name, depth, visiting)
+	}
+	if len(schema.AnyOf) > 0 {
+		return s.generate(schema.AnyOf[0], name, depth, visiting)
+	}
+
+	switch schemaType(schema) {
+	case "object":
+		if depth >= maxDepth {
+			return map[string]interface{}{}
+		}
+		required := map[string]bool{}
+		for _, property := range schema.Required {
+			required[property] = true
+		}
+		object := map[string]interface{}{}
+		for property, propertySchema := range schema.Properties {
+			if s.resolve(propertySchema).WriteOnly {
+				continue
+			}
+			// optional self references are left out instead of nesting
+			// down to maxDepth
+			if !required[property] && recursive(propertySchema, visiting) {
+				continue
+			}
+			object[property] = s.generate(propertySchema, property, depth+1, visiting)
+		}
+		return object
+	case "array":
+		if depth >= maxDepth {
+			return []interface{}{}
+		}
+		count := between(schema.MinItems, schema.MaxItems, 1, 3)
+		items := make([]interface{}, count)
+		for i := range items {
+			items[i] = s.generate(schema.Items, name, depth+1, visiting)
+		}
+		return items
+	case "integer":
+		return int64(number(schema, 1, 1000))
+	case "number":
+		return math.Round(number(schema, 1, 1000)*100) / 100
+	case "boolean":
+		return rand.Intn(2) == 1
+	case "string":
+		return fakeString(schema, name)
+	}
+	return nil
+}
+
+// generateAllOf merges the objects generated for every subschema
+func (s *Spec) generateAllOf(schema *Schema, name string, depth int, visiting map[string]bool) interface{} {
+	merged := map[string]interface{}{}
+	for _, part := range schema.AllOf {
+		generated := s.generate(part, name, depth, visiting)
+		value, ok := generated.(map[string]interface{})
+		if !ok {
+			return generated
+		}
+		for key, item := range value {
+			merged[key] = item
+		}
+	}
+	rest := *schema
+	rest.AllOf = nil
+	if value, ok := s.generate(&rest, name, depth, visiting).(map[string]interface{}); ok {
+		for key, item := range value {
+			merged[key] = item
+		}
+	}
+	return merged
+}
+
+// schemaType infers the type of schemas that leave it out
+func schemaType(schema *Schema) string {
+	if primary := schema.Type.Primary(); primary != "" {
+		return primary
+	}
+	switch {
+	case schema.Properties != nil:
+		return "object"
+	case schema.Items != nil:
+		return "array"
+	}
+	return ""
+}
+
+// between picks a count within min and max, clamped to
+// [0, maxGeneratedItems]
+func between(min *int, max *int, defaultMin int, defaultMax int) int {
+	low, high := defaultMin, defaultMax
+	if min != nil {
+		low = *min
+		if high < low {
+			high = low
+		}
+	}
+	if max != nil {
+		high = *max
+		if low > high {
+			low = high
+		}
+	}
+	low = clamp(low, 0, maxGeneratedItems)
+	high = clamp(high, low, maxGeneratedItems)
+	return low + rand.Intn(high-low+1)
+}
+
+func clamp(value int, low int, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
+
+func number(schema *Schema, defaultMin float64, defaultMax float64) float64 {
+	low, high := defaultMin, defaultMax
+	if schema.Minimum != nil {
+		low = *schema.Minimum
+		if high < low {
+			high = low + defaultMax
+		}
+	}
+	if schema.Maximum != nil {
+		high = *schema.Maximum
+		if low > high {
+			low = high
+		}
+	}
+	if schemaType(schema) == "integer" {
+		low = math.Max(math.Ceil(low), -maxGeneratedInteger)
+		high = math.Min(math.Floor(high), maxGeneratedInteger)
+		if high < low {
+			return low
+		}
+		// below 2^53 every integer of the range is a float64
+		if high-low < 1<<53 {
+			return low + float64(rand.Int63n(int64(high-low)+1))
+		}
+		return math.Floor(interpolate(low, high, rand.Float64()))
+	}
+	return interpolate(low, high, rand.Float64())
+}
+
+// interpolate returns the point at f of [low, high] without computing
+// high-low, which overflows for ranges such as the whole float64 range
+func interpolate(low float64, high float64, f float64) float64 {
+	return math.Min(high, math.Max(low, low*(1-f)+high*f))
+}
+
+func fakeString(schema *Schema, name string) string {
+	value := ""
+	if fake, ok := fakeByFormat[schema.Format]; ok {
+		value = fake()
+	} else {
+		lower := strings.ToLower(name)
+		for _, candidate := range fakeByName {
+			if strings.HasSuffix(lower, candidate.suffix) {
+				value = candidate.fake()
+				break
+			}
+		}
+		if value == "" {
+			value = faker.Word()
+		}
+	}
+	minLength := 0
+	if schema.MinLength != nil {
+		minLength = clamp(*schema.MinLength, 0, maxGeneratedLength)
+	}
+	for len(value) < minLength {
+		value += faker.Word()
+	}
+	if schema.MaxLength != nil && *schema.MaxLength >= 0 && len(value) > *schema.MaxLength {
+		value = value[:*schema.MaxLength]
+	}
+	return value
+}
@@ -0,0 +1,120 @@
+package mock
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func intPtr(v int) *int { return &v }
+
+func floatPtr(v float64) *float64 { return &v }
+
+func TestNumberRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   Schema
+		low      float64
+		high     float64
+		integral bool
+	}{
+		{"default integer", Schema{Type: Types{"integer"}}, 1, 1000, true},
+		{"small integer range", Schema{Type: Types{"integer"}, Minimum: floatPtr(5), Maximum: floatPtr(7)}, 5, 7, true},
+		{"fractional bounds", Schema{Type: Types{"integer"}, Minimum: floatPtr(0.5), Maximum: floatPtr(2.5)}, 1, 2, true},
+		{"whole int64 range", Schema{Type: Types{"integer"}, Minimum: floatPtr(math.MinInt64), Maximum: floatPtr(math.MaxInt64)}, -maxGeneratedInteger, maxGeneratedInteger, true},
+		{"beyond int64", Schema{Type: Types{"integer"}, Minimum: floatPtr(-1e30), Maximum: floatPtr(1e30)}, -maxGeneratedInteger, maxGeneratedInteger, true},
+		{"only a minimum", Schema{Type: Types{"integer"}, Minimum: floatPtr(5000)}, 5000, 6000, true},
+		{"whole float64 range", Schema{Type: Types{"number"}, Minimum: floatPtr(-math.MaxFloat64), Maximum: floatPtr(math.MaxFloat64)}, -math.MaxFloat64, math.MaxFloat64, false},
+		{"negative numbers", Schema{Type: Types{"number"}, Minimum: floatPtr(-2), Maximum: floatPtr(-1)}, -2, -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 200; i++ {
+				value := number(&tt.schema, 1, 1000)
+				if math.IsNaN(value) || math.IsInf(value, 0) || value < tt.low || value > tt.high {
+					t.Fatalf("%v is outside [%v, %v]", value, tt.low, tt.high)
+				}
+				if tt.integral && value != math.Trunc(value) {
+					t.Fatalf("%v is not an integer", value)
+				}
+			}
+		})
+	}
+}
+
+func TestBetween(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max *int
+		low      int
+		high     int
+	}{
+		{"defaults", nil, nil, 1, 3},
+		{"exact", intPtr(2), intPtr(2), 2, 2},
+		{"only a minimum", intPtr(5), nil, 5, 5},
+		{"only a maximum", nil, intPtr(0), 0, 0},
+		{"negative maximum", nil, intPtr(-4), 0, 0},
+		{"huge minimum", intPtr(1 << 40), nil, maxGeneratedItems, maxGeneratedItems},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			n := between(tt.min, tt.max, 1, 3)
+			if n < tt.low || n > tt.high {
+				t.Fatalf("%s: %d is outside [%d, %d]", tt.name, n, tt.low, tt.high)
+			}
+		}
+	}
+}
+
+func TestFakeStringLength(t *testing.T) {
+	long := fakeString(&Schema{MinLength: intPtr(1 << 30)}, "name")
+	if len(long) < maxGeneratedLength || len(long) > maxGeneratedLength+100 {
+		t.Errorf("length = %d", len(long))
+	}
+	short := fakeString(&Schema{MaxLength: intPtr(3)}, "description")
+	if len(short) > 3 {
+		t.Errorf("length = %d", len(short))
+	}
+}
+
+func TestParseRejectsBadRanges(t *testing.T) {
+	document := func(schema string) string {
+		return `{"openapi": "3.0.0", "paths": {"/things": {"get": {"responses": {"200": {"description": "ok",
+			"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Thing"}}}}}}}},
+			"components": {"schemas": {"Thing": ` + schema + `}}}`
+	}
+	tests := []struct {
+		name   string
+		schema string
+		valid  bool
+	}{
+		{"plain", `{"type": "integer", "minimum": -9223372036854775808, "maximum": 9223372036854775807}`, true},
+		{"negative maxItems", `{"type": "array", "maxItems": -1, "items": {"type": "string"}}`, false},
+		{"negative maxLength in a property", `{"type": "object", "properties": {"name": {"type": "string", "maxLength": -2}}}`, false},
+		{"minItems above maxItems", `{"type": "array", "minItems": 3, "maxItems": 1}`, false},
+		{"minimum above maximum", `{"type": "number", "minimum": 3, "maximum": 1}`, false},
+		{"nested in allOf", `{"allOf": [{"type": "string", "minLength": 5, "maxLength": 2}]}`, false},
+	}
+	for _, tt := range tests {
+		_, err := Parse("test", []byte(document(tt.schema)), "application/json")
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "invalid schema") {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+}
+
+func TestGenerateWholeInt64Range(t *testing.T) {
+	spec, err := Parse("test", []byte(`{"openapi": "3.0.0", "paths": {"/n": {"get": {"responses": {"200": {"description": "ok"}}}}}}`), "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := &Schema{Type: Types{"integer"}, Minimum: floatPtr(math.MinInt64), Maximum: floatPtr(math.MaxInt64)}
+	for i := 0; i < 100; i++ {
+		if _, ok := spec.Generate(schema, "n").(int64); !ok {
+			t.Fatal("expected an int64")
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package mock
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"nojoke/auth"
+	"nojoke/lib"
+	"nojoke/openapi"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// uploaded documents larger than this are rejected
+const maxDocumentBytes = 5 << 20
+
+// mocks are served under /mocks/{name}
+const prefix = "/mocks/"
+
+var contentTypes = map[string]string{
+	".json": "application/json",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// preferPattern reads the Prefer: code=404, example=empty request header
+var preferPattern = regexp.MustCompile(`(code|example)=([^,;\s]+)`)
+
+type SpecSummary struct {
+	Name       string    `json:"name"`
+	Title      string    `json:"title"`
+	Version    string    `json:"version"`
+	OpenAPI    string    `json:"openapi"`
+	Paths      int       `json:"paths"`
+	Operations int       `json:"operations"`
+	URL        string    `json:"url"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+func summary(spec *Spec) SpecSummary {
+	return SpecSummary{
+		Name:       spec.Name,
+		Title:      spec.Document.Info.Title,
+		Version:    spec.Document.Info.Version,
+		OpenAPI:    spec.Document.OpenAPI,
+		Paths:      len(spec.routes),
+		Operations: spec.Operations(),
+		URL:        prefix + spec.Name,
+		UploadedAt: spec.UploadedAt,
+	}
+}
+
+func prefer(r *http.Request) (int, string) {
+	code, example := 0, ""
+	for _, match := range preferPattern.FindAllStringSubmatch(r.Header.Get("Prefer"), -1) {
+		if match[1] == "code" {
+			code, _ = strconv.Atoi(match[2])
+		} else {
+			example = match[2]
+		}
+	}
+	return code, example
+}
+
+// declared finds the response op documents for status, falling back to the
+// 4XX style ranges and then to default
+func (s *Spec) declared(op *Operation, status int) *Response {
+	code := strconv.Itoa(status)
+	for _, key := range []string{code, code[:1] + "XX", "default"} {
+		if response, ok := op.Responses[key]; ok {
+			return s.response(response)
+		}
+	}
+	return nil
+}
+
+// success picks the status and response a mock answers with, the lowest
+// declared 2xx unless the client asked for another one with Prefer
+func (s *Spec) success(op *Operation, preferred int) (int, *Response) {
+	if preferred != 0 {
+		if response := s.declared(op, preferred); response != nil {
+			return preferred, response
+		}
+	}
+	codes := []int{}
+	for key := range op.Responses {
+		if code, err := strconv.Atoi(key); err == nil && code >= 200 && code < 300 {
+			codes = append(codes, code)
+		}
+	}
+	sort.Ints(codes)
+	if len(codes) > 0 {
+		return codes[0], s.response(op.Responses[strconv.Itoa(codes[0])])
+	}
+	for _, key := range []string{"2XX", "default"} {
+		if response, ok := op.Responses[key]; ok {
+			return http.StatusOK, s.response(response)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// body returns an example of the media type, by name when requested, or a
+// value generated from its schema
+func (s *Spec) body(media MediaType, example string) interface{} {
+	if named, ok := media.Examples[example]; ok {
+		return named.Value
+	}
+	if media.Example != nil {
+		return media.Example
+	}
+	names := []string{}
+	for name := range media.Examples {
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return media.Examples[names[0]].Value
+	}
+	if media.Schema == nil {
+		return nil
+	}
+	return s.Generate(media.Schema, "")
+}
+
+func writeBody(w http.ResponseWriter, status int, contentType string, body interface{}) {
+	if contentType == "" {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if text, ok := body.(string); ok && !strings.Contains(contentType, "json") {
+		io.WriteString(w, text)
+		return
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// fillError puts the message, status and validation errors into the
+// matching properties of a generated error body
+func fillError(body interface{}, status int, message string, errs []ValidationError) interface{} {
+	object, ok := body.(map[string]interface{})
+	if !ok {
+		return body
+	}
+	for key, value := range object {
+		switch strings.ToLower(key) {
+		case "message", "error", "detail", "title", "description", "error_description":
+			if _, ok := value.(string); ok {
+				object[key] = message
+			}
+		case "status", "code", "status_code", "statuscode":
+			switch value.(type) {
+			case int64, float64:
+				object[key] = status
+			case string:
+				object[key] = strconv.Itoa(status)
+			}
+		case "errors", "details", "violations", "invalid_params":
+			items, ok := value.([]interface{})
+			if !ok {
+				continue
+			}
+			filled := []interface{}{}
+			for _, err := range errs {
+				if len(items) > 0 {
+					if _, ok := items[0].(map[string]interface{}); ok {
+						filled = append(filled, fillViolation(items[0].(map[string]interface{}), err))
+						continue
+					}
+				}
+				filled = append(filled, err.Error())
+			}
+			object[key] = filled
+		}
+	}
+	return object
+}
+
+func fillViolation(sample map[string]interface{}, err ValidationError) map[string]interface{} {
+	violation := map[string]interface{}{}
+	for key, value := range sample {
+		violation[key] = value
+		switch strings.ToLower(key) {
+		case "field", "path", "name", "pointer", "param", "location":
+			violation[key] = err.Field
+		case "message", "detail", "reason", "description", "error":
+			violation[key] = err.Message
+		}
+	}
+	return violation
+}
+
+// writeError answers with the error response op declares for status, shaped
+// by its schema, or with the usual nojoke error envelope
+func (s *Spec) writeError(w http.ResponseWriter, op *Operation, status int, message string, errs []ValidationError) {
+	if op != nil {
+		if response := s.declared(op, status); response != nil {
+			if contentType, media, ok := jsonMedia(response.Content); ok && media.Schema != nil {
+				body := fillError(s.Generate(media.Schema, ""), status, message, errs)
+				writeBody(w, status, contentType, body)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(lib.NewErrorResponse(status, message))
+}
+
+func handleMock(w http.ResponseWriter, r *http.Request, store *Store, logger *lib.Logger) {
+	name := mux.Vars(r)["name"]
+	spec, ok := store.Get(name)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "No mock named "+name))
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix+name)
+	matched, params := spec.match(path)
+	if matched == nil {
+		spec.writeError(w, nil, http.StatusNotFound, "No path of "+name+" matches "+path, nil)
+		return
+	}
+	op, ok := matched.operations[r.Method]
+	if !ok && r.Method == http.MethodHead {
+		op, ok = matched.operations[http.MethodGet]
+	}
+	if !ok {
+		allowed := []string{}
+		for method := range matched.operations {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		spec.writeError(w, nil, http.StatusMethodNotAllowed, r.Method+" is not declared for "+matched.template, nil)
+		return
+	}
+
+	if errs := spec.validateRequest(r, matched.item, op, params); len(errs) > 0 {
+		status := http.StatusBadRequest
+		if _, ok := op.Responses["400"]; !ok {
+			if _, ok := op.Responses["422"]; ok {
+				status = http.StatusUnprocessableEntity
+			}
+		}
+		logger.DebugContext(r.Context(), "Mock request rejected", "mock", name, "path", matched.template, "errors", len(errs))
+		spec.writeError(w, op, status, errs[0].Error(), errs)
+		return
+	}
+
+	preferred, example := prefer(r)
+	status, response := spec.success(op, preferred)
+	if response == nil {
+		w.WriteHeader(status)
+		return
+	}
+	contentType, media, ok := jsonMedia(response.Content)
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+	writeBody(w, status, contentType, spec.body(media, example))
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(lib.NewErrorResponse(401, "Unauthorized"))
+}
+
+func handleList(w http.ResponseWriter, r *http.Request, admin *auth.Admin, store *Store) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	summaries := []SpecSummary{}
+	for _, spec := range store.List() {
+		summaries = append(summaries, summary(spec))
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", summaries))
+}
+
+func handleGet(w http.ResponseWriter, r *http.Request, admin *auth.Admin, store *Store) {
+	if admin == nil {
+		w.Header().Set("Content-Type", "application/json")
+		unauthorized(w)
+		return
+	}
+	spec, ok := store.Get(mux.Vars(r)["name"])
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Mock not found"))
+		return
+	}
+	w.Header().Set("Content-Type", spec.ContentType)
+	w.Write(spec.Raw)
+}
+
+func handlePut(w http.ResponseWriter, r *http.Request, admin *auth.Admin, store *Store, logger *lib.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if !validName.MatchString(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Mock names may only contain letters, digits, - and _"))
+		return
+	}
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDocumentBytes))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(413, err.Error()))
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	spec, err := Parse(name, raw, contentType)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+	store.Set(spec)
+	logger.InfoContext(r.Context(), "Mock uploaded", "mock", name, "operations", spec.Operations())
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", summary(spec)))
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, admin *auth.Admin, store *Store, logger *lib.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if !store.Delete(name) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Mock not found"))
+		return
+	}
+	logger.InfoContext(r.Context(), "Mock deleted", "mock", name)
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "DELETED", nil))
+}
+
+// loadDir serves every .json, .yaml and .yml document in dir under its file
+// name so mocks survive restarts
+func loadDir(dir string, store *Store, logger *lib.Logger) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Error("Error reading mock spec directory", "dir", dir, "error", err)
+		return
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		contentType, ok := contentTypes[ext]
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if entry.IsDir() || !ok || !validName.MatchString(name) {
+			continue
+		}
+		spec, err := loadFile(filepath.Join(dir, entry.Name()), name, contentType)
+		if err != nil {
+			logger.Error("Error loading mock spec", "file", entry.Name(), "error", err)
+			continue
+		}
+		store.Set(spec)
+		logger.Info("Mock loaded", "mock", name, "operations", spec.Operations())
+	}
+}
+
+func loadFile(path string, name string, contentType string) (*Spec, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(name, raw, contentType)
+}
+
+func InitMockRouter(mux *mux.Router, logger *lib.Logger, config *lib.Config) {
+	store := NewStore()
+	if config.Mock.SpecDir != "" {
+		loadDir(config.Mock.SpecDir, store, logger)
+	}
+
+	router := mux.PathPrefix("/api/admin/mocks").Subrouter()
+	openapi.Describe(router.Handle("", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleList(w, r, a, store)
+	})).Methods("GET"), openapi.Operation{Summary: "List the uploaded mock APIs", Response: []SpecSummary{}, Auth: true})
+	openapi.Describe(router.Handle("/{name}", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleGet(w, r, a, store)
+	})).Methods("GET"), openapi.Operation{Summary: "Download an uploaded OpenAPI document", Raw: true, Response: map[string]interface{}{}, Auth: true})
+	openapi.Describe(router.Handle("/{name}", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handlePut(w, r, a, store, logger)
+	})).Methods("PUT"), openapi.Operation{Summary: "Upload an OpenAPI 3 document, JSON or YAML, and serve it under /mocks/{name}", Request: map[string]interface{}{}, Response: SpecSummary{}, Auth: true})
+	openapi.Describe(router.Handle("/{name}", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleDelete(w, r, a, store, logger)
+	})).Methods("DELETE"), openapi.Operation{Summary: "Stop serving a mock API", Auth: true})
+
+	// the paths of a mock are only known from its document
+	openapi.Describe(mux.PathPrefix(prefix+"{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleMock(w, r, store, logger)
+	}), openapi.Operation{Hidden: true})
+}
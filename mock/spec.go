@@ -0,0 +1,485 @@
+package mock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Types accepts both the OpenAPI 3.0 "type": "string" and the 3.1
+// "type": ["string", "null"] forms
+type Types []string
+
+func (t *Types) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*t = Types{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*t = list
+	return nil
+}
+
+func (t Types) Has(name string) bool {
+	for _, value := range t {
+		if value == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Primary is the first non null type, empty when the schema declares none
+func (t Types) Primary() string {
+	for _, value := range t {
+		if value != "null" {
+			return value
+		}
+	}
+	return ""
+}
+
+type Schema struct {
+	Ref         string             `json:"$ref"`
+	Type        Types              `json:"type"`
+	Format      string             `json:"format"`
+	Enum        []interface{}      `json:"enum"`
+	Example     interface{}        `json:"example"`
+	Default     interface{}        `json:"default"`
+	Nullable    bool               `json:"nullable"`
+	Properties  map[string]*Schema `json:"properties"`
+	Required    []string           `json:"required"`
+	Items       *Schema            `json:"items"`
+	MinItems    *int               `json:"minItems"`
+	MaxItems    *int               `json:"maxItems"`
+	MinLength   *int               `json:"minLength"`
+	MaxLength   *int               `json:"maxLength"`
+	Minimum     *float64           `json:"minimum"`
+	Maximum     *float64           `json:"maximum"`
+	Pattern     string             `json:"pattern"`
+	AllOf       []*Schema          `json:"allOf"`
+	OneOf       []*Schema          `json:"oneOf"`
+	AnyOf       []*Schema          `json:"anyOf"`
+	ReadOnly    bool               `json:"readOnly"`
+	WriteOnly   bool               `json:"writeOnly"`
+	Description string             `json:"description"`
+}
+
+type Example struct {
+	Value interface{} `json:"value"`
+}
+
+type MediaType struct {
+	Schema   *Schema            `json:"schema"`
+	Example  interface{}        `json:"example"`
+	Examples map[string]Example `json:"examples"`
+}
+
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Ref      string               `json:"$ref"`
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref         string               `json:"$ref"`
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content"`
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Parameters  []*Parameter         `json:"parameters"`
+	RequestBody *RequestBody         `json:"requestBody"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type PathItem struct {
+	Parameters []*Parameter `json:"parameters"`
+	Get        *Operation   `json:"get"`
+	Put        *Operation   `json:"put"`
+	Post       *Operation   `json:"post"`
+	Delete     *Operation   `json:"delete"`
+	Options    *Operation   `json:"options"`
+	Head       *Operation   `json:"head"`
+	Patch      *Operation   `json:"patch"`
+}
+
+func (p *PathItem) operations() map[string]*Operation {
+	operations := map[string]*Operation{}
+	for method, op := range map[string]*Operation{
+		"GET": p.Get, "PUT": p.Put, "POST": p.Post, "DELETE": p.Delete,
+		"OPTIONS": p.Options, "HEAD": p.Head, "PATCH": p.Patch,
+	} {
+		if op != nil {
+			operations[method] = op
+		}
+	}
+	return operations
+}
+
+type Components struct {
+	Schemas       map[string]*Schema      `json:"schemas"`
+	Parameters    map[string]*Parameter   `json:"parameters"`
+	RequestBodies map[string]*RequestBody `json:"requestBodies"`
+	Responses     map[string]*Response    `json:"responses"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Servers    []Server             `json:"servers"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+// route is a path of the document compiled for matching request paths
+type route struct {
+	template   string
+	pattern    *regexp.Regexp
+	names      []string
+	item       *PathItem
+	operations map[string]*Operation
+}
+
+// Spec is an uploaded document ready to serve
+type Spec struct {
+	Name        string
+	Document    Document
+	Raw         []byte
+	ContentType string
+	UploadedAt  time.Time
+	basePath    string
+	routes      []*route
+}
+
+var templateParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+// Parse reads an OpenAPI 3 document in JSON or YAML
+func Parse(name string, raw []byte, contentType string) (*Spec, error) {
+	var generic interface{}
+	if err := yaml.Unmarshal(raw, &generic); err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	// YAML is a superset of JSON, re-encoding gives the typed model a single
+	// input format
+	encoded, err := json.Marshal(stringKeys(generic))
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	document := Document{}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	if !strings.HasPrefix(document.OpenAPI, "3.") {
+		return nil, errors.New("only OpenAPI 3 documents are supported")
+	}
+	if len(document.Paths) == 0 {
+		return nil, errors.New("the document declares no paths")
+	}
+	if err := checkDocument(document); err != nil {
+		return nil, err
+	}
+
+	spec := &Spec{
+		Name:        name,
+		Document:    document,
+		Raw:         raw,
+		ContentType: contentType,
+		UploadedAt:  time.Now(),
+	}
+	if len(document.Servers) > 0 {
+		if server, err := url.Parse(document.Servers[0].URL); err == nil {
+			spec.basePath = strings.TrimSuffix(server.Path, "/")
+		}
+	}
+	for template, item := range document.Paths {
+		if item == nil {
+			continue
+		}
+		compiled := &route{template: template, item: item, operations: item.operations()}
+		pattern := "^"
+		last := 0
+		for _, match := range templateParam.FindAllStringSubmatchIndex(template, -1) {
+			pattern += regexp.QuoteMeta(template[last:match[0]]) + "([^/]+)"
+			compiled.names = append(compiled.names, template[match[2]:match[3]])
+			last = match[1]
+		}
+		compiled.pattern, err = regexp.Compile(pattern + regexp.QuoteMeta(template[last:]) + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %s: %w", template, err)
+		}
+		spec.routes = append(spec.routes, compiled)
+	}
+	// literal paths win over templated ones, /users/me before /users/{id}
+	sort.Slice(spec.routes, func(i, j int) bool {
+		a, b := spec.routes[i], spec.routes[j]
+		if len(a.names) != len(b.names) {
+			return len(a.names) < len(b.names)
+		}
+		return a.template < b.template
+	})
+	return spec, nil
+}
+
+// checkDocument rejects schemas whose ranges cannot be generated, such as
+// a negative maxItems or a minimum above the maximum
+func checkDocument(document Document) error {
+	schemas := []*Schema{}
+	addContent := func(content map[string]MediaType) {
+		for _, media := range content {
+			schemas = append(schemas, media.Schema)
+		}
+	}
+	addParameters := func(parameters []*Parameter) {
+		for _, parameter := range parameters {
+			if parameter != nil {
+				schemas = append(schemas, parameter.Schema)
+			}
+		}
+	}
+	for _, item := range document.Paths {
+		if item == nil {
+			continue
+		}
+		addParameters(item.Parameters)
+		for _, op := range item.operations() {
+			addParameters(op.Parameters)
+			if op.RequestBody != nil {
+				addContent(op.RequestBody.Content)
+			}
+			for _, response := range op.Responses {
+				if response != nil {
+					addContent(response.Content)
+				}
+			}
+		}
+	}
+	components := document.Components
+	for _, schema := range components.Schemas {
+		schemas = append(schemas, schema)
+	}
+	for _, parameter := range components.Parameters {
+		addParameters([]*Parameter{parameter})
+	}
+	for _, body := range components.RequestBodies {
+		if body != nil {
+			addContent(body.Content)
+		}
+	}
+	for _, response := range components.Responses {
+		if response != nil {
+			addContent(response.Content)
+		}
+	}
+	checked := map[*Schema]bool{}
+	for _, schema := range schemas {
+		if err := checkSchema(schema, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkSchema(schema *Schema, checked map[*Schema]bool) error {
+	if schema == nil || checked[schema] {
+		return nil
+	}
+	checked[schema] = true
+	for name, value := range map[string]*int{
+		"minItems": schema.MinItems, "maxItems": schema.MaxItems,
+		"minLength": schema.MinLength, "maxLength": schema.MaxLength,
+	} {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("invalid schema: %s must not be negative", name)
+		}
+	}
+	if schema.MinItems != nil && schema.MaxItems != nil && *schema.MinItems > *schema.MaxItems {
+		return errors.New("invalid schema: minItems is above maxItems")
+	}
+	if schema.MinLength != nil && schema.MaxLength != nil && *schema.MinLength > *schema.MaxLength {
+		return errors.New("invalid schema: minLength is above maxLength")
+	}
+	for name, value := range map[string]*float64{"minimum": schema.Minimum, "maximum": schema.Maximum} {
+		if value != nil && (math.IsNaN(*value) || math.IsInf(*value, 0)) {
+			return fmt.Errorf("invalid schema: %s must be finite", name)
+		}
+	}
+	if schema.Minimum != nil && schema.Maximum != nil && *schema.Minimum > *schema.Maximum {
+		return errors.New("invalid schema: minimum is above maximum")
+	}
+	children := []*Schema{schema.Items}
+	for _, property := range schema.Properties {
+		children = append(children, property)
+	}
+	children = append(children, schema.AllOf...)
+	children = append(children, schema.OneOf...)
+	children = append(children, schema.AnyOf...)
+	for _, child := range children {
+		if err := checkSchema(child, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stringKeys converts the map[interface{}]interface{} YAML produces for
+// unquoted keys such as response codes
+func stringKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = stringKeys(item)
+		}
+		return converted
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = stringKeys(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = stringKeys(item)
+		}
+	}
+	return value
+}
+
+// match finds the route for path and returns its path parameters
+func (s *Spec) match(path string) (*route, map[string]string) {
+	if s.basePath != "" && strings.HasPrefix(path, s.basePath+"/") {
+		path = strings.TrimPrefix(path, s.basePath)
+	}
+	if path == "" {
+		path = "/"
+	}
+	for _, candidate := range s.routes {
+		values := candidate.pattern.FindStringSubmatch(path)
+		if values == nil {
+			continue
+		}
+		params := map[string]string{}
+		for i, name := range candidate.names {
+			params[name], _ = url.PathUnescape(values[i+1])
+		}
+		return candidate, params
+	}
+	return nil, nil
+}
+
+func (s *Spec) Operations() int {
+	count := 0
+	for _, candidate := range s.routes {
+		count += len(candidate.operations)
+	}
+	return count
+}
+
+func refName(ref string, kind string) string {
+	return strings.TrimPrefix(ref, "#/components/"+kind+"/")
+}
+
+// resolve follows schema references, unknown references resolve to an
+// empty schema that accepts anything
+func (s *Spec) resolve(schema *Schema) *Schema {
+	for depth := 0; schema != nil && schema.Ref != "" && depth < 32; depth++ {
+		schema = s.Document.Components.Schemas[refName(schema.Ref, "schemas")]
+	}
+	if schema == nil || schema.Ref != "" {
+		return &Schema{}
+	}
+	return schema
+}
+
+func (s *Spec) parameter(parameter *Parameter) *Parameter {
+	if parameter != nil && parameter.Ref != "" {
+		return s.Document.Components.Parameters[refName(parameter.Ref, "parameters")]
+	}
+	return parameter
+}
+
+func (s *Spec) requestBody(body *RequestBody) *RequestBody {
+	if body != nil && body.Ref != "" {
+		return s.Document.Components.RequestBodies[refName(body.Ref, "requestBodies")]
+	}
+	return body
+}
+
+func (s *Spec) response(response *Response) *Response {
+	if response != nil && response.Ref != "" {
+		return s.Document.Components.Responses[refName(response.Ref, "responses")]
+	}
+	return response
+}
+
+// parameters merges the path item parameters with the operation ones, the
+// operation wins when both declare the same name and location
+func (s *Spec) parameters(item *PathItem, op *Operation) []*Parameter {
+	merged := map[string]*Parameter{}
+	order := []string{}
+	for _, list := range [][]*Parameter{item.Parameters, op.Parameters} {
+		for _, parameter := range list {
+			parameter = s.parameter(parameter)
+			if parameter == nil {
+				continue
+			}
+			key := parameter.In + ":" + parameter.Name
+			if _, ok := merged[key]; !ok {
+				order = append(order, key)
+			}
+			merged[key] = parameter
+		}
+	}
+	parameters := []*Parameter{}
+	for _, key := range order {
+		parameters = append(parameters, merged[key])
+	}
+	return parameters
+}
+
+// jsonMedia picks the JSON representation of content, or the first one
+func jsonMedia(content map[string]MediaType) (string, MediaType, bool) {
+	types := []string{}
+	for contentType := range content {
+		types = append(types, contentType)
+	}
+	sort.Strings(types)
+	for _, contentType := range types {
+		if contentType == "application/json" || strings.HasSuffix(contentType, "+json") {
+			return contentType, content[contentType], true
+		}
+	}
+	if len(types) == 0 {
+		return "", MediaType{}, false
+	}
+	return types[0], content[types[0]], true
+}
@@ -0,0 +1,49 @@
+package mock
+
+import (
+	"sort"
+	"sync"
+)
+
+// Store holds the uploaded documents by name, safe for concurrent use
+type Store struct {
+	mu    sync.RWMutex
+	specs map[string]*Spec
+}
+
+func NewStore() *Store {
+	return &Store{specs: map[string]*Spec{}}
+}
+
+func (s *Store) Get(name string) (*Spec, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spec, ok := s.specs[name]
+	return spec, ok
+}
+
+func (s *Store) Set(spec *Spec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.specs[spec.Name] = spec
+}
+
+func (s *Store) Delete(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.specs[name]
+	delete(s.specs, name)
+	return ok
+}
+
+// List returns the documents sorted by name
+func (s *Store) List() []*Spec {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	specs := []*Spec{}
+	for _, spec := range s.specs {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs
+}
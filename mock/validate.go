@@ -0,0 +1,279 @@
+package mock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ValidationError points at the part of the request that does not match
+// the document, such as query.limit or body.items[0].name
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// validateRequest checks the parameters and body of r against op
+func (s *Spec) validateRequest(r *http.Request, item *PathItem, op *Operation, pathParams map[string]string) []ValidationError {
+	errs := []ValidationError{}
+	query := r.URL.Query()
+	for _, parameter := range s.parameters(item, op) {
+		var values []string
+		switch parameter.In {
+		case "path":
+			if value, ok := pathParams[parameter.Name]; ok {
+				values = []string{value}
+			}
+		case "query":
+			values = query[parameter.Name]
+		case "header":
+			values = r.Header.Values(parameter.Name)
+		case "cookie":
+			if cookie, err := r.Cookie(parameter.Name); err == nil {
+				values = []string{cookie.Value}
+			}
+		}
+		field := parameter.In + "." + parameter.Name
+		if len(values) == 0 {
+			if parameter.Required {
+				errs = append(errs, ValidationError{field, "is required"})
+			}
+			continue
+		}
+		if parameter.Schema == nil {
+			continue
+		}
+		schema := s.resolve(parameter.Schema)
+		if schemaType(schema) == "array" {
+			items := []interface{}{}
+			for _, value := range values {
+				for _, part := range strings.Split(value, ",") {
+					items = append(items, coerce(s.resolve(schema.Items), part))
+				}
+			}
+			errs = s.validate(schema, items, field, errs, 0)
+			continue
+		}
+		errs = s.validate(schema, coerce(schema, values[0]), field, errs, 0)
+	}
+
+	body := s.requestBody(op.RequestBody)
+	if body == nil {
+		return errs
+	}
+	contentType, media, ok := jsonMedia(body.Content)
+	if !ok || media.Schema == nil || !strings.Contains(contentType, "json") {
+		return errs
+	}
+	var value interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		if errors.Is(err, io.EOF) {
+			if body.Required {
+				errs = append(errs, ValidationError{"body", "is required"})
+			}
+			return errs
+		}
+		return append(errs, ValidationError{"body", "is not valid JSON: " + err.Error()})
+	}
+	return s.validate(media.Schema, value, "body", errs, 0)
+}
+
+// coerce converts a parameter string to the type its schema declares so it
+// can be validated like a JSON value
+func coerce(schema *Schema, value string) interface{} {
+	switch schemaType(schema) {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	case "boolean":
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return value
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number, float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func (s *Spec) validate(schema *Schema, value interface{}, field string, errs []ValidationError, depth int) []ValidationError {
+	schema = s.resolve(schema)
+	if depth > maxDepth*4 {
+		return errs
+	}
+	for _, part := range schema.AllOf {
+		errs = s.validate(part, value, field, errs, depth+1)
+	}
+	for _, alternatives := range [][]*Schema{schema.OneOf, schema.AnyOf} {
+		if len(alternatives) == 0 {
+			continue
+		}
+		matched := false
+		for _, alternative := range alternatives {
+			if len(s.validate(alternative, value, field, nil, depth+1)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errs = append(errs, ValidationError{field, "does not match any of the allowed schemas"})
+		}
+	}
+
+	if value == nil {
+		if schema.Nullable || schema.Type.Has("null") || schemaType(schema) == "" {
+			return errs
+		}
+		return append(errs, ValidationError{field, "must not be null"})
+	}
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, value) {
+		return append(errs, ValidationError{field, fmt.Sprintf("must be one of %v", schema.Enum)})
+	}
+
+	expected := schemaType(schema)
+	switch expected {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, ValidationError{field, "must be an object, got " + typeName(value)})
+		}
+		for _, name := range schema.Required {
+			property := s.resolve(schema.Properties[name])
+			if _, ok := object[name]; !ok && !property.ReadOnly {
+				errs = append(errs, ValidationError{field + "." + name, "is required"})
+			}
+		}
+		for name, property := range schema.Properties {
+			if item, ok := object[name]; ok {
+				errs = s.validate(property, item, field+"."+name, errs, depth+1)
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(errs, ValidationError{field, "must be an array, got " + typeName(value)})
+		}
+		if schema.MinItems != nil && len(items) < *schema.MinItems {
+			errs = append(errs, ValidationError{field, fmt.Sprintf("must have at least %d items", *schema.MinItems)})
+		}
+		if schema.MaxItems != nil && len(items) > *schema.MaxItems {
+			errs = append(errs, ValidationError{field, fmt.Sprintf("must have at most %d items", *schema.MaxItems)})
+		}
+		if schema.Items != nil {
+			for i, item := range items {
+				errs = s.validate(schema.Items, item, fmt.Sprintf("%s[%d]", field, i), errs, depth+1)
+			}
+		}
+	case "integer", "number":
+		number, ok := toFloat(value)
+		if !ok {
+			return append(errs, ValidationError{field, "must be of type " + expected + ", got " + typeName(value)})
+		}
+		if expected == "integer" && number != math.Trunc(number) {
+			return append(errs, ValidationError{field, "must be an integer"})
+		}
+		if schema.Minimum != nil && number < *schema.Minimum {
+			errs = append(errs, ValidationError{field, fmt.Sprintf("must be at least %v", *schema.Minimum)})
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			errs = append(errs, ValidationError{field, fmt.Sprintf("must be at most %v", *schema.Maximum)})
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return append(errs, ValidationError{field, "must be a boolean, got " + typeName(value)})
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return append(errs, ValidationError{field, "must be a string, got " + typeName(value)})
+		}
+		errs = validateString(schema, text, field, errs)
+	}
+	return errs
+}
+
+func validateString(schema *Schema, text string, field string, errs []ValidationError) []ValidationError {
+	length := utf8.RuneCountInString(text)
+	if schema.MinLength != nil && length < *schema.MinLength {
+		errs = append(errs, ValidationError{field, fmt.Sprintf("must be at least %d characters", *schema.MinLength)})
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		errs = append(errs, ValidationError{field, fmt.Sprintf("must be at most %d characters", *schema.MaxLength)})
+	}
+	if schema.Pattern != "" {
+		if pattern, err := regexp.Compile(schema.Pattern); err == nil && !pattern.MatchString(text) {
+			errs = append(errs, ValidationError{field, "must match " + schema.Pattern})
+		}
+	}
+	valid := true
+	switch schema.Format {
+	case "email":
+		_, err := mail.ParseAddress(text)
+		valid = err == nil
+	case "uuid":
+		valid = uuidPattern.MatchString(text)
+	case "date":
+		_, err := time.Parse(time.DateOnly, text)
+		valid = err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, text)
+		valid = err == nil
+	}
+	if !valid {
+		errs = append(errs, ValidationError{field, "must be a valid " + schema.Format})
+	}
+	return errs
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case json.Number:
+		number, err := value.Float64()
+		return number, err == nil
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if fmt.Sprint(allowed) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
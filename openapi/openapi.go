@@ -0,0 +1,284 @@
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"nojoke/lib"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+//go:embed docs.html
+var docsPage []byte
+
+// Operation documents a route registered on the router, routes without an
+// Operation are still listed with a generic description
+type Operation struct {
+	Summary string
+	Tags    []string
+	// sample value of the request body, nil when the route takes none
+	Request interface{}
+	// sample value of lib.DataResponse.Data, or of the whole body when Raw
+	Response interface{}
+	// paginated list response taking limit and page query parameters
+	List bool
+	// the route accepts the JWT returned by /api/auth/signin
+	Auth bool
+	// the response is not wrapped in lib.DataResponse
+	Raw bool
+	// content type of a Raw response, application/json by default
+	ContentType string
+	// leave the route out of the document
+	Hidden bool
+}
+
+var (
+	mu         sync.RWMutex
+	operations = map[*mux.Route]Operation{}
+)
+
+// Describe attaches op to route and returns route for chaining
+func Describe(route *mux.Route, op Operation) *mux.Route {
+	mu.Lock()
+	defer mu.Unlock()
+	operations[route] = op
+	return route
+}
+
+func lookup(route *mux.Route) (Operation, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	op, ok := operations[route]
+	return op, ok
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type OperationObject struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type Document struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Info       Info                                   `json:"info"`
+	Paths      map[string]map[string]*OperationObject `json:"paths"`
+	Components Components                             `json:"components"`
+}
+
+var pathParam = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+func jsonContent(schema *Schema) map[string]MediaType {
+	return map[string]MediaType{"application/json": {Schema: schema}}
+}
+
+func defaultTag(template string) string {
+	parts := strings.Split(strings.Trim(template, "/"), "/")
+	if len(parts) > 1 && parts[0] == "api" {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+func operationID(method string, template string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.Split(pathParam.ReplaceAllString(template, "by_$1"), "/") {
+		if part != "" {
+			id += "_" + strings.ReplaceAll(part, "-", "_")
+		}
+	}
+	return id
+}
+
+func (b *schemaBuilder) operation(method string, template string, op Operation, described bool) *OperationObject {
+	object := &OperationObject{
+		OperationID: operationID(method, template),
+		Summary:     op.Summary,
+		Tags:        op.Tags,
+		Responses:   map[string]Response{},
+	}
+	if object.Summary == "" {
+		object.Summary = method + " " + template
+	}
+	if len(object.Tags) == 0 {
+		object.Tags = []string{defaultTag(template)}
+	}
+	for _, match := range pathParam.FindAllStringSubmatch(template, -1) {
+		object.Parameters = append(object.Parameters, Parameter{
+			Name: match[1], In: "path", Required: true, Schema: &Schema{Type: "string"},
+		})
+	}
+	if op.List {
+		object.Parameters = append(object.Parameters,
+			Parameter{Name: "limit", In: "query", Schema: &Schema{Type: "integer"}},
+			Parameter{Name: "page", In: "query", Schema: &Schema{Type: "integer"}},
+		)
+	}
+	if op.Request != nil {
+		object.RequestBody = &RequestBody{Required: true, Content: jsonContent(b.schemaOf(op.Request))}
+	}
+	if op.Auth {
+		object.Security = []map[string][]string{{"bearerAuth": {}}}
+	}
+
+	if !described {
+		object.Responses["200"] = Response{Description: "OK"}
+		return object
+	}
+	if op.Raw {
+		contentType := op.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		schema := b.schemaOf(op.Response)
+		if op.Response == nil {
+			schema = &Schema{Type: "string"}
+		}
+		object.Responses["200"] = Response{
+			Description: "OK",
+			Content:     map[string]MediaType{contentType: {Schema: schema}},
+		}
+	} else {
+		data := b.schemaOf(op.Response)
+		if op.List {
+			data = &Schema{Type: "array", Items: data}
+		}
+		envelope := &Schema{
+			Type: "object",
+			Properties: map[string]*Schema{
+				"status":     {Type: "integer"},
+				"message":    {Type: "string"},
+				"data":       data,
+				"pagination": b.schemaOf(lib.Pagination{}),
+			},
+		}
+		object.Responses["200"] = Response{Description: "OK", Content: jsonContent(envelope)}
+	}
+	object.Responses["default"] = Response{
+		Description: "Error",
+		Content:     jsonContent(b.schemaOf(lib.ErrorResponse{})),
+	}
+	return object
+}
+
+// Build walks router and documents every route that has a path template,
+// it runs per request so routes added later are always included
+func Build(router *mux.Router, info Info) (Document, error) {
+	builder := newSchemaBuilder()
+	document := Document{
+		OpenAPI: "3.0.3",
+		Info:    info,
+		Paths:   map[string]map[string]*OperationObject{},
+	}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+		op, described := lookup(route)
+		if op.Hidden {
+			return nil
+		}
+		path := pathParam.ReplaceAllString(template, "{$1}")
+		if document.Paths[path] == nil {
+			document.Paths[path] = map[string]*OperationObject{}
+		}
+		for _, method := range methods {
+			if method == http.MethodHead || method == http.MethodOptions {
+				continue
+			}
+			document.Paths[path][strings.ToLower(method)] = builder.operation(method, template, op, described)
+		}
+		return nil
+	})
+	document.Components = Components{
+		Schemas: builder.components,
+		SecuritySchemes: map[string]SecurityScheme{
+			"bearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+		},
+	}
+	return document, err
+}
+
+func handleSpec(w http.ResponseWriter, r *http.Request, router *mux.Router, info Info) {
+	w.Header().Set("Content-Type", "application/json")
+	document, err := Build(router, info)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, err.Error()))
+		return
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(document)
+}
+
+func InitOpenAPIRouter(mux *mux.Router, logger *lib.Logger, config *lib.Config, version string) {
+	info := Info{
+		Title:       "nojoke",
+		Version:     version,
+		Description: "Dynamic and flexible API services with Go",
+	}
+	Describe(mux.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		handleSpec(w, r, mux, info)
+	}).Methods("GET"), Operation{Summary: "OpenAPI document", Tags: []string{"docs"}, Raw: true, Response: map[string]interface{}{}})
+
+	Describe(mux.HandleFunc("/docs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(docsPage)
+	}).Methods("GET"), Operation{Summary: "Swagger UI", Tags: []string{"docs"}, Raw: true, ContentType: "text/html"})
+
+	Describe(mux.PathPrefix("/docs/").Handler(
+		http.StripPrefix("/docs/", http.FileServer(http.FS(swaggerFiles.FS))),
+	).Methods("GET"), Operation{Hidden: true})
+}
@@ -0,0 +1,207 @@
+package openapi
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of the OpenAPI 3 schema object nojoke needs
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// types with a custom JSON encoding that are documented as a scalar
+var scalars = map[reflect.Type]Schema{}
+
+// Scalar documents the type of sample as typ and format, for structs such as
+// timestamppb.Timestamp whose JSON encoding is a single string
+func Scalar(sample interface{}, typ string, format string) {
+	mu.Lock()
+	defer mu.Unlock()
+	scalars[reflect.TypeOf(sample)] = Schema{Type: typ, Format: format}
+}
+
+func scalar(t reflect.Type) (Schema, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	schema, ok := scalars[t]
+	return schema, ok
+}
+
+// schemaBuilder converts Go types to schemas, named structs are collected
+// as components and referenced with $ref
+type schemaBuilder struct {
+	components map[string]*Schema
+	names      map[reflect.Type]string
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{components: map[string]*Schema{}, names: map[reflect.Type]string{}}
+}
+
+func (b *schemaBuilder) schemaOf(v interface{}) *Schema {
+	if v == nil {
+		return &Schema{}
+	}
+	return b.schema(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	if schema, ok := scalar(t); ok {
+		return &schema
+	}
+	// scalars with their own JSON encoding, such as chaos.Duration, are
+	// written as strings
+	if t.Kind() != reflect.Struct && t.Implements(marshalerType) {
+		return &Schema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Uint8:
+		return &Schema{Type: "integer", Format: "uint8"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: b.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name, ok := b.names[t]
+		if !ok {
+			name = t.Name()
+			// the first type keeps its name, later ones of the same name
+			// from other packages are prefixed with the package, pb.User
+			// becomes PbUser
+			if _, taken := b.components[name]; taken {
+				pkg := path.Base(t.PkgPath())
+				name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+			}
+			b.names[t] = name
+			// register before recursing so self references terminate
+			b.components[name] = &Schema{}
+			*b.components[name] = *b.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	return &Schema{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	b.addFields(schema, t)
+	return schema
+}
+
+func (b *schemaBuilder) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				b.addFields(schema, embedded)
+				continue
+			}
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := b.schema(field.Type)
+		if required := applyValidation(property, field.Tag.Get("validate")); required {
+			schema.Required = append(schema.Required, name)
+		}
+		schema.Properties[name] = property
+	}
+}
+
+// applyValidation maps gookit/validate rules such as
+// "required|minLen:3|maxLen:20|email" onto the schema and reports whether
+// the field is required
+func applyValidation(schema *Schema, rules string) bool {
+	if rules == "" || schema.Ref != "" {
+		return strings.Contains(rules, "required")
+	}
+	required := false
+	for _, rule := range strings.Split(rules, "|") {
+		name, arg, _ := strings.Cut(rule, ":")
+		switch name {
+		case "required":
+			required = true
+		case "email":
+			schema.Format = "email"
+		case "url":
+			schema.Format = "uri"
+		case "minLen", "min_len":
+			if n, err := strconv.Atoi(arg); err == nil {
+				schema.MinLength = &n
+			}
+		case "maxLen", "max_len":
+			if n, err := strconv.Atoi(arg); err == nil {
+				schema.MaxLength = &n
+			}
+		case "min":
+			if n, err := strconv.ParseFloat(arg, 64); err == nil {
+				schema.Minimum = &n
+			}
+		case "max":
+			if n, err := strconv.ParseFloat(arg, 64); err == nil {
+				schema.Maximum = &n
+			}
+		case "in", "enum":
+			for _, value := range strings.Split(arg, ",") {
+				schema.Enum = append(schema.Enum, value)
+			}
+		}
+	}
+	return required
+}
@@ -1,9 +1,15 @@
 package product
 
 import (
+	"context"
 	"database/sql"
 	"nojoke/auth"
+	"nojoke/events"
 	"nojoke/lib"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type ProductQuery struct {
@@ -12,62 +18,220 @@ type ProductQuery struct {
 	admin    *auth.Admin
 }
 
-func (g *ProductQuery) HandleGuestGet(pagination *lib.Pagination) ([]Product, error) {
-	g.logger.Info("Getting products ...")
-	query := GetProductsWithoutCollectionQuery
-	rows, err := g.database.Query(query)
-	if err != nil {
-		g.logger.Error("Error getting products: " + err.Error())
-		return nil, err
-	}
+func NewProductQuery(database *sql.DB, logger *lib.Logger) *ProductQuery {
+	return &ProductQuery{database: database, logger: logger}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProduct(row rowScanner) (Product, error) {
+	product := Product{}
+	err := row.Scan(
+		&product.Id,
+		&product.Name,
+		&product.Price,
+		&product.Description,
+		&product.Discount,
+		&product.Rating,
+		&product.Stock,
+		&product.Brand,
+		&product.Category_id,
+		&product.Thumbnail,
+		&product.Image,
+		&product.Collection_id,
+		&product.UpdatedAt,
+	)
+	return product, err
+}
+
+func scanProducts(rows *sql.Rows) ([]Product, error) {
+	defer rows.Close()
 	productList := []Product{}
 	for rows.Next() {
-		product := Product{}
-		err = rows.Scan(
-			&product.Id,
-			&product.Name,
-			&product.Price,
-			&product.Description,
-			&product.Discount,
-			&product.Rating,
-			&product.Stock,
-			&product.Brand,
-			&product.Category_id,
-			&product.Thumbnail,
-			&product.Image,
-			&product.Collection_id,
-		)
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
 		productList = append(productList, product)
 	}
-	return productList, nil
+	return productList, rows.Err()
 }
 
-func (g *ProductQuery) HandleGet(collectionId int, pagination *lib.Pagination) ([]Product, error) {
-	g.logger.Info("Getting products ...")
-	query := GetProductsByCollectionQuery
-	rows, err := g.database.Query(query, collectionId)
+// List returns a page of products and sets pagination.Total, guests only see
+// the products outside of any collection and collectionId 0 means every
+// collection
+func (g *ProductQuery) List(ctx context.Context, guest bool, collectionId int64, pagination *lib.Pagination) ([]Product, error) {
+	g.logger.DebugContext(ctx, "Getting products", "query", "GetProductsPageQuery", "collection_id", collectionId)
+	err := lib.DB(ctx, g.database).QueryRowContext(ctx, CountProductsPageQuery, guest, collectionId).Scan(&pagination.Total)
 	if err != nil {
-		g.logger.Error("Error getting products: " + err.Error())
+		g.logger.ErrorContext(ctx, "Error counting products", "error", err)
 		return nil, err
 	}
-	productList := []Product{}
+	offset := (pagination.Page - 1) * pagination.Limit
+	rows, err := lib.DB(ctx, g.database).QueryContext(ctx, GetProductsPageQuery, guest, collectionId, pagination.Limit, offset)
+	if err != nil {
+		g.logger.ErrorContext(ctx, "Error getting products", "error", err)
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// ByCollections returns the products of every collection in ids with one
+// query
+func (g *ProductQuery) ByCollections(ctx context.Context, ids []int64) (map[int64][]Product, error) {
+	rows, err := lib.DB(ctx, g.database).QueryContext(ctx, GetProductsByCollectionsQuery, pq.Array(ids))
+	if err != nil {
+		g.logger.ErrorContext(ctx, "Error getting products", "error", err)
+		return nil, err
+	}
+	productList, err := scanProducts(rows)
+	if err != nil {
+		return nil, err
+	}
+	products := map[int64][]Product{}
+	for _, product := range productList {
+		products[product.Collection_id] = append(products[product.Collection_id], product)
+	}
+	return products, nil
+}
+
+func (g *ProductQuery) LastModified(ctx context.Context) (time.Time, error) {
+	var lastModified time.Time
+	err := lib.DB(ctx, g.database).QueryRowContext(ctx, GetProductsLastModifiedQuery).Scan(&lastModified)
+	return lastModified, err
+}
+
+// FindOne returns sql.ErrNoRows when the product does not exist
+func (g *ProductQuery) FindOne(ctx context.Context, id int64) (Product, error) {
+	return scanProduct(lib.DB(ctx, g.database).QueryRowContext(ctx, GetProductQuery, id))
+}
+
+// ChangeEvent describes a change of product on the products channel and,
+// for products in a collection, on collections/{id} for admins only
+func ChangeEvent(typ string, product Product) events.Event {
+	channels := []string{"products"}
+	if product.Collection_id != 0 {
+		channels = append(channels, "collections/"+strconv.FormatInt(product.Collection_id, 10))
+	}
+	return events.Event{Type: typ, Data: product, Channels: channels, AdminOnly: product.Collection_id != 0}
+}
+
+func insertProduct(ctx context.Context, q lib.Queryer, product Product) (Product, error) {
+	return scanProduct(q.QueryRowContext(ctx, InsertProductQuery,
+		product.Name, product.Price, product.Description, product.Discount,
+		product.Rating, product.Stock, product.Brand, product.Category_id,
+		product.Thumbnail, product.Image, product.Collection_id,
+	))
+}
+
+// Create inserts product and returns the stored record
+func (g *ProductQuery) Create(ctx context.Context, product Product) (Product, error) {
+	product, err := insertProduct(ctx, lib.DB(ctx, g.database), product)
+	if err == nil {
+		events.Default.PublishContext(ctx, ChangeEvent("product.created", product))
+	}
+	return product, err
+}
+
+// Import inserts products one by one, or in a single transaction that stops
+// at the first failure when atomic. It returns the number of stored products
+// and the errors by index into products.
+func (g *ProductQuery) Import(ctx context.Context, products []Product, atomic bool) (int, map[int]error) {
+	failures := map[int]error{}
+	if !atomic {
+		imported := 0
+		for i, product := range products {
+			// the client left, the rows after i are not stored
+			if err := ctx.Err(); err != nil {
+				failures[i] = err
+				break
+			}
+			if _, err := g.Create(ctx, product); err != nil {
+				failures[i] = err
+				continue
+			}
+			imported++
+		}
+		return imported, failures
+	}
+	tx, err := lib.BeginTx(ctx, g.database)
+	if err != nil {
+		g.logger.ErrorContext(ctx, "Error creating transaction", "error", err)
+		failures[0] = err
+		return 0, failures
+	}
+	created := make([]Product, 0, len(products))
+	for i, product := range products {
+		if err := ctx.Err(); err != nil {
+			tx.Rollback()
+			failures[i] = err
+			return 0, failures
+		}
+		product, err := insertProduct(ctx, tx, product)
+		if err != nil {
+			tx.Rollback()
+			failures[i] = err
+			return 0, failures
+		}
+		created = append(created, product)
+	}
+	if err := tx.Commit(); err != nil {
+		g.logger.ErrorContext(ctx, "Error importing products", "error", err)
+		failures[0] = err
+		return 0, failures
+	}
+	for _, product := range created {
+		events.Default.PublishContext(ctx, ChangeEvent("product.created", product))
+	}
+	return len(created), failures
+}
+
+// Export calls each for every product in id order while reading them from
+// the database, with the same visibility as List
+func (g *ProductQuery) Export(ctx context.Context, guest bool, collectionId int64, each func(Product) error) error {
+	rows, err := lib.DB(ctx, g.database).QueryContext(ctx, ExportProductsQuery, guest, collectionId)
+	if err != nil {
+		g.logger.ErrorContext(ctx, "Error exporting products", "error", err)
+		return err
+	}
+	defer rows.Close()
 	for rows.Next() {
-		product := Product{}
-		err = rows.Scan(
-			&product.Id,
-			&product.Name,
-			&product.Price,
-			&product.Description,
-			&product.Discount,
-			&product.Rating,
-			&product.Stock,
-			&product.Brand,
-			&product.Category_id,
-			&product.Thumbnail,
-			&product.Image,
-			&product.Collection_id,
-		)
-		productList = append(productList, product)
+		product, err := scanProduct(rows)
+		if err != nil {
+			return err
+		}
+		if err := each(product); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Update returns the stored record, or sql.ErrNoRows when the product does
+// not exist
+func (g *ProductQuery) Update(ctx context.Context, product Product) (Product, error) {
+	product, err := scanProduct(lib.DB(ctx, g.database).QueryRowContext(ctx, UpdateProductQuery,
+		product.Id, product.Name, product.Price, product.Description,
+		product.Discount, product.Rating, product.Stock, product.Brand,
+		product.Category_id, product.Thumbnail, product.Image, product.Collection_id,
+	))
+	if err == nil {
+		events.Default.PublishContext(ctx, ChangeEvent("product.updated", product))
+	}
+	return product, err
+}
+
+func (g *ProductQuery) Delete(ctx context.Context, id int64) error {
+	product := Product{Id: id}
+	err := lib.DB(ctx, g.database).QueryRowContext(ctx, DeleteProductQuery, id).Scan(&product.Collection_id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
-	return productList, nil
+	events.Default.PublishContext(ctx, ChangeEvent("product.deleted", product))
+	return nil
 }
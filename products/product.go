@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"nojoke/auth"
 	"nojoke/lib"
+	"nojoke/openapi"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -22,18 +24,19 @@ type Category struct {
 }
 
 type Product struct {
-	Id            int64   `json:"id"`
-	Name          string  `json:"name" validate:"required"`
-	Price         int     `json:"price" validate:"required"`
-	Description   string  `json:"description" validate:"required"`
-	Discount      float32 `json:"discount"`
-	Rating        float32 `json:"rating"`
-	Stock         int     `json:"stock"`
-	Brand         string  `json:"brand" validate:"required"`
-	Category_id   int     `json:"category"`
-	Thumbnail     string  `json:"thumbnail"`
-	Image         string  `json:"image"`
-	Collection_id int64   `json:"collection_id"`
+	Id            int64     `json:"id"`
+	Name          string    `json:"name" validate:"required"`
+	Price         int       `json:"price" validate:"required"`
+	Description   string    `json:"description" validate:"required"`
+	Discount      float32   `json:"discount"`
+	Rating        float32   `json:"rating"`
+	Stock         int       `json:"stock"`
+	Brand         string    `json:"brand" validate:"required"`
+	Category_id   int       `json:"category"`
+	Thumbnail     string    `json:"thumbnail"`
+	Image         string    `json:"image"`
+	Collection_id int64     `json:"collection_id"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
 func GenerateProducts(limit int) []Product {
@@ -60,32 +63,25 @@ func handleGet(w http.ResponseWriter, r *http.Request, admin *auth.Admin, pq *Pr
 
 	limit := r.URL.Query().Get("limit")
 	page := r.URL.Query().Get("page")
-	total := r.URL.Query().Get("total")
-	limitInt, pageInt, totalInt, error := lib.PaginationParams(limit, page, total)
-
+	limitInt, pageInt, _, error := lib.PaginationParams(limit, page, "")
+	if error != nil || limitInt < 1 || pageInt < 1 {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid query params"))
+		return
+	}
 	pagination := lib.Pagination{
 		Limit: limitInt,
 		Page:  pageInt,
-		Total: totalInt,
-	}
-	if error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, error.Error()))
-		return
 	}
 
-	var productList []Product
-
-	if admin == nil {
-		productList, error = pq.HandleGuestGet(&pagination)
-	} else {
-		collectionId := 1
-		productList, error = pq.HandleGet(collectionId, &pagination)
+	// guests only see the products outside of any collection, admins the
+	// products of their collection
+	var collectionId int64
+	if admin != nil {
+		collectionId = 1
 	}
-	fmt.Println(productList)
+	productList, error := pq.List(r.Context(), admin == nil, collectionId, &pagination)
 	if error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, error.Error()))
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting products"))
 		return
 	}
 
@@ -97,115 +93,331 @@ func handleGet(w http.ResponseWriter, r *http.Request, admin *auth.Admin, pq *Pr
 		Data:       productList,
 		Pagination: pagination,
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	lastModified, _ := pq.LastModified(r.Context())
+	// guests and admins see different products
+	w.Header().Set("Vary", "Authorization")
+	w.Header().Set("Cache-Control", lib.CacheControlPrivate)
+	if lib.NotModified(w, r, lib.WeakETag(response), lastModified) {
+		return
+	}
+	lib.Render(w, r, http.StatusOK, response)
+}
+
+func parseId(r *http.Request) (int64, error) {
+	return strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+}
+
+func handleFindOne(w http.ResponseWriter, r *http.Request, admin *auth.Admin, pq *ProductQuery) {
+	w.Header().Add("Content-Type", "application/json")
+	intId, err := parseId(r)
+	if err != nil {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid Id"))
+		return
+	}
+	product, err := pq.FindOne(r.Context(), intId)
+	if err == sql.ErrNoRows {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "Product not found"))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting product"))
+		return
+	}
+	// guests only see the products outside of any collection, like the list
+	w.Header().Set("Vary", "Authorization")
+	w.Header().Set("Cache-Control", lib.CacheControlPrivate)
+	if admin == nil && product.Collection_id != 0 {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "Product not found"))
+		return
+	}
+	if lib.NotModified(w, r, lib.ETag(product), product.UpdatedAt) {
+		return
+	}
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "OK", product))
 }
 
-func handlePost(w http.ResponseWriter, r *http.Request, admin *auth.Admin) {
+func handlePost(w http.ResponseWriter, r *http.Request, admin *auth.Admin, pq *ProductQuery) {
 	w.Header().Add("Content-Type", "application/json")
+	if admin == nil {
+		lib.Render(w, r, http.StatusUnauthorized, lib.NewErrorResponse(401, "Unauthorized"))
+		return
+	}
 	data := Product{}
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err := lib.DecodeBody(r, &data)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, err.Error()))
 		return
 	}
 	isValid, message := lib.ValidateForm(data)
 	if !isValid {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, message))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, message))
+		return
+	}
+	data, err = pq.Create(r.Context(), data)
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error creating product"))
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(
-		lib.NewDataResponse(201, "OK", data),
-	)
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	lib.SetValidators(w, r, lib.ETag(data), data.UpdatedAt)
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(201, "OK", data))
 }
 
-func handlePut(w http.ResponseWriter, r *http.Request, admin *auth.Admin) {
+func handlePut(w http.ResponseWriter, r *http.Request, admin *auth.Admin, pq *ProductQuery) {
 	w.Header().Add("Content-Type", "application/json")
-	pathParams := mux.Vars(r)
-	id := pathParams["id"]
+	if admin == nil {
+		lib.Render(w, r, http.StatusUnauthorized, lib.NewErrorResponse(401, "Unauthorized"))
+		return
+	}
+	intId, err := parseId(r)
+	if err != nil {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid Id"))
+		return
+	}
 	data := Product{}
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err = lib.DecodeBody(r, &data)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, err.Error()))
 		return
 	}
 
 	isValid, message := lib.ValidateForm(data)
 	if !isValid {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, message))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, message))
 		return
 	}
-	userList := GenerateProducts(100)
-	found := false
-	for i, product := range userList {
-		if product.Id == data.Id || fmt.Sprint(product.Id) == id {
-			userList[i] = data
-			found = true
-			break
-		}
+	current, err := pq.FindOne(r.Context(), intId)
+	if err == sql.ErrNoRows {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "Product not found"))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting product"))
+		return
+	}
+	if lib.PreconditionFailed(w, r, lib.ETag(current), current.UpdatedAt) {
+		return
+	}
+	data.Id = intId
+	data, err = pq.Update(r.Context(), data)
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error updating product"))
+		return
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	lib.SetValidators(w, r, lib.ETag(data), data.UpdatedAt)
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "OK", data))
+}
+
+func handlePatch(w http.ResponseWriter, r *http.Request, admin *auth.Admin, pq *ProductQuery) {
+	w.Header().Add("Content-Type", "application/json")
+	if admin == nil {
+		lib.Render(w, r, http.StatusUnauthorized, lib.NewErrorResponse(401, "Unauthorized"))
+		return
 	}
-	if !found || data.Id == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Product not found"))
+	intId, err := parseId(r)
+	if err != nil {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid Id"))
+		return
+	}
+	current, err := pq.FindOne(r.Context(), intId)
+	if err == sql.ErrNoRows {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "Product not found"))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting product"))
+		return
+	}
+	if lib.PreconditionFailed(w, r, lib.ETag(current), current.UpdatedAt) {
+		return
+	}
+	data, err := lib.Patch(r, current)
+	if patchErr, ok := err.(*lib.PatchError); ok {
+		lib.Render(w, r, patchErr.Status, lib.NewErrorResponse(patchErr.Status, patchErr.Message))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error patching product"))
+		return
+	}
+	// only the patched document is validated, like a PUT of the whole product
+	isValid, message := lib.ValidateForm(data)
+	if !isValid {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, message))
+		return
+	}
+	data.Id = intId
+	data, err = pq.Update(r.Context(), data)
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error updating product"))
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(
-		lib.NewDataResponse(200, "OK", data),
-	)
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	lib.SetValidators(w, r, lib.ETag(data), data.UpdatedAt)
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "OK", data))
 }
 
-func handleDelete(w http.ResponseWriter, r *http.Request, admin *auth.Admin) {
+func handleDelete(w http.ResponseWriter, r *http.Request, admin *auth.Admin, pq *ProductQuery) {
 
 	w.Header().Add("Content-Type", "application/json")
-	pathParams := mux.Vars(r)
-	id := pathParams["id"]
-	intId, err := strconv.Atoi(id)
+	if admin == nil {
+		lib.Render(w, r, http.StatusUnauthorized, lib.NewErrorResponse(401, "Unauthorized"))
+		return
+	}
+	intId, err := parseId(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid Id"))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid Id"))
 		return
 	}
 
-	if intId == 0 || intId > 100 {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "User not found"))
+	current, err := pq.FindOne(r.Context(), intId)
+	if err == sql.ErrNoRows {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "Product not found"))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting product"))
+		return
+	}
+	if lib.PreconditionFailed(w, r, lib.ETag(current), current.UpdatedAt) {
+		return
+	}
+	err = pq.Delete(r.Context(), intId)
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error deleting product"))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(
-		lib.NewDataResponse(200, "DELETED", nil),
-	)
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "DELETED", nil))
 }
 
-func initializeDatabase(database *sql.DB, logger *lib.Logger) {
-	createTableQuery := CreateProductTableQuery
-	_, err := database.Exec(createTableQuery)
+func handleImport(w http.ResponseWriter, r *http.Request, admin *auth.Admin, pq *ProductQuery, config *lib.Config) {
+	if admin == nil {
+		lib.Render(w, r, http.StatusUnauthorized, lib.NewErrorResponse(401, "Unauthorized"))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	lib.Import(w, r, config.Import, lib.ValidateForm[Product], pq.Import)
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request, admin *auth.Admin, pq *ProductQuery) {
+	format, err := lib.ExportFormat(r)
 	if err != nil {
-		logger.Error("Error creating table" + err.Error())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
 		return
 	}
-	logger.Info("Table created successfully for Products")
+	// admins export every collection unless they pick one
+	var collectionId int64
+	if admin != nil && r.URL.Query().Get("collection_id") != "" {
+		collectionId, err = strconv.ParseInt(r.URL.Query().Get("collection_id"), 10, 64)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid collection_id"))
+			return
+		}
+	}
+	// the download starts with the first row, so a failing query can still
+	// be answered with an error
+	var exporter *lib.Exporter
+	start := func() error {
+		exporter, err = lib.NewExporter(w, format, "products", Product{})
+		return err
+	}
+	err = pq.Export(r.Context(), admin == nil, collectionId, func(product Product) error {
+		if exporter == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return exporter.Write(product)
+	})
+	if err != nil && exporter == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error exporting products"))
+		return
+	}
+	if err != nil {
+		// the status is sent, the client sees a truncated file
+		pq.logger.ErrorContext(r.Context(), "Error exporting products", "error", err)
+		return
+	}
+	if exporter == nil && start() != nil {
+		return
+	}
+	exporter.Close()
 }
 
-func InitProductRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger) {
-	initializeDatabase(database, logger)
-	router := mux.PathPrefix("/api/products").Subrouter()
-	pq := ProductQuery{
-		database: database,
-		logger:   logger,
+func insertMockData(database *sql.DB, logger *lib.Logger, config *lib.Config) {
+	var count int
+	tx, err := database.Begin()
+	if err != nil {
+		logger.Error("Error creating transaction", "error", err)
+		return
+	}
+	tx.QueryRow(CountProductsQuery).Scan(&count)
+	if count >= config.Mock.Products {
+		logger.Info("Product data already inserted Skipping")
+		tx.Rollback()
+		return
 	}
-	router.Handle("", auth.Authenticated(func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
-		handleGet(w, r, a, &pq)
-	})).Methods("GET")
+	productList := GenerateProducts(config.Mock.Products - count)
+	vals := []interface{}{}
+	sqlStr := `INSERT INTO products (name, price, description, discount, rating, stock, brand, category_id, thumbnail, image) VALUES `
+	for idx, product := range productList {
+		n := idx * 10
+		sqlStr += fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d),", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10)
+		vals = append(vals, product.Name, product.Price, product.Description, product.Discount, product.Rating,
+			product.Stock, product.Brand, product.Category_id, product.Thumbnail, product.Image)
+	}
+	sqlStr = sqlStr[0 : len(sqlStr)-1]
+	sqlStr += ";"
+	_, err = tx.Exec(sqlStr, vals...)
+	if err != nil {
+		logger.Error("Error inserting mock products", "error", err)
+		tx.Rollback()
+		return
+	}
+	tx.Commit()
+	logger.Info("Data inserted successfully for Product")
+}
+
+func InitProductRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config) {
+	insertMockData(database, logger, config)
+	lib.RegisterRecordCount(database, "products", CountProductsQuery)
+	pq := NewProductQuery(database, logger)
+	// the export picks CSV or NDJSON itself, see lib.ExportFormat, so it is
+	// matched before the negotiated routes
+	openapi.Describe(mux.Handle("/api/products/export", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleExport(w, r, a, pq)
+	})).Methods("GET"), openapi.Operation{Summary: "Download every visible product as CSV or NDJSON", Raw: true, ContentType: "text/csv", Auth: true})
+	router := mux.PathPrefix("/api/products").Subrouter()
+	router.Use(lib.Negotiate)
+	openapi.Describe(router.Handle("", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleGet(w, r, a, pq)
+	})).Methods("GET"), openapi.Operation{Summary: "List products, limited to the caller's collection when signed in", Response: Product{}, List: true, Auth: true})
 
-	router.Handle("", auth.Authenticated(handlePost)).Methods("POST")
-	router.Handle("/{id}", auth.Authenticated(handlePut)).Methods("PUT")
-	router.Handle("/{id}", auth.Authenticated(handleDelete)).Methods("DELETE")
+	openapi.Describe(router.Handle("", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handlePost(w, r, a, pq)
+	})).Methods("POST"), openapi.Operation{Summary: "Create a product", Request: Product{}, Response: Product{}, Auth: true})
+	openapi.Describe(router.Handle("/import", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleImport(w, r, a, pq, config)
+	})).Methods("POST"), openapi.Operation{Summary: "Import products from a CSV, JSON array or NDJSON body", Request: []Product{}, Response: lib.ImportResult{}, Auth: true})
+	openapi.Describe(router.Handle("/{id}", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleFindOne(w, r, a, pq)
+	})).Methods("GET"), openapi.Operation{Summary: "Get a product", Response: Product{}, Auth: true})
+	openapi.Describe(router.Handle("/{id}", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handlePut(w, r, a, pq)
+	})).Methods("PUT"), openapi.Operation{Summary: "Replace a product", Request: Product{}, Response: Product{}, Auth: true})
+	openapi.Describe(router.Handle("/{id}", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handlePatch(w, r, a, pq)
+	})).Methods("PATCH"), openapi.Operation{Summary: "Update a product with a JSON Merge Patch or a JSON Patch", Request: Product{}, Response: Product{}, Auth: true})
+	openapi.Describe(router.Handle("/{id}", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleDelete(w, r, a, pq)
+	})).Methods("DELETE"), openapi.Operation{Summary: "Delete a product", Auth: true})
 }
@@ -0,0 +1,51 @@
+package product
+
+import (
+	"net/http/httptest"
+	"nojoke/auth"
+	"nojoke/lib"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestFindOneHidesCollectionsFromGuests(t *testing.T) {
+	tests := []struct {
+		name         string
+		collectionId int64
+		admin        *auth.Admin
+		status       int
+	}{
+		{"guest, no collection", 0, nil, 200},
+		{"guest, in a collection", 3, nil, 404},
+		{"admin, in a collection", 3, &auth.Admin{Username: "admin"}, 200},
+	}
+	for _, tt := range tests {
+		database, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta(GetProductQuery)).WithArgs(int64(7)).WillReturnRows(sqlmock.NewRows([]string{
+			"id", "name", "price", "description", "discount", "rating", "stock", "brand", "category_id", "thumbnail", "image", "collection_id", "updated_at",
+		}).AddRow(7, "Mug", 12, "A mug", 0, 0, 3, "Nojoke", 1, "", "", tt.collectionId, time.Now()))
+		pq := NewProductQuery(database, lib.NewLogger(nil, lib.LogConfig{Level: "error"}))
+
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/api/products/7", nil), map[string]string{"id": "7"})
+		w := httptest.NewRecorder()
+		handleFindOne(w, r, tt.admin, pq)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		// the answer depends on who asks, shared caches must not keep it
+		if w.Header().Get("Cache-Control") != lib.CacheControlPrivate || w.Header().Get("Vary") != "Authorization" {
+			t.Errorf("%s: Cache-Control %q, Vary %q", tt.name, w.Header().Get("Cache-Control"), w.Header().Get("Vary"))
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		database.Close()
+	}
+}
@@ -17,24 +17,105 @@ const CreateProductTableQuery = `
 	);
 `
 
+const DropProductTableQuery = `
+	DROP TABLE IF EXISTS products;
+`
+
 const CountProductsQuery = `
 	SELECT COUNT(*) FROM products;
 `
 
-const GetProductsByCollectionQuery = `
-	SELECT p.id,p.name,p.price,p.description,p.discount,
-	p.rating,p.stock,p.brand,p.category_id,
-	p.thumbnail,p.image,p.collection_id
+const AddProductUpdatedAtQuery = `
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+	CREATE TRIGGER products_set_updated_at BEFORE UPDATE ON products
+		FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+`
+
+const DropProductUpdatedAtQuery = `
+	DROP TRIGGER IF EXISTS products_set_updated_at ON products;
+	ALTER TABLE products DROP COLUMN IF EXISTS updated_at;
+`
+
+const GetProductsPageQuery = `
+	SELECT
+	p.id,p.name,p.price,p.description,COALESCE(p.discount, 0),
+	COALESCE(p.rating, 0),p.stock,p.brand,COALESCE(p.category_id, 0),
+	COALESCE(p.thumbnail, ''),COALESCE(p.image, ''),COALESCE(p.collection_id, 0),
+	p.updated_at
+	FROM products p
+	WHERE (NOT $1::boolean OR p.collection_id IS NULL)
+	AND ($2::bigint = 0 OR p.collection_id = $2)
+	ORDER BY p.id
+	LIMIT $3 OFFSET $4;
+`
+
+const CountProductsPageQuery = `
+	SELECT COUNT(*) FROM products p
+	WHERE (NOT $1::boolean OR p.collection_id IS NULL)
+	AND ($2::bigint = 0 OR p.collection_id = $2);
+`
+
+const GetProductsByCollectionsQuery = `
+	SELECT
+	p.id,p.name,p.price,p.description,COALESCE(p.discount, 0),
+	COALESCE(p.rating, 0),p.stock,p.brand,COALESCE(p.category_id, 0),
+	COALESCE(p.thumbnail, ''),COALESCE(p.image, ''),COALESCE(p.collection_id, 0),
+	p.updated_at
 	FROM products p
-	JOIN collections c ON p.collection_id = c.id
-	WHERE c.id = $1;
+	WHERE p.collection_id = ANY($1)
+	ORDER BY p.id;
+`
+
+const GetProductQuery = `
+	SELECT
+	p.id,p.name,p.price,p.description,COALESCE(p.discount, 0),
+	COALESCE(p.rating, 0),p.stock,p.brand,COALESCE(p.category_id, 0),
+	COALESCE(p.thumbnail, ''),COALESCE(p.image, ''),COALESCE(p.collection_id, 0),
+	p.updated_at
+	FROM products p
+	WHERE p.id = $1;
+`
+
+const GetProductsLastModifiedQuery = `
+	SELECT COALESCE(MAX(updated_at), 'epoch') FROM products;
+`
+
+const InsertProductQuery = `
+	INSERT INTO products AS p (name, price, description, discount, rating,
+	stock, brand, category_id, thumbnail, image, collection_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, 0))
+	RETURNING
+	p.id,p.name,p.price,p.description,COALESCE(p.discount, 0),
+	COALESCE(p.rating, 0),p.stock,p.brand,COALESCE(p.category_id, 0),
+	COALESCE(p.thumbnail, ''),COALESCE(p.image, ''),COALESCE(p.collection_id, 0),
+	p.updated_at;
+`
+
+const UpdateProductQuery = `
+	UPDATE products AS p
+	SET name = $2, price = $3, description = $4, discount = $5, rating = $6,
+	stock = $7, brand = $8, category_id = $9, thumbnail = $10, image = $11,
+	collection_id = NULLIF($12, 0)
+	WHERE p.id = $1
+	RETURNING
+	p.id,p.name,p.price,p.description,COALESCE(p.discount, 0),
+	COALESCE(p.rating, 0),p.stock,p.brand,COALESCE(p.category_id, 0),
+	COALESCE(p.thumbnail, ''),COALESCE(p.image, ''),COALESCE(p.collection_id, 0),
+	p.updated_at;
+`
+
+const DeleteProductQuery = `
+	DELETE FROM products WHERE id = $1 RETURNING COALESCE(collection_id, 0);
 `
 
-const GetProductsWithoutCollectionQuery = `
-	SELECT 
-	p.id,p.name,p.price,p.description,p.discount,
-	p.rating,p.stock,p.brand,p.category_id,
-	p.thumbnail,p.image,p.collection_id
+const ExportProductsQuery = `
+	SELECT
+	p.id,p.name,p.price,p.description,COALESCE(p.discount, 0),
+	COALESCE(p.rating, 0),p.stock,p.brand,COALESCE(p.category_id, 0),
+	COALESCE(p.thumbnail, ''),COALESCE(p.image, ''),COALESCE(p.collection_id, 0),
+	p.updated_at
 	FROM products p
-	WHERE p.collection_id IS NULL;
+	WHERE (NOT $1::boolean OR p.collection_id IS NULL)
+	AND ($2::bigint = 0 OR p.collection_id = $2)
+	ORDER BY p.id;
 `
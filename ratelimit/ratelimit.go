@@ -0,0 +1,151 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"nojoke/auth"
+	"nojoke/lib"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+var exemptPrefixes = []string{"/health", "/metrics"}
+
+// Limiter throttles requests with a token bucket per client and policy
+type Limiter struct {
+	handler  http.Handler
+	store    Store
+	logger   *lib.Logger
+	config   *lib.Config
+	fallback Policy
+	policies map[string]Policy
+}
+
+func NewLimiter(handler http.Handler, store Store, logger *lib.Logger, config *lib.Config) *Limiter {
+	policies := map[string]Policy{}
+	for _, route := range config.RateLimit.Routes {
+		key := policyKey(route.Route, route.Method)
+		policies[key] = Policy{Name: key, Rate: route.Rate, Burst: route.Burst}
+	}
+	return &Limiter{
+		handler: handler,
+		store:   store,
+		logger:  logger,
+		config:  config,
+		fallback: Policy{
+			Name:  "default",
+			Rate:  config.RateLimit.Rate,
+			Burst: config.RateLimit.Burst,
+		},
+		policies: policies,
+	}
+}
+
+func policyKey(route string, method string) string {
+	return strings.ToUpper(method) + " " + route
+}
+
+// policy returns the policy of the route found by lib.Routes, a method
+// specific policy wins over one for any method
+func (l *Limiter) policy(r *http.Request) Policy {
+	template := lib.Route(r)
+	if template == "" {
+		return l.fallback
+	}
+	if policy, ok := l.policies[policyKey(template, r.Method)]; ok {
+		return policy
+	}
+	if policy, ok := l.policies[policyKey(template, "")]; ok {
+		return policy
+	}
+	return l.fallback
+}
+
+// identities names the buckets a request takes a token from: the client
+// address always, so signing up more admins buys no more requests, and the
+// verified admin as well, so an admin gets no more by changing address.
+// API keys are not checked against anything, so a new key must not buy a
+// new bucket.
+func (l *Limiter) identities(r *http.Request) []string {
+	identities := []string{"ip:" + ClientIP(r, l.config.RateLimit.TrustProxy)}
+	if token := auth.TokenFromRequest(r); token != "" {
+		claims, err := auth.ParseToken(token, l.config.Auth.JWTSecret)
+		if err == nil {
+			identities = append(identities, "admin:"+claims.Username)
+		}
+	}
+	return identities
+}
+
+// take takes a token from the bucket of every identity and returns the
+// tightest result, a request is allowed only when every bucket allows it
+func (l *Limiter) take(r *http.Request, policy Policy) (Result, error) {
+	var tightest Result
+	for i, identity := range l.identities(r) {
+		result, err := l.store.Take(r.Context(), policy.Name+"|"+identity, policy)
+		if err != nil {
+			return result, err
+		}
+		if i == 0 || result.Allowed && tightest.Allowed && result.Remaining < tightest.Remaining ||
+			!result.Allowed && (tightest.Allowed || result.RetryAfter > tightest.RetryAfter) {
+			tightest = result
+		}
+	}
+	return tightest, nil
+}
+
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func (l *Limiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range exemptPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			l.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	policy := l.policy(r)
+	result, err := l.take(r, policy)
+	if err != nil {
+		// fail open, an unavailable store must not take the API down
+		l.logger.ErrorContext(r.Context(), "Error taking rate limit token", "error", err)
+		l.handler.ServeHTTP(w, r)
+		return
+	}
+
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", seconds(result.Reset))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", policy.Burst, seconds(policy.Window())))
+
+	if !result.Allowed {
+		header.Set("Retry-After", seconds(result.RetryAfter))
+		header.Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(429, "Too many requests"))
+		return
+	}
+	l.handler.ServeHTTP(w, r)
+}
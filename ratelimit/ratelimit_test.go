@@ -0,0 +1,156 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"nojoke/lib"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	policy := Policy{Name: "test", Rate: 2, Burst: 3}
+	tests := []struct {
+		name      string
+		after     time.Duration
+		allowed   bool
+		remaining int
+	}{
+		{"first token of a full bucket", 0, true, 2},
+		{"second", 0, true, 1},
+		{"third empties the burst", 0, true, 0},
+		{"empty bucket", 0, false, 0},
+		{"half a second refills one token", 500 * time.Millisecond, true, 0},
+		{"refill never exceeds the burst", time.Hour, true, 2},
+	}
+	now := time.Unix(0, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	for _, tt := range tests {
+		now = now.Add(tt.after)
+		result, err := store.Take(context.Background(), "client", policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != tt.allowed || result.Remaining != tt.remaining {
+			t.Errorf("%s: allowed %v remaining %d, want %v %d", tt.name, result.Allowed, result.Remaining, tt.allowed, tt.remaining)
+		}
+		if !result.Allowed && result.RetryAfter <= 0 {
+			t.Errorf("%s: retry after %v", tt.name, result.RetryAfter)
+		}
+	}
+}
+
+func TestMemoryStoreKeysAreIndependent(t *testing.T) {
+	policy := Policy{Name: "test", Rate: 1, Burst: 1}
+	store := NewMemoryStore()
+	store.Take(context.Background(), "a", policy)
+	if result, _ := store.Take(context.Background(), "a", policy); result.Allowed {
+		t.Error("a should be limited")
+	}
+	if result, _ := store.Take(context.Background(), "b", policy); !result.Allowed {
+		t.Error("b should have its own bucket")
+	}
+}
+
+func signToken(t *testing.T, username string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &lib.Claims{
+		Username:         username,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestIdentities(t *testing.T) {
+	config := lib.DefaultConfig()
+	config.Auth.JWTSecret = "secret"
+	l := NewLimiter(nil, NewMemoryStore(), nil, config)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    []string
+	}{
+		{"ip", nil, []string{"ip:192.0.2.1"}},
+		{"unverified api keys share the ip bucket", map[string]string{APIKeyHeader: "random"}, []string{"ip:192.0.2.1"}},
+		{"forged token", map[string]string{"Authorization": "Bearer forged"}, []string{"ip:192.0.2.1"}},
+		{"verified admin", map[string]string{"Authorization": "Bearer " + signToken(t, "admin")}, []string{"ip:192.0.2.1", "admin:admin"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/users", nil)
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		if got := l.identities(r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: identities = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	config := lib.DefaultConfig()
+	config.Auth.JWTSecret = "secret"
+	config.RateLimit.Rate = 0.001
+	config.RateLimit.Burst = 3
+	config.RateLimit.Routes = []lib.RateLimitRoute{{Route: "/api/auth/signin", Method: "POST", Rate: 0.001, Burst: 1}}
+	router := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router.HandleFunc("/api/auth/signin", ok).Methods("POST")
+	router.HandleFunc("/api/products/{id}", ok)
+	limiter := lib.NewRoutes(NewLimiter(router, NewMemoryStore(), lib.NewLogger(nil, lib.LogConfig{Level: "error"}), config), router)
+
+	type request struct {
+		method, target, addr, admin string
+		status                      int
+	}
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{"route policy", []request{
+			{"POST", "/api/auth/signin", "192.0.2.1:1", "", 200},
+			{"POST", "/api/auth/signin", "192.0.2.1:1", "", 429},
+			{"POST", "/api/auth/signin", "192.0.2.2:1", "", 200},
+		}},
+		{"route templates share a bucket", []request{
+			{"GET", "/api/products/1", "192.0.2.3:1", "", 200},
+			{"GET", "/api/products/2", "192.0.2.3:1", "", 200},
+			{"GET", "/api/products/3", "192.0.2.3:1", "", 200},
+			{"GET", "/api/products/4", "192.0.2.3:1", "", 429},
+		}},
+		{"more admins buy no more requests from one address", []request{
+			{"GET", "/api/products/1", "192.0.2.4:1", "a", 200},
+			{"GET", "/api/products/1", "192.0.2.4:1", "b", 200},
+			{"GET", "/api/products/1", "192.0.2.4:1", "c", 200},
+			{"GET", "/api/products/1", "192.0.2.4:1", "d", 429},
+		}},
+		{"an admin gets no more from more addresses", []request{
+			{"GET", "/api/products/1", "192.0.2.5:1", "e", 200},
+			{"GET", "/api/products/1", "192.0.2.6:1", "e", 200},
+			{"GET", "/api/products/1", "192.0.2.7:1", "e", 200},
+			{"GET", "/api/products/1", "192.0.2.8:1", "e", 429},
+		}},
+	}
+	for _, tt := range tests {
+		for i, req := range tt.requests {
+			r := httptest.NewRequest(req.method, req.target, nil)
+			r.RemoteAddr = req.addr
+			if req.admin != "" {
+				r.Header.Set("Authorization", "Bearer "+signToken(t, req.admin))
+			}
+			w := httptest.NewRecorder()
+			limiter.ServeHTTP(w, r)
+			if w.Code != req.status {
+				t.Errorf("%s, request %d: status %d, want %d", tt.name, i+1, w.Code, req.status)
+			}
+		}
+	}
+}
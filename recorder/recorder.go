@@ -0,0 +1,246 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"nojoke/lib"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Header tells clients whether a response was replayed
+const Header = "X-Nojoke-Replay"
+
+// Exchange is one line of the recording
+type Exchange struct {
+	Time       time.Time `json:"time"`
+	DurationMs int64     `json:"duration_ms"`
+	Request    Request   `json:"request"`
+	Response   Response  `json:"response"`
+}
+
+type Request struct {
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Query   string      `json:"query"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+	// base64 when the body is not valid UTF-8, empty otherwise
+	BodyEncoding string `json:"body_encoding,omitempty"`
+}
+
+type Response struct {
+	Status       int         `json:"status"`
+	Headers      http.Header `json:"headers"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+}
+
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeBody(body string, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+// excluded reports whether path is never recorded or replayed
+func excluded(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact hides the values of credentials before they reach the file
+func redact(header http.Header, names []string) http.Header {
+	header = header.Clone()
+	for _, name := range names {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; ok {
+			header.Set(name, "[redacted]")
+		}
+	}
+	return header
+}
+
+// redactBody hides the values of fields at any depth of a JSON body, other
+// bodies are kept as they are
+func redactBody(body []byte, fields []string) []byte {
+	if len(fields) == 0 {
+		return body
+	}
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return body
+	}
+	redacted := map[string]bool{}
+	for _, field := range fields {
+		redacted[field] = true
+	}
+	if !hide(document, redacted) {
+		return body
+	}
+	content, err := json.Marshal(document)
+	if err != nil {
+		return body
+	}
+	return content
+}
+
+// hide replaces the redacted fields in place and reports whether it found
+// any
+func hide(value interface{}, redacted map[string]bool) bool {
+	found := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if redacted[key] {
+				v[key] = "[redacted]"
+				found = true
+			} else {
+				found = hide(field, redacted) || found
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			found = hide(item, redacted) || found
+		}
+	}
+	return found
+}
+
+// capture writes through to the client and keeps a copy of the body, a
+// response that outgrows maxBytes or streams is not recorded
+type capture struct {
+	*lib.ResponseWriter
+	body     bytes.Buffer
+	maxBytes int64
+	skip     bool
+}
+
+func (w *capture) WriteHeader(status int) {
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		w.skip = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *capture) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.skip {
+		if int64(w.body.Len()+len(b)) > w.maxBytes {
+			w.skip = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Recorder appends every request handled by handler and its response to a
+// JSONL file, one Exchange per line
+type Recorder struct {
+	handler http.Handler
+	logger  *lib.Logger
+	config  lib.RecorderConfig
+	mu      sync.Mutex
+	file    *os.File
+}
+
+func NewRecorder(handler http.Handler, logger *lib.Logger, config *lib.Config) (*Recorder, error) {
+	file, err := os.OpenFile(config.Recorder.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Recording requests", "file", config.Recorder.File)
+	return &Recorder{handler: handler, logger: logger, config: config.Recorder, file: file}, nil
+}
+
+func (rec *Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// WebSocket upgrades hijack the connection and cannot be replayed
+	if excluded(r.URL.Path, rec.config.Exclude) || r.Header.Get("Upgrade") != "" {
+		rec.handler.ServeHTTP(w, r)
+		return
+	}
+	start := time.Now()
+	body, err := io.ReadAll(io.LimitReader(r.Body, rec.config.MaxBodyBytes+1))
+	if err != nil {
+		rec.handler.ServeHTTP(w, r)
+		return
+	}
+	// the handler reads the whole body, including what was not recorded
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	tooLarge := int64(len(body)) > rec.config.MaxBodyBytes
+
+	cw := &capture{ResponseWriter: lib.NewResponseWriter(w), maxBytes: rec.config.MaxBodyBytes}
+	rec.handler.ServeHTTP(cw, r)
+	if tooLarge || cw.skip {
+		rec.logger.DebugContext(r.Context(), "Request not recorded", "path", r.URL.Path, "reason", "body too large or streamed")
+		return
+	}
+
+	status := cw.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	exchange := Exchange{
+		Time:       start.UTC(),
+		DurationMs: time.Since(start).Milliseconds(),
+		Request: Request{
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Query:   r.URL.RawQuery,
+			Headers: redact(r.Header, rec.config.RedactHeaders),
+		},
+		Response: Response{
+			Status:  status,
+			Headers: redact(cw.Header(), rec.config.RedactHeaders),
+		},
+	}
+	exchange.Request.Body, exchange.Request.BodyEncoding = encodeBody(redactBody(body, rec.config.RedactBodyFields))
+	exchange.Response.Body, exchange.Response.BodyEncoding = encodeBody(redactBody(cw.body.Bytes(), rec.config.RedactBodyFields))
+	if err := rec.write(exchange); err != nil {
+		rec.logger.ErrorContext(r.Context(), "Error recording request", "error", err)
+	}
+}
+
+// write appends one line with a single write so concurrent requests never
+// interleave
+func (rec *Recorder) write(exchange Exchange) error {
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		return err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	_, err = rec.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the recording once the server has drained its requests
+func (rec *Recorder) Close(ctx context.Context) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.file.Close()
+}
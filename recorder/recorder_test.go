@@ -0,0 +1,90 @@
+package recorder
+
+import (
+	"net/http"
+	"nojoke/lib"
+	"testing"
+)
+
+func TestMatcherKey(t *testing.T) {
+	type request struct {
+		method, path, query, body string
+	}
+	tests := []struct {
+		name   string
+		config lib.RecorderConfig
+		a, b   request
+		same   bool
+	}{
+		{"identical", lib.RecorderConfig{Match: lib.RecorderMatch{Query: true, Body: true}},
+			request{"GET", "/api/users", "limit=5", ""}, request{"GET", "/api/users", "limit=5", ""}, true},
+		{"method", lib.RecorderConfig{},
+			request{"GET", "/api/users", "", ""}, request{"DELETE", "/api/users", "", ""}, false},
+		{"path", lib.RecorderConfig{},
+			request{"GET", "/api/users", "", ""}, request{"GET", "/api/products", "", ""}, false},
+		{"query order", lib.RecorderConfig{Match: lib.RecorderMatch{Query: true}},
+			request{"GET", "/api/users", "limit=5&page=2", ""}, request{"GET", "/api/users", "page=2&limit=5", ""}, true},
+		{"other query", lib.RecorderConfig{Match: lib.RecorderMatch{Query: true}},
+			request{"GET", "/api/users", "limit=5", ""}, request{"GET", "/api/users", "limit=6", ""}, false},
+		{"query not compared", lib.RecorderConfig{},
+			request{"GET", "/api/users", "limit=5", ""}, request{"GET", "/api/users", "limit=6", ""}, true},
+		{"ignored query", lib.RecorderConfig{Match: lib.RecorderMatch{Query: true, IgnoreQuery: []string{"_"}}},
+			request{"GET", "/api/users", "limit=5&_=1", ""}, request{"GET", "/api/users", "_=2&limit=5", ""}, true},
+		{"json key order", lib.RecorderConfig{Match: lib.RecorderMatch{Body: true}},
+			request{"POST", "/api/users", "", `{"a": 1, "b": 2}`}, request{"POST", "/api/users", "", `{"b":2,"a":1}`}, true},
+		{"other json", lib.RecorderConfig{Match: lib.RecorderMatch{Body: true}},
+			request{"POST", "/api/users", "", `{"a": 1}`}, request{"POST", "/api/users", "", `{"a": 2}`}, false},
+		{"ignored nested field", lib.RecorderConfig{Match: lib.RecorderMatch{Body: true, IgnoreBodyFields: []string{"at"}}},
+			request{"POST", "/api/batch", "", `{"requests": [{"at": 1, "a": 1}]}`}, request{"POST", "/api/batch", "", `{"requests": [{"at": 2, "a": 1}]}`}, true},
+		{"redacted field", lib.RecorderConfig{RedactBodyFields: []string{"password"}, Match: lib.RecorderMatch{Body: true}},
+			request{"POST", "/api/users", "", `{"email": "a@b.c", "password": "[redacted]"}`}, request{"POST", "/api/users", "", `{"email": "a@b.c", "password": "hunter22"}`}, true},
+		{"raw body", lib.RecorderConfig{Match: lib.RecorderMatch{Body: true}},
+			request{"POST", "/api/users", "", "name,age\nx,1"}, request{"POST", "/api/users", "", "name,age\nx,2"}, false},
+	}
+	for _, tt := range tests {
+		m := newMatcher(tt.config)
+		a := m.key(tt.a.method, tt.a.path, tt.a.query, []byte(tt.a.body))
+		b := m.key(tt.b.method, tt.b.path, tt.b.query, []byte(tt.b.body))
+		if (a == b) != tt.same {
+			t.Errorf("%s: keys %q and %q, same = %v", tt.name, a, b, tt.same)
+		}
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"top level", `{"email": "a@b.c", "password": "hunter22"}`, `{"email":"a@b.c","password":"[redacted]"}`},
+		{"nested", `[{"user": {"password": "x"}}]`, `[{"user":{"password":"[redacted]"}}]`},
+		{"nothing to hide keeps the bytes", `{"email":  "a@b.c"}`, `{"email":  "a@b.c"}`},
+		{"not json", `password=hunter22`, `password=hunter22`},
+	}
+	for _, tt := range tests {
+		if got := string(redactBody([]byte(tt.body), []string{"password"})); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedactAndExclude(t *testing.T) {
+	header := http.Header{"Authorization": {"Bearer x"}, "Accept": {"*/*"}}
+	redacted := redact(header, []string{"authorization", "cookie"})
+	if redacted.Get("Authorization") != "[redacted]" || redacted.Get("Accept") != "*/*" || redacted.Get("Cookie") != "" {
+		t.Errorf("redacted = %v", redacted)
+	}
+	if header.Get("Authorization") != "Bearer x" {
+		t.Error("redact changed the request headers")
+	}
+	exclude := lib.DefaultConfig().Recorder.Exclude
+	for _, path := range []string{"/api/auth/signin", "/api/auth/signup", "/health/ready"} {
+		if !excluded(path, exclude) {
+			t.Errorf("%s is recorded", path)
+		}
+	}
+	if excluded("/api/users", exclude) {
+		t.Error("/api/users is not recorded")
+	}
+}
@@ -0,0 +1,214 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"nojoke/lib"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// headers that describe the replaying connection rather than the recorded
+// response
+var skippedHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Date":              true,
+	lib.RequestIDHeader: true,
+}
+
+// matcher turns a request into the key recorded responses are looked up by,
+// the method and path always have to match
+type matcher struct {
+	config lib.RecorderMatch
+}
+
+// newMatcher also ignores the redacted body fields, their recorded values
+// are gone
+func newMatcher(config lib.RecorderConfig) matcher {
+	match := config.Match
+	match.IgnoreBodyFields = append(append([]string{}, match.IgnoreBodyFields...), config.RedactBodyFields...)
+	return matcher{match}
+}
+
+func (m matcher) key(method string, path string, query string, body []byte) string {
+	parts := []string{method, path}
+	if m.config.Query {
+		parts = append(parts, m.query(query))
+	}
+	if m.config.Body {
+		parts = append(parts, m.body(body))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// query sorts the parameters and drops the ignored ones, such as cache
+// busters
+func (m matcher) query(raw string) string {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return raw
+	}
+	for _, name := range m.config.IgnoreQuery {
+		values.Del(name)
+	}
+	return values.Encode()
+}
+
+// body compares JSON by value, without the ignored fields at any depth, and
+// anything else byte for byte
+func (m matcher) body(body []byte) string {
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return string(body)
+	}
+	if len(m.config.IgnoreBodyFields) > 0 {
+		ignored := map[string]bool{}
+		for _, field := range m.config.IgnoreBodyFields {
+			ignored[field] = true
+		}
+		document = strip(document, ignored)
+	}
+	// maps are encoded with sorted keys, so key order does not matter
+	canonical, _ := json.Marshal(document)
+	return string(canonical)
+}
+
+func strip(value interface{}, ignored map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if ignored[key] {
+				delete(v, key)
+			} else {
+				v[key] = strip(field, ignored)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = strip(v[i], ignored)
+		}
+	}
+	return value
+}
+
+// Replayer answers purely from a recording. Requests that match several
+// exchanges get them in recorded order and the last one once the others
+// were used, so a session that reads, writes and reads again replays the
+// same way every time.
+type Replayer struct {
+	handler   http.Handler
+	logger    *lib.Logger
+	config    lib.RecorderConfig
+	matcher   matcher
+	mu        sync.Mutex
+	exchanges map[string][]Exchange
+	next      map[string]int
+}
+
+// NewReplayer loads the recording, handler only serves the excluded paths
+func NewReplayer(handler http.Handler, logger *lib.Logger, config *lib.Config) (*Replayer, error) {
+	file, err := os.Open(config.Recorder.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rp := &Replayer{
+		handler:   handler,
+		logger:    logger,
+		config:    config.Recorder,
+		matcher:   newMatcher(config.Recorder),
+		exchanges: map[string][]Exchange{},
+		next:      map[string]int{},
+	}
+	if err := rp.load(file); err != nil {
+		return nil, errors.New("recorder: " + config.Recorder.File + ": " + err.Error())
+	}
+	total := 0
+	for _, exchanges := range rp.exchanges {
+		total += len(exchanges)
+	}
+	logger.Info("Replaying recorded requests", "file", config.Recorder.File, "requests", total)
+	return rp, nil
+}
+
+func (rp *Replayer) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		exchange := Exchange{}
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			return errors.New("line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		body, err := decodeBody(exchange.Request.Body, exchange.Request.BodyEncoding)
+		if err != nil {
+			return errors.New("line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		key := rp.matcher.key(exchange.Request.Method, exchange.Request.Path, exchange.Request.Query, body)
+		rp.exchanges[key] = append(rp.exchanges[key], exchange)
+	}
+	return scanner.Err()
+}
+
+// take returns the next exchange recorded for key
+func (rp *Replayer) take(key string) (Exchange, bool) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	exchanges := rp.exchanges[key]
+	if len(exchanges) == 0 {
+		return Exchange{}, false
+	}
+	i := rp.next[key]
+	if i < len(exchanges)-1 {
+		rp.next[key] = i + 1
+	}
+	return exchanges[i], true
+}
+
+func (rp *Replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if excluded(r.URL.Path, rp.config.Exclude) {
+		rp.handler.ServeHTTP(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, rp.config.MaxBodyBytes))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(413, err.Error()))
+		return
+	}
+	exchange, ok := rp.take(rp.matcher.key(r.Method, r.URL.Path, r.URL.RawQuery, body))
+	if !ok {
+		rp.logger.WarnContext(r.Context(), "No recorded response", "method", r.Method, "path", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(Header, "MISS")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "No recorded response for "+r.Method+" "+r.URL.RequestURI()))
+		return
+	}
+	responseBody, err := decodeBody(exchange.Response.Body, exchange.Response.BodyEncoding)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Invalid recorded body"))
+		return
+	}
+	for name, values := range exchange.Response.Headers {
+		if !skippedHeaders[http.CanonicalHeaderKey(name)] {
+			w.Header()[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	w.Header().Set(Header, "HIT")
+	w.WriteHeader(exchange.Response.Status)
+	w.Write(responseBody)
+}
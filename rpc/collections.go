@@ -0,0 +1,49 @@
+package rpc
+
+import (
+	"context"
+	"nojoke/collections"
+	"nojoke/rpc/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type collectionService struct {
+	pb.UnimplementedCollectionServiceServer
+	collections *collections.CollectionQuery
+}
+
+func toCollection(c collections.Collection) *pb.Collection {
+	return &pb.Collection{
+		Id:        c.Id,
+		CreateAt:  c.CreateAt,
+		UserId:    c.UserId,
+		UpdatedAt: timestamppb.New(c.UpdatedAt),
+	}
+}
+
+func (s *collectionService) ListCollections(ctx context.Context, req *pb.PageRequest) (*pb.ListCollectionsResponse, error) {
+	p, err := pagination(req.GetLimit(), req.GetPage())
+	if err != nil {
+		return nil, err
+	}
+	found, err := s.collections.List(ctx, p)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error getting collections")
+	}
+	response := &pb.ListCollectionsResponse{Data: make([]*pb.Collection, 0, len(found)), Pagination: toPagination(p)}
+	for _, c := range found {
+		response.Data = append(response.Data, toCollection(c))
+	}
+	return response, nil
+}
+
+func (s *collectionService) GetCollection(ctx context.Context, req *pb.IdRequest) (*pb.Collection, error) {
+	c, err := s.collections.FindOne(ctx, req.GetId())
+	if err != nil {
+		return nil, findError(err, "Collection")
+	}
+	return toCollection(c), nil
+}
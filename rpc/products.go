@@ -0,0 +1,119 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"nojoke/cache"
+	product "nojoke/products"
+	"nojoke/rpc/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type productService struct {
+	pb.UnimplementedProductServiceServer
+	products *product.ProductQuery
+}
+
+func toProduct(p product.Product) *pb.Product {
+	return &pb.Product{
+		Id:           p.Id,
+		Name:         p.Name,
+		Price:        int64(p.Price),
+		Description:  p.Description,
+		Discount:     p.Discount,
+		Rating:       p.Rating,
+		Stock:        int32(p.Stock),
+		Brand:        p.Brand,
+		Category:     int32(p.Category_id),
+		Thumbnail:    p.Thumbnail,
+		Image:        p.Image,
+		CollectionId: p.Collection_id,
+		UpdatedAt:    timestamppb.New(p.UpdatedAt),
+	}
+}
+
+func fromProductInput(input *pb.ProductInput) product.Product {
+	return product.Product{
+		Name:          input.GetName(),
+		Price:         int(input.GetPrice()),
+		Description:   input.GetDescription(),
+		Discount:      input.GetDiscount(),
+		Rating:        input.GetRating(),
+		Stock:         int(input.GetStock()),
+		Brand:         input.GetBrand(),
+		Category_id:   int(input.GetCategory()),
+		Thumbnail:     input.GetThumbnail(),
+		Image:         input.GetImage(),
+		Collection_id: input.GetCollectionId(),
+	}
+}
+
+func (s *productService) ListProducts(ctx context.Context, req *pb.ListProductsRequest) (*pb.ListProductsResponse, error) {
+	p, err := pagination(req.GetLimit(), req.GetPage())
+	if err != nil {
+		return nil, err
+	}
+	products, err := s.products.List(ctx, adminFrom(ctx) == nil, req.GetCollectionId(), p)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error getting products")
+	}
+	response := &pb.ListProductsResponse{Data: make([]*pb.Product, 0, len(products)), Pagination: toPagination(p)}
+	for _, found := range products {
+		response.Data = append(response.Data, toProduct(found))
+	}
+	return response, nil
+}
+
+func (s *productService) GetProduct(ctx context.Context, req *pb.IdRequest) (*pb.Product, error) {
+	p, err := s.products.FindOne(ctx, req.GetId())
+	if err != nil {
+		return nil, findError(err, "Product")
+	}
+	// guests only see the products outside of any collection, like the list
+	if adminFrom(ctx) == nil && p.Collection_id != 0 {
+		return nil, findError(sql.ErrNoRows, "Product")
+	}
+	return toProduct(p), nil
+}
+
+func (s *productService) CreateProduct(ctx context.Context, req *pb.ProductInput) (*pb.Product, error) {
+	p := fromProductInput(req)
+	if err := validate(p); err != nil {
+		return nil, err
+	}
+	p, err := s.products.Create(ctx, p)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error creating product")
+	}
+	cache.Invalidate(ctx, "/api/products")
+	return toProduct(p), nil
+}
+
+func (s *productService) UpdateProduct(ctx context.Context, req *pb.UpdateProductRequest) (*pb.Product, error) {
+	p := fromProductInput(req.GetProduct())
+	if err := validate(p); err != nil {
+		return nil, err
+	}
+	p.Id = req.GetId()
+	p, err := s.products.Update(ctx, p)
+	if err != nil {
+		return nil, findError(err, "Product")
+	}
+	cache.Invalidate(ctx, "/api/products")
+	return toProduct(p), nil
+}
+
+func (s *productService) DeleteProduct(ctx context.Context, req *pb.IdRequest) (*emptypb.Empty, error) {
+	if _, err := s.products.FindOne(ctx, req.GetId()); err != nil {
+		return nil, findError(err, "Product")
+	}
+	if err := s.products.Delete(ctx, req.GetId()); err != nil {
+		return nil, status.Error(codes.Internal, "Error deleting product")
+	}
+	cache.Invalidate(ctx, "/api/products")
+	return &emptypb.Empty{}, nil
+}
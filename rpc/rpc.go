@@ -0,0 +1,182 @@
+package rpc
+
+//go:generate protoc -I proto --go_out=.. --go_opt=module=nojoke --go-grpc_out=.. --go-grpc_opt=module=nojoke nojoke/v1/common.proto nojoke/v1/users.proto nojoke/v1/products.proto nojoke/v1/collections.proto
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net"
+	"nojoke/auth"
+	"nojoke/cache"
+	"nojoke/collections"
+	"nojoke/lib"
+	product "nojoke/products"
+	"nojoke/rpc/pb"
+	user "nojoke/users"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+type adminKeyType struct{}
+
+var adminKey = adminKeyType{}
+
+func adminFrom(ctx context.Context) *auth.Admin {
+	admin, _ := ctx.Value(adminKey).(*auth.Admin)
+	return admin
+}
+
+// service is a registered implementation, kept so the JSON transcoder can
+// call the same handlers as the gRPC server
+type service struct {
+	desc *grpc.ServiceDesc
+	impl interface{}
+}
+
+// Server serves the Users, Products and Collections services on their own
+// port, sharing the data layer with the HTTP handlers
+type Server struct {
+	grpcServer *grpc.Server
+	logger     *lib.Logger
+	cache      *cache.Cache
+	config     lib.GRPCConfig
+	secret     string
+	services   []service
+}
+
+// NewServer registers the services, responseCache may be nil when the HTTP
+// cache is disabled
+func NewServer(database *sql.DB, logger *lib.Logger, config *lib.Config, responseCache *cache.Cache) *Server {
+	s := &Server{
+		logger: logger,
+		cache:  responseCache,
+		config: config.GRPC,
+		secret: config.Auth.JWTSecret,
+	}
+	s.grpcServer = grpc.NewServer(grpc.ChainUnaryInterceptor(s.logRequest, s.authenticate))
+
+	s.register(&pb.UserService_ServiceDesc, &userService{users: user.NewUserQuery(database, logger)})
+	s.register(&pb.ProductService_ServiceDesc, &productService{products: product.NewProductQuery(database, logger)})
+	s.register(&pb.CollectionService_ServiceDesc, &collectionService{collections: collections.NewCollectionQuery(database, logger)})
+	if s.config.Reflection {
+		reflection.Register(s.grpcServer)
+	}
+	return s
+}
+
+func (s *Server) register(desc *grpc.ServiceDesc, impl interface{}) {
+	s.grpcServer.RegisterService(desc, impl)
+	s.services = append(s.services, service{desc: desc, impl: impl})
+}
+
+// Run serves until Shutdown is called
+func (s *Server) Run() error {
+	listener, err := net.Listen("tcp", ":"+s.config.Port)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("gRPC server running", "addr", listener.Addr().String())
+	return s.grpcServer.Serve(listener)
+}
+
+// Shutdown waits for in-flight calls until ctx expires and then closes the
+// remaining connections
+func (s *Server) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		return ctx.Err()
+	}
+}
+
+// authenticate verifies the JWT in the authorization metadata the same way
+// as auth.Verified, calls without a valid token run as a guest
+func (s *Server) authenticate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	if token, found := strings.CutPrefix(authorization, "Bearer "); found {
+		authorization = strings.TrimSpace(token)
+	}
+	ctx = context.WithValue(ctx, adminKey, auth.AdminFromToken(authorization, s.secret))
+	return handler(s.cache.WithStore(ctx), req)
+}
+
+func (s *Server) logRequest(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(lib.RequestIDHeader); len(values) > 0 && len(values[0]) <= 128 {
+			ctx = lib.WithRequestID(ctx, values[0])
+		}
+	}
+	resp, err := handler(ctx, req)
+
+	code := status.Code(err)
+	level := slog.LevelInfo
+	switch code {
+	case codes.OK:
+	case codes.Internal, codes.Unknown, codes.Unavailable, codes.DataLoss:
+		level = slog.LevelError
+	default:
+		level = slog.LevelWarn
+	}
+	s.logger.LogAttrs(ctx, level, "rpc",
+		slog.String("method", info.FullMethod),
+		slog.String("code", code.String()),
+		slog.Duration("latency", time.Since(start)),
+	)
+	return resp, err
+}
+
+// pagination mirrors lib.PaginationParams, zero values use its defaults
+func pagination(limit int32, page int32) (*lib.Pagination, error) {
+	p := &lib.Pagination{Limit: int(limit), Page: int(page)}
+	if p.Limit == 0 {
+		p.Limit = 10
+	}
+	if p.Page == 0 {
+		p.Page = 1
+	}
+	if p.Limit < 1 || p.Page < 1 {
+		return nil, status.Error(codes.InvalidArgument, "Invalid query params")
+	}
+	return p, nil
+}
+
+func toPagination(p *lib.Pagination) *pb.Pagination {
+	return &pb.Pagination{Total: int64(p.Total), Limit: int64(p.Limit), Page: int64(p.Page)}
+}
+
+// validate runs the same gookit rules as the REST handlers
+func validate[T interface{}](form T) error {
+	if isValid, message := lib.ValidateForm(form); !isValid {
+		return status.Error(codes.InvalidArgument, message)
+	}
+	return nil
+}
+
+// findError maps a lookup error to NotFound or Internal with the messages of
+// the REST handlers
+func findError(err error, name string) error {
+	if err == sql.ErrNoRows {
+		return status.Error(codes.NotFound, name+" not found")
+	}
+	return status.Error(codes.Internal, "Error getting "+strings.ToLower(name))
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"context"
+	"nojoke/auth"
+	"nojoke/lib"
+	product "nojoke/products"
+	"nojoke/rpc/pb"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthenticate(t *testing.T) {
+	sign := func(secret string, ttl time.Duration) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &lib.Claims{
+			Username:         "admin",
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl))},
+		}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		admin         bool
+	}{
+		{"no metadata", "", false},
+		{"any value", "letmein", false},
+		{"wrong secret", "Bearer " + sign("other", time.Minute), false},
+		{"expired", "Bearer " + sign("secret", -time.Minute), false},
+		{"valid bearer", "Bearer " + sign("secret", time.Minute), true},
+		{"valid bare token", sign("secret", time.Minute), true},
+	}
+	s := &Server{secret: "secret"}
+	for _, tt := range tests {
+		md := metadata.MD{}
+		if tt.authorization != "" {
+			md.Set("authorization", tt.authorization)
+		}
+		var admin *auth.Admin
+		_, err := s.authenticate(metadata.NewIncomingContext(context.Background(), md), nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+			admin = adminFrom(ctx)
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (admin != nil) != tt.admin {
+			t.Errorf("%s: admin = %v, want %v", tt.name, admin, tt.admin)
+		}
+	}
+}
+
+func TestGetProductHidesCollectionsFromGuests(t *testing.T) {
+	tests := []struct {
+		name         string
+		collectionId int64
+		admin        *auth.Admin
+		code         codes.Code
+	}{
+		{"guest, no collection", 0, nil, codes.OK},
+		{"guest, in a collection", 3, nil, codes.NotFound},
+		{"admin, in a collection", 3, &auth.Admin{Username: "admin"}, codes.OK},
+	}
+	for _, tt := range tests {
+		database, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta(product.GetProductQuery)).WillReturnRows(sqlmock.NewRows([]string{
+			"id", "name", "price", "description", "discount", "rating", "stock", "brand", "category_id", "thumbnail", "image", "collection_id", "updated_at",
+		}).AddRow(7, "Mug", 12, "A mug", 0, 0, 3, "Nojoke", 1, "", "", tt.collectionId, time.Now()))
+		s := &productService{products: product.NewProductQuery(database, lib.NewLogger(nil, lib.LogConfig{Level: "error"}))}
+
+		ctx := context.WithValue(context.Background(), adminKey, tt.admin)
+		if _, err := s.GetProduct(ctx, &pb.IdRequest{Id: 7}); status.Code(err) != tt.code {
+			t.Errorf("%s: err = %v, want %s", tt.name, err, tt.code)
+		}
+		database.Close()
+	}
+}
@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"nojoke/lib"
+	"nojoke/openapi"
+	"reflect"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const maxBodyBytes = 1 << 20
+
+var (
+	unmarshaler = protojson.UnmarshalOptions{}
+	marshaler   = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}
+)
+
+// httpStatus follows the mapping used by grpc-gateway
+var httpStatus = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+func (s *Server) transcode(w http.ResponseWriter, r *http.Request, svc service, method grpc.MethodDesc) {
+	w.Header().Set("Content-Type", "application/json")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return
+	}
+	dec := func(v interface{}) error {
+		// an empty body is the zero request, like {}
+		if len(body) == 0 {
+			return nil
+		}
+		if err := unmarshaler.Unmarshal(body, v.(proto.Message)); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil
+	}
+	md := metadata.MD{}
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		md.Set("authorization", authorization)
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+
+	resp, err := method.Handler(svc.impl, ctx, dec, s.authenticate)
+	if err != nil {
+		st := status.Convert(err)
+		code, ok := httpStatus[st.Code()]
+		if !ok {
+			code = http.StatusInternalServerError
+		}
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(code, st.Message()))
+		return
+	}
+	out, err := marshaler.Marshal(resp.(proto.Message))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, err.Error()))
+		return
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// messageTypes returns zero values of the request and response messages of
+// the named method for the OpenAPI document
+func messageTypes(impl interface{}, name string) (interface{}, interface{}) {
+	m, ok := reflect.TypeOf(impl).MethodByName(name)
+	if !ok || m.Type.NumIn() != 3 || m.Type.NumOut() != 2 {
+		return nil, nil
+	}
+	return reflect.New(m.Type.In(2).Elem()).Interface(), reflect.New(m.Type.Out(0).Elem()).Interface()
+}
+
+// InitTranscodingRouter serves every method of s as POST
+// /rpc/{service}/{method} with the protobuf JSON mapping of its messages, so
+// the services can be called without a gRPC client
+func InitTranscodingRouter(mux *mux.Router, s *Server, logger *lib.Logger, config *lib.Config) {
+	openapi.Scalar(timestamppb.Timestamp{}, "string", "date-time")
+	for _, svc := range s.services {
+		svc := svc
+		for _, method := range svc.desc.Methods {
+			method := method
+			request, response := messageTypes(svc.impl, method.MethodName)
+			openapi.Describe(mux.HandleFunc("/rpc/"+svc.desc.ServiceName+"/"+method.MethodName, func(w http.ResponseWriter, r *http.Request) {
+				s.transcode(w, r, svc, method)
+			}).Methods("POST"), openapi.Operation{
+				Summary:  svc.desc.ServiceName + "." + method.MethodName + " over HTTP/JSON",
+				Tags:     []string{"rpc"},
+				Request:  request,
+				Response: response,
+				Raw:      true,
+				Auth:     true,
+			})
+		}
+	}
+}
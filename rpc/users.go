@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"context"
+	"nojoke/cache"
+	"nojoke/rpc/pb"
+	user "nojoke/users"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type userService struct {
+	pb.UnimplementedUserServiceServer
+	users *user.UserQuery
+}
+
+func toUser(u user.User) *pb.User {
+	return &pb.User{
+		Id:        int64(u.Id),
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Email:     u.Email,
+		Age:       int32(u.Age),
+		Phone:     u.Phone,
+		Image:     u.Image,
+		UpdatedAt: timestamppb.New(u.UpdatedAt),
+	}
+}
+
+func fromUserInput(input *pb.UserInput) user.User {
+	return user.User{
+		FirstName: input.GetFirstName(),
+		LastName:  input.GetLastName(),
+		Email:     input.GetEmail(),
+		Age:       int(input.GetAge()),
+		Phone:     input.GetPhone(),
+		Password:  input.GetPassword(),
+		Image:     input.GetImage(),
+	}
+}
+
+func (s *userService) ListUsers(ctx context.Context, req *pb.PageRequest) (*pb.ListUsersResponse, error) {
+	p, err := pagination(req.GetLimit(), req.GetPage())
+	if err != nil {
+		return nil, err
+	}
+	count, _, err := s.users.LastModified(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error getting users")
+	}
+	p.Total = count
+	users, err := s.users.List(ctx, p)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error getting users")
+	}
+	response := &pb.ListUsersResponse{Data: make([]*pb.User, 0, len(users)), Pagination: toPagination(p)}
+	for _, u := range users {
+		response.Data = append(response.Data, toUser(u))
+	}
+	return response, nil
+}
+
+func (s *userService) GetUser(ctx context.Context, req *pb.IdRequest) (*pb.User, error) {
+	u, err := s.users.FindOne(ctx, int(req.GetId()))
+	if err != nil {
+		return nil, findError(err, "User")
+	}
+	return toUser(u), nil
+}
+
+func (s *userService) CreateUser(ctx context.Context, req *pb.UserInput) (*pb.User, error) {
+	u := fromUserInput(req)
+	if err := validate(u); err != nil {
+		return nil, err
+	}
+	u, err := s.users.Create(ctx, u)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error creating user")
+	}
+	cache.Invalidate(ctx, "/api/users")
+	return toUser(u), nil
+}
+
+func (s *userService) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.User, error) {
+	u := fromUserInput(req.GetUser())
+	if err := validate(u); err != nil {
+		return nil, err
+	}
+	u.Id = int(req.GetId())
+	u, err := s.users.Update(ctx, u)
+	if err != nil {
+		return nil, findError(err, "User")
+	}
+	cache.Invalidate(ctx, "/api/users")
+	return toUser(u), nil
+}
+
+func (s *userService) DeleteUser(ctx context.Context, req *pb.IdRequest) (*emptypb.Empty, error) {
+	if _, err := s.users.FindOne(ctx, int(req.GetId())); err != nil {
+		return nil, findError(err, "User")
+	}
+	if err := s.users.Delete(ctx, int(req.GetId())); err != nil {
+		return nil, status.Error(codes.Internal, "Error deleting user")
+	}
+	cache.Invalidate(ctx, "/api/users")
+	return &emptypb.Empty{}, nil
+}
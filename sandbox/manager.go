@@ -0,0 +1,551 @@
+package sandbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"nojoke/auth"
+	"nojoke/events"
+	"nojoke/lib"
+	"nojoke/ratelimit"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Header picks a sandbox by name, clients sending the same name share it
+	Header = "X-Sandbox-Id"
+	// ResponseHeader tells clients which sandbox answered
+	ResponseHeader = "X-Sandbox"
+	// SeedSchema keeps the data every sandbox starts from
+	SeedSchema = "sandbox_seed"
+)
+
+var (
+	ErrTooMany          = errors.New("sandbox: too many sandboxes")
+	ErrTooManyForClient = errors.New("sandbox: too many sandboxes for this client")
+	// ErrBusy means every connection of the budget serves a request
+	ErrBusy = errors.New("sandbox: connection budget exhausted")
+)
+
+// paths whose data comes from the sandbox of the client, the others, such
+// as the event streams, stay shared
+var prefixes = []string{
+	"/api/users", "/api/products", "/api/collections", "/api/batch", "/api/sandbox",
+	"/graphql", "/rpc/",
+}
+
+type Sandbox struct {
+	Id         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ResetAt    time.Time `json:"reset_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (m *Manager) scanSandbox(row rowScanner) (Sandbox, error) {
+	sandbox := Sandbox{}
+	err := row.Scan(&sandbox.Id, &sandbox.CreatedAt, &sandbox.ResetAt, &sandbox.LastUsedAt)
+	sandbox.ExpiresAt = sandbox.LastUsedAt.Add(m.config.IdleTTL)
+	return sandbox, err
+}
+
+// pool is the connection pool of one sandbox, its search_path puts the
+// sandbox schema in front of public. The first request creates the sandbox
+// and closes ready, the others wait for it. database and err are set, and
+// active and used kept, under Manager.mu.
+type pool struct {
+	database *sql.DB
+	err      error
+	ready    chan struct{}
+	// requests using the pool, a pool in use is never closed
+	active int
+	used   time.Time
+	// when last_used_at was last written
+	touched time.Time
+}
+
+// Manager creates a sandbox the first time a client uses it and drops the
+// sandboxes that were idle for longer than the configured TTL
+type Manager struct {
+	database *sql.DB
+	logger   *lib.Logger
+	config   lib.SandboxConfig
+	auth     lib.AuthConfig
+	url      string
+	// whether the client address comes from X-Forwarded-For
+	trustProxy bool
+	mu         sync.Mutex
+	pools      map[string]*pool
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+func NewManager(database *sql.DB, logger *lib.Logger, config *lib.Config) *Manager {
+	return &Manager{
+		database:   database,
+		logger:     logger,
+		config:     config.Sandbox,
+		auth:       config.Auth,
+		url:        config.Database.URL,
+		trustProxy: config.RateLimit.TrustProxy,
+		pools:      map[string]*pool{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+type idKey struct{}
+
+// FromContext returns the id of the sandbox serving the request, if any
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(idKey{}).(string)
+	return id, ok
+}
+
+func hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// identify names the sandbox of r by X-Sandbox-Id, then X-API-Key, then the
+// signed in admin. The name is hashed so neither keys nor tokens end up in
+// schema names. Anyone can make up a name or a key, so those sandboxes are
+// also counted against the hashed address of the client; the sandboxes of
+// admins are not.
+func (m *Manager) identify(r *http.Request) (id string, client string, ok bool) {
+	identity := ""
+	if name := r.Header.Get(Header); name != "" {
+		identity = "name:" + name
+	} else if key := r.Header.Get(ratelimit.APIKeyHeader); key != "" {
+		identity = "key:" + key
+	} else if token := auth.TokenFromRequest(r); token != "" {
+		if claims, err := auth.ParseToken(token, m.auth.JWTSecret); err == nil {
+			return hash("admin:" + claims.Username), "", true
+		}
+	}
+	if identity == "" {
+		return "", "", false
+	}
+	return hash(identity), hash("ip:" + ratelimit.ClientIP(r, m.trustProxy)), true
+}
+
+func schema(id string) string {
+	return "sandbox_" + id
+}
+
+// withSearchPath adds the search_path run-time parameter to a URL or a
+// key=value connection string
+func withSearchPath(dsn string, path string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		query.Set("search_path", path)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+	return dsn + " search_path='" + path + "'", nil
+}
+
+// clone copies the sandboxed tables of schema from into a new schema to
+func clone(ctx context.Context, tx *sql.Tx, from string, to string) error {
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(CreateSchemaQuery, to)); err != nil {
+		return err
+	}
+	for _, table := range Tables {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(CloneTableQuery, from, to, table)); err != nil {
+			return errors.New(table + ": " + err.Error())
+		}
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(AddForeignKeysQuery, to))
+	return err
+}
+
+// EnsureSeed copies the shared tables into the seed schema unless it exists,
+// so sandboxes start from the mock data rather than from whatever the
+// shared dataset became
+func (m *Manager) EnsureSeed(ctx context.Context) error {
+	tx, err := m.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, LockQuery, SeedSchema); err != nil {
+		return err
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, SchemaExistsQuery, SeedSchema).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if err := clone(ctx, tx, "public", SeedSchema); err != nil {
+		return err
+	}
+	m.logger.Info("Sandbox seed created", "schema", SeedSchema)
+	return tx.Commit()
+}
+
+// create makes the schema of sandbox id from the seed unless it exists,
+// counting it against the sandboxes of client when there is one
+func (m *Manager) create(ctx context.Context, id string, client string) error {
+	tx, err := m.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, LockQuery, schema(id)); err != nil {
+		return err
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, SchemaExistsQuery, schema(id)).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		var count int
+		if client != "" {
+			if _, err := tx.ExecContext(ctx, LockQuery, "client_"+client); err != nil {
+				return err
+			}
+			if err := tx.QueryRowContext(ctx, CountClientSandboxesQuery, client).Scan(&count); err != nil {
+				return err
+			}
+			if count >= m.config.MaxPerClient {
+				return ErrTooManyForClient
+			}
+		}
+		if err := tx.QueryRowContext(ctx, CountSandboxesQuery).Scan(&count); err != nil {
+			return err
+		}
+		if count >= m.config.MaxSandboxes {
+			return ErrTooMany
+		}
+		if err := clone(ctx, tx, SeedSchema, schema(id)); err != nil {
+			return err
+		}
+		m.logger.InfoContext(ctx, "Sandbox created", "sandbox", id)
+	}
+	if _, err := m.scanSandbox(tx.QueryRowContext(ctx, InsertSandboxQuery, id, client)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// connect creates sandbox id unless it exists and opens its pool
+func (m *Manager) connect(ctx context.Context, id string, client string) (*sql.DB, error) {
+	if err := m.create(ctx, id, client); err != nil {
+		return nil, err
+	}
+	dsn, err := withSearchPath(m.url, schema(id)+",public")
+	if err != nil {
+		return nil, err
+	}
+	database := lib.ConnectDB(dsn)
+	database.SetMaxOpenConns(m.config.MaxConnections)
+	database.SetMaxIdleConns(1)
+	database.SetConnMaxIdleTime(time.Minute)
+	return database, nil
+}
+
+// open returns the pool of sandbox id for one request, which hands it back
+// with release. The first request creates the sandbox outside m.mu, so the
+// clone holds up neither the other sandboxes nor the requests waiting for
+// this one. last_used_at is written at most once a minute per sandbox.
+func (m *Manager) open(ctx context.Context, id string, client string) (*pool, error) {
+	m.mu.Lock()
+	p, ok := m.pools[id]
+	if !ok {
+		if err := m.reserve(); err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+		p = &pool{ready: make(chan struct{}), touched: time.Now()}
+		m.pools[id] = p
+	}
+	p.active++
+	p.used = time.Now()
+	touch := ok && time.Since(p.touched) > time.Minute
+	if touch {
+		p.touched = p.used
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		database, err := m.connect(ctx, id, client)
+		m.mu.Lock()
+		p.database, p.err = database, err
+		if err != nil && m.pools[id] == p {
+			delete(m.pools, id)
+		}
+		m.mu.Unlock()
+		close(p.ready)
+	}
+	select {
+	case <-p.ready:
+	case <-ctx.Done():
+		m.release(id, p)
+		return nil, ctx.Err()
+	}
+	if p.err != nil {
+		m.release(id, p)
+		return nil, p.err
+	}
+	if touch {
+		if _, err := m.database.ExecContext(ctx, TouchSandboxQuery, id); err != nil {
+			m.logger.WarnContext(ctx, "Error touching sandbox", "sandbox", id, "error", err)
+		}
+	}
+	return p, nil
+}
+
+// release hands back the pool of sandbox id once a request is done with it
+func (m *Manager) release(id string, p *pool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p.active--
+	// the pool was forgotten while in use
+	if p.active == 0 && m.pools[id] != p && p.database != nil {
+		p.database.Close()
+	}
+}
+
+// reserve makes room for one more pool within the connection budget,
+// closing the least recently used pool no request is using. The caller
+// holds m.mu.
+func (m *Manager) reserve() error {
+	if len(m.pools) < m.config.ConnectionBudget/m.config.MaxConnections {
+		return nil
+	}
+	lru := ""
+	for id, p := range m.pools {
+		if p.active == 0 && (lru == "" || p.used.Before(m.pools[lru].used)) {
+			lru = id
+		}
+	}
+	if lru == "" {
+		return ErrBusy
+	}
+	m.forget(lru)
+	return nil
+}
+
+// forget drops the pool of sandbox id, the last request using it closes
+// it. The caller holds m.mu.
+func (m *Manager) forget(id string) {
+	p, ok := m.pools[id]
+	if !ok {
+		return
+	}
+	delete(m.pools, id)
+	if p.active == 0 && p.database != nil {
+		p.database.Close()
+	}
+}
+
+// Find returns sql.ErrNoRows when sandbox id does not exist
+func (m *Manager) Find(ctx context.Context, id string) (Sandbox, error) {
+	return m.scanSandbox(m.database.QueryRowContext(ctx, GetSandboxQuery, id))
+}
+
+func (m *Manager) List(ctx context.Context, pagination *lib.Pagination) ([]Sandbox, error) {
+	if err := m.database.QueryRowContext(ctx, CountSandboxesQuery).Scan(&pagination.Total); err != nil {
+		return nil, err
+	}
+	rows, err := m.database.QueryContext(ctx, GetSandboxesQuery, pagination.Limit, (pagination.Page-1)*pagination.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sandboxes := []Sandbox{}
+	for rows.Next() {
+		sandbox, err := m.scanSandbox(rows)
+		if err != nil {
+			return nil, err
+		}
+		sandboxes = append(sandboxes, sandbox)
+	}
+	return sandboxes, rows.Err()
+}
+
+// Reset replaces the data of sandbox id with a fresh copy of the seed
+func (m *Manager) Reset(ctx context.Context, id string) (Sandbox, error) {
+	// the next requests open a new pool rather than reuse connections to
+	// the dropped tables
+	m.mu.Lock()
+	m.forget(id)
+	m.mu.Unlock()
+	tx, err := m.database.BeginTx(ctx, nil)
+	if err != nil {
+		return Sandbox{}, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, LockQuery, schema(id)); err != nil {
+		return Sandbox{}, err
+	}
+	sandbox, err := m.scanSandbox(tx.QueryRowContext(ctx, ResetSandboxQuery, id))
+	if err != nil {
+		return sandbox, err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(DropSchemaQuery, schema(id))); err != nil {
+		return sandbox, err
+	}
+	if err := clone(ctx, tx, SeedSchema, schema(id)); err != nil {
+		return sandbox, err
+	}
+	m.logger.InfoContext(ctx, "Sandbox reset", "sandbox", id)
+	return sandbox, tx.Commit()
+}
+
+// Remove drops sandbox id, the next request of its client starts a new one
+func (m *Manager) Remove(ctx context.Context, id string) error {
+	m.mu.Lock()
+	m.forget(id)
+	m.mu.Unlock()
+	tx, err := m.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, LockQuery, schema(id)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(DropSchemaQuery, schema(id))); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, DeleteSandboxQuery, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// expire closes the pools unused for the TTL and removes the sandboxes idle
+// for longer. A sandbox with an open pool is kept, since its last_used_at
+// lags behind by up to a minute.
+func (m *Manager) expire(ctx context.Context) {
+	m.mu.Lock()
+	for id, p := range m.pools {
+		if p.active > 0 || time.Since(p.used) < m.config.IdleTTL {
+			continue
+		}
+		m.forget(id)
+	}
+	m.mu.Unlock()
+
+	rows, err := m.database.QueryContext(ctx, GetIdleSandboxesQuery, m.config.IdleTTL.Seconds())
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Error getting idle sandboxes", "error", err)
+		return
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		m.mu.Lock()
+		_, active := m.pools[id]
+		m.mu.Unlock()
+		if active {
+			continue
+		}
+		if err := m.Remove(ctx, id); err != nil {
+			m.logger.ErrorContext(ctx, "Error removing idle sandbox", "sandbox", id, "error", err)
+			continue
+		}
+		m.logger.InfoContext(ctx, "Idle sandbox removed", "sandbox", id)
+	}
+}
+
+// Run removes idle sandboxes every minute until Shutdown
+func (m *Manager) Run() {
+	defer close(m.done)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.expire(context.Background())
+		}
+	}
+}
+
+func (m *Manager) Shutdown(ctx context.Context) error {
+	close(m.stop)
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id := range m.pools {
+		m.forget(id)
+	}
+	return nil
+}
+
+func sandboxed(path string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware serves the requests of clients with a sandbox from its schema,
+// through lib.DB, and keeps their change events off the shared feeds. The
+// items of a batch already run in the sandbox, and maybe its transaction.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := FromContext(r.Context()); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, client, ok := m.identify(r)
+		if !ok || !sandboxed(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := m.open(r.Context(), id, client)
+		if err != nil {
+			status, message := http.StatusServiceUnavailable, "Sandbox unavailable"
+			switch err {
+			case ErrTooMany:
+				message = "Too many sandboxes, try again once idle ones expired"
+			case ErrTooManyForClient:
+				status, message = http.StatusTooManyRequests, "Too many sandboxes for this address, delete one or wait until idle ones expired"
+			case ErrBusy:
+				message = "Every sandbox is busy, try again shortly"
+			default:
+				m.logger.ErrorContext(r.Context(), "Error opening sandbox", "sandbox", id, "error", err)
+			}
+			lib.Render(w, r, status, lib.NewErrorResponse(status, message))
+			return
+		}
+		defer m.release(id, p)
+		w.Header().Set(ResponseHeader, id)
+		ctx := context.WithValue(r.Context(), idKey{}, id)
+		ctx = events.WithSandbox(lib.WithQueryer(ctx, p.database), id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,169 @@
+package sandbox
+
+import (
+	"context"
+	"net/http/httptest"
+	"nojoke/lib"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestManager(t *testing.T) (*Manager, sqlmock.Sqlmock) {
+	t.Helper()
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	config := lib.DefaultConfig()
+	config.Auth.JWTSecret = "secret"
+	config.Database.URL = "postgres://localhost/nojoke?sslmode=disable"
+	return NewManager(database, lib.NewLogger(nil, lib.LogConfig{Level: "error"}), config), mock
+}
+
+func TestIdentify(t *testing.T) {
+	m, _ := newTestManager(t)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &lib.Claims{
+		Username:         "admin",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		addr    string
+		id      string
+		client  bool
+	}{
+		{"nothing", nil, "10.0.0.1:1234", "", false},
+		{"name", map[string]string{Header: "demo"}, "10.0.0.1:1234", hash("name:demo"), true},
+		{"name before key", map[string]string{Header: "demo", "X-API-Key": "k"}, "10.0.0.1:1234", hash("name:demo"), true},
+		{"key", map[string]string{"X-API-Key": "k"}, "10.0.0.1:1234", hash("key:k"), true},
+		{"admin", map[string]string{"Authorization": "Bearer " + token}, "10.0.0.1:1234", hash("admin:admin"), false},
+		{"unverified token", map[string]string{"Authorization": "Bearer letmein"}, "10.0.0.1:1234", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/users", nil)
+		r.RemoteAddr = tt.addr
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		id, client, ok := m.identify(r)
+		if id != tt.id || ok != (tt.id != "") {
+			t.Errorf("%s: id = %q (%v), want %q", tt.name, id, ok, tt.id)
+		}
+		if tt.client && client != hash("ip:10.0.0.1") || !tt.client && client != "" {
+			t.Errorf("%s: client = %q", tt.name, client)
+		}
+	}
+}
+
+func TestWithSearchPath(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{"postgres://u:p@db/nojoke?sslmode=disable", "postgres://u:p@db/nojoke?search_path=sandbox_1%2Cpublic&sslmode=disable"},
+		{"postgresql://db/nojoke", "postgresql://db/nojoke?search_path=sandbox_1%2Cpublic"},
+		{"host=db dbname=nojoke", "host=db dbname=nojoke search_path='sandbox_1,public'"},
+	}
+	for _, tt := range tests {
+		got, err := withSearchPath(tt.dsn, "sandbox_1,public")
+		if err != nil || got != tt.want {
+			t.Errorf("withSearchPath(%q) = %q, %v, want %q", tt.dsn, got, err, tt.want)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		pools   map[string]*pool
+		err     error
+		evicted string
+	}{
+		{"within the budget", map[string]*pool{"a": {used: now}}, nil, ""},
+		{"closes the least recently used", map[string]*pool{
+			"a": {used: now.Add(-time.Minute)},
+			"b": {used: now.Add(-time.Hour)},
+			"c": {used: now.Add(-2 * time.Hour), active: 1},
+		}, nil, "b"},
+		{"every pool in use", map[string]*pool{"a": {used: now, active: 1}, "b": {used: now, active: 2}, "c": {used: now, active: 1}}, ErrBusy, ""},
+	}
+	for _, tt := range tests {
+		m, _ := newTestManager(t)
+		m.config.MaxConnections = 4
+		m.config.ConnectionBudget = 12
+		m.pools = tt.pools
+		before := len(m.pools)
+		if err := m.reserve(); err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+		if _, ok := m.pools[tt.evicted]; tt.evicted != "" && ok || tt.evicted == "" && len(m.pools) != before {
+			t.Errorf("%s: pools left %v, want %q closed", tt.name, m.pools, tt.evicted)
+		}
+	}
+}
+
+func TestCreateLimitsClients(t *testing.T) {
+	m, mock := newTestManager(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(LockQuery)).WithArgs(schema("1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(SchemaExistsQuery)).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta(LockQuery)).WithArgs("client_c").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(CountClientSandboxesQuery)).WithArgs("c").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(m.config.MaxPerClient))
+	mock.ExpectRollback()
+	if err := m.create(context.Background(), "1", "c"); err != ErrTooManyForClient {
+		t.Errorf("err = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenCreatesOnce(t *testing.T) {
+	m, mock := newTestManager(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(LockQuery)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(SchemaExistsQuery)).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(InsertSandboxQuery)).WithArgs("1", "c").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "reset_at", "last_used_at"}).AddRow("1", time.Now(), time.Now(), time.Now()))
+	mock.ExpectCommit()
+
+	var wg sync.WaitGroup
+	pools := make([]*pool, 8)
+	for i := range pools {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := m.open(context.Background(), "1", "c")
+			if err != nil {
+				t.Error(err)
+			}
+			pools[i] = p
+		}(i)
+	}
+	wg.Wait()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	for _, p := range pools {
+		if p != pools[0] {
+			t.Fatal("requests got different pools")
+		}
+		m.release("1", p)
+	}
+	if p := m.pools["1"]; p == nil || p.active != 0 {
+		t.Errorf("pool = %+v", p)
+	}
+	m.forget("1")
+}
@@ -0,0 +1,111 @@
+package sandbox
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"nojoke/auth"
+	"nojoke/lib"
+	"nojoke/openapi"
+	"nojoke/ratelimit"
+
+	"github.com/gorilla/mux"
+)
+
+func noSandbox(w http.ResponseWriter, r *http.Request) {
+	lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "No sandbox, send "+Header+", "+ratelimit.APIKeyHeader+" or sign in"))
+}
+
+func handleFindOne(w http.ResponseWriter, r *http.Request, m *Manager) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	id, ok := FromContext(r.Context())
+	if !ok {
+		noSandbox(w, r)
+		return
+	}
+	sandbox, err := m.Find(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "Sandbox not found"))
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Error getting sandbox", "sandbox", id, "error", err)
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting sandbox"))
+		return
+	}
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "Success", sandbox))
+}
+
+func handleReset(w http.ResponseWriter, r *http.Request, m *Manager) {
+	w.Header().Set("Content-Type", "application/json")
+	id, ok := FromContext(r.Context())
+	if !ok {
+		noSandbox(w, r)
+		return
+	}
+	sandbox, err := m.Reset(r.Context(), id)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Error resetting sandbox", "sandbox", id, "error", err)
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error resetting sandbox"))
+		return
+	}
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "Sandbox reset", sandbox))
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, m *Manager) {
+	w.Header().Set("Content-Type", "application/json")
+	id, ok := FromContext(r.Context())
+	if !ok {
+		noSandbox(w, r)
+		return
+	}
+	if err := m.Remove(r.Context(), id); err != nil {
+		m.logger.ErrorContext(r.Context(), "Error removing sandbox", "sandbox", id, "error", err)
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error deleting sandbox"))
+		return
+	}
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "Sandbox deleted", nil))
+}
+
+func handleGet(w http.ResponseWriter, r *http.Request, admin *auth.Admin, m *Manager) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		lib.Render(w, r, http.StatusUnauthorized, lib.NewErrorResponse(401, "Unauthorized"))
+		return
+	}
+	limitInt, pageInt, _, err := lib.PaginationParams(r.URL.Query().Get("limit"), r.URL.Query().Get("page"), "")
+	if err != nil || limitInt < 1 || pageInt < 1 {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid query params"))
+		return
+	}
+	pagination := lib.Pagination{Limit: limitInt, Page: pageInt}
+	sandboxes, err := m.List(r.Context(), &pagination)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Error getting sandboxes", "error", err)
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting sandboxes"))
+		return
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	lib.Render(w, r, http.StatusOK, lib.DataResponse{Status: 200, Message: "Success", Data: sandboxes, Pagination: pagination})
+}
+
+// InitSandboxRouter serves the sandbox of the caller under /api/sandbox and
+// the list of every sandbox to admins
+func InitSandboxRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config, m *Manager) {
+	router := mux.PathPrefix("/api/sandbox").Subrouter()
+	router.Use(lib.Negotiate)
+	handle := func(path string, method string, handler func(http.ResponseWriter, *http.Request, *Manager), operation openapi.Operation) {
+		operation.Tags = []string{"sandbox"}
+		openapi.Describe(router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r, m)
+		}).Methods(method), operation)
+	}
+	handle("", "GET", handleFindOne, openapi.Operation{Summary: "Get the sandbox of the caller", Response: Sandbox{}})
+	handle("", "DELETE", handleDelete, openapi.Operation{Summary: "Delete the sandbox of the caller, the next request starts a new one"})
+	handle("/reset", "POST", handleReset, openapi.Operation{Summary: "Restore the seed data in the sandbox of the caller", Response: Sandbox{}})
+
+	openapi.Describe(mux.Handle("/api/admin/sandboxes", lib.Negotiate(auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleGet(w, r, a, m)
+	}))).Methods("GET"), openapi.Operation{Summary: "List the sandboxes, most recently used first", Tags: []string{"sandbox"}, Response: Sandbox{}, List: true, Auth: true})
+}
@@ -0,0 +1,125 @@
+package sandbox
+
+const CreateSandboxTableQuery = `
+	CREATE TABLE IF NOT EXISTS sandboxes (
+		id VARCHAR(32) PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		reset_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+`
+
+// AddSandboxCreatorQuery records the hashed address of the client that
+// created each sandbox, so one client cannot take all of them
+const AddSandboxCreatorQuery = `
+	ALTER TABLE sandboxes ADD COLUMN IF NOT EXISTS created_by VARCHAR(64);
+	CREATE INDEX IF NOT EXISTS sandboxes_created_by ON sandboxes (created_by);
+`
+
+const DropSandboxCreatorQuery = `
+	DROP INDEX IF EXISTS sandboxes_created_by;
+	ALTER TABLE sandboxes DROP COLUMN IF EXISTS created_by;
+`
+
+// the schemas of the sandboxes and of the seed go with the table
+const DropSandboxTableQuery = `
+	DO $$
+	DECLARE
+		name TEXT;
+	BEGIN
+		FOR name IN SELECT schema_name FROM information_schema.schemata WHERE schema_name LIKE 'sandbox\_%' LOOP
+			EXECUTE 'DROP SCHEMA ' || quote_ident(name) || ' CASCADE';
+		END LOOP;
+	END
+	$$;
+	DROP TABLE IF EXISTS sandboxes;
+`
+
+// tables copied into every sandbox, in an order that satisfies the foreign
+// keys; the others, such as admin, stay shared
+var Tables = []string{"collections", "products", "users"}
+
+// CloneTableQuery copies table %[3]s from schema %[1]s into schema %[2]s,
+// with its own id sequence and updated_at trigger. LIKE copies neither the
+// triggers nor the foreign keys, and its default would draw ids from the
+// sequence of the original table.
+const CloneTableQuery = `
+	CREATE TABLE %[2]s.%[3]s (LIKE %[1]s.%[3]s INCLUDING ALL);
+	CREATE SEQUENCE %[2]s.%[3]s_id_seq OWNED BY %[2]s.%[3]s.id;
+	ALTER TABLE %[2]s.%[3]s ALTER COLUMN id SET DEFAULT nextval('%[2]s.%[3]s_id_seq');
+	INSERT INTO %[2]s.%[3]s SELECT * FROM %[1]s.%[3]s;
+	SELECT setval('%[2]s.%[3]s_id_seq', COALESCE((SELECT MAX(id) FROM %[2]s.%[3]s), 0) + 1, false);
+	CREATE TRIGGER %[3]s_set_updated_at BEFORE UPDATE ON %[2]s.%[3]s
+		FOR EACH ROW EXECUTE FUNCTION public.set_updated_at();
+`
+
+// AddForeignKeysQuery restores the foreign keys of schema %[1]s, admin is
+// shared
+const AddForeignKeysQuery = `
+	ALTER TABLE %[1]s.collections ADD FOREIGN KEY (user_id)
+		REFERENCES public.admin(id) ON DELETE CASCADE;
+	ALTER TABLE %[1]s.products ADD FOREIGN KEY (collection_id)
+		REFERENCES %[1]s.collections(id) ON DELETE CASCADE;
+`
+
+const CreateSchemaQuery = `
+	CREATE SCHEMA %s;
+`
+
+const DropSchemaQuery = `
+	DROP SCHEMA IF EXISTS %s CASCADE;
+`
+
+const SchemaExistsQuery = `
+	SELECT EXISTS (SELECT 1 FROM information_schema.schemata WHERE schema_name = $1);
+`
+
+// LockQuery serialises the creation, reset and removal of one schema, and
+// the creations of one client, across server processes until the
+// transaction ends
+const LockQuery = `
+	SELECT pg_advisory_xact_lock(hashtext($1));
+`
+
+const CountSandboxesQuery = `
+	SELECT COUNT(*) FROM sandboxes;
+`
+
+const CountClientSandboxesQuery = `
+	SELECT COUNT(*) FROM sandboxes WHERE created_by = $1;
+`
+
+const InsertSandboxQuery = `
+	INSERT INTO sandboxes (id, created_by) VALUES ($1, NULLIF($2, ''))
+	ON CONFLICT (id) DO UPDATE SET last_used_at = CURRENT_TIMESTAMP
+	RETURNING id, created_at, reset_at, last_used_at;
+`
+
+const GetSandboxQuery = `
+	SELECT id, created_at, reset_at, last_used_at FROM sandboxes WHERE id = $1;
+`
+
+const GetSandboxesQuery = `
+	SELECT id, created_at, reset_at, last_used_at FROM sandboxes
+	ORDER BY last_used_at DESC
+	LIMIT $1 OFFSET $2;
+`
+
+const TouchSandboxQuery = `
+	UPDATE sandboxes SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1;
+`
+
+const ResetSandboxQuery = `
+	UPDATE sandboxes SET reset_at = CURRENT_TIMESTAMP, last_used_at = CURRENT_TIMESTAMP
+	WHERE id = $1
+	RETURNING id, created_at, reset_at, last_used_at;
+`
+
+const DeleteSandboxQuery = `
+	DELETE FROM sandboxes WHERE id = $1;
+`
+
+const GetIdleSandboxesQuery = `
+	SELECT id FROM sandboxes
+	WHERE last_used_at < CURRENT_TIMESTAMP - make_interval(secs => $1);
+`
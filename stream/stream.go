@@ -0,0 +1,241 @@
+package stream
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"nojoke/auth"
+	"nojoke/events"
+	"nojoke/lib"
+	"nojoke/openapi"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// retryMillis tells EventSource how long to wait before reconnecting
+const retryMillis = 3000
+
+// writer sends Server-Sent Events, every event is flushed right away
+type writer struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+}
+
+// start answers with the event stream headers, streams outlive the server
+// WriteTimeout so the write deadline is lifted
+func start(w http.ResponseWriter) (*writer, error) {
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return nil, err
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keep reverse proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	s := &writer{w: w, controller: controller}
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", retryMillis); err != nil {
+		return nil, err
+	}
+	return s, controller.Flush()
+}
+
+// send writes one event, id is left out when empty
+func (s *writer) send(id string, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		fmt.Fprintf(s.w, "id: %s\n", id)
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload)
+	return s.controller.Flush()
+}
+
+// comment keeps idle connections from being closed by proxies
+func (s *writer) comment(text string) error {
+	fmt.Fprintf(s.w, ": %s\n\n", text)
+	return s.controller.Flush()
+}
+
+// adminFromRequest verifies the JWT from signInHandler, EventSource cannot
+// set headers so the token cookie and ?token= are accepted too
+func adminFromRequest(r *http.Request, config *lib.Config) (*auth.Admin, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = auth.TokenFromRequest(r)
+	}
+	if token == "" {
+		return nil, nil
+	}
+	if _, err := auth.ParseToken(token, config.Auth.JWTSecret); err != nil {
+		return nil, err
+	}
+	return &auth.Admin{}, nil
+}
+
+// lastEventID reads the ID EventSource sends when it reconnects, or
+// ?lastEventId= for clients that cannot set headers
+func lastEventID(r *http.Request) (uint64, bool, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("lastEventId")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	return id, true, err
+}
+
+func visible(event events.Event, channel string, admin *auth.Admin) bool {
+	if (event.AdminOnly && admin == nil) || event.Sandbox != "" {
+		return false
+	}
+	for _, c := range event.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func handleChanges(w http.ResponseWriter, r *http.Request, channel string, admin *auth.Admin, config *lib.Config) {
+	lastID, resume, err := lastEventID(r)
+	if err != nil {
+		badRequest(w, "Invalid Last-Event-ID")
+		return
+	}
+	var subscription *events.Subscription
+	var missed []events.Event
+	complete := true
+	if resume {
+		subscription, missed, complete = events.Default.SubscribeSince(lastID, config.Stream.Buffer)
+	} else {
+		subscription = events.Default.Subscribe(config.Stream.Buffer)
+	}
+	defer subscription.Close()
+
+	s, err := start(w)
+	if err != nil {
+		return
+	}
+	if !complete {
+		// the client should reload the resource instead of relying on
+		// the events it missed
+		s.send("", "reset", lib.NewErrorResponse(410, "Events after "+strconv.FormatUint(lastID, 10)+" are no longer available"))
+	}
+	for _, event := range missed {
+		if visible(event, channel, admin) {
+			if err := s.send(strconv.FormatUint(event.ID, 10), event.Type, event); err != nil {
+				return
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(config.Stream.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			err = s.comment("ping")
+		case event, ok := <-subscription.C:
+			if !ok {
+				// dropped for falling behind, EventSource reconnects with
+				// Last-Event-ID and gets the rest from the log
+				return
+			}
+			if visible(event, channel, admin) {
+				err = s.send(strconv.FormatUint(event.ID, 10), event.Type, event)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleResource streams the changes to products or users
+func handleResource(w http.ResponseWriter, r *http.Request, admin *auth.Admin, config *lib.Config) {
+	handleChanges(w, r, mux.Vars(r)["resource"], admin, config)
+}
+
+// handleCollection streams the changes to the products of a collection,
+// which only admins may see
+func handleCollection(w http.ResponseWriter, r *http.Request, admin *auth.Admin, config *lib.Config) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id < 1 {
+		badRequest(w, "Invalid Id")
+		return
+	}
+	if admin == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(401, "Unauthorized"))
+		return
+	}
+	handleChanges(w, r, "collections/"+strconv.FormatInt(id, 10), admin, config)
+}
+
+// authenticated rejects invalid tokens and passes the admin, nil for
+// guests, to handler
+func authenticated(config *lib.Config, handler func(http.ResponseWriter, *http.Request, *auth.Admin)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, err := adminFromRequest(r, config)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(lib.NewErrorResponse(401, "Invalid token"))
+			return
+		}
+		handler(w, r, admin)
+	}
+}
+
+func InitStreamRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config) {
+	router := mux.PathPrefix("/api/stream").Subrouter()
+	ticker := newTicker(database, logger)
+	openapi.Describe(router.HandleFunc("/ticker", authenticated(config, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		ticker.handle(w, r, a)
+	})).Methods("GET"), openapi.Operation{
+		Summary:     "Synthetic stock prices of the first ?limit= products every ?interval=, starting from their price",
+		Tags:        []string{"realtime"},
+		Raw:         true,
+		Auth:        true,
+		ContentType: "text/event-stream",
+	})
+	openapi.Describe(router.HandleFunc("/signups", func(w http.ResponseWriter, r *http.Request) {
+		handleSignups(w, r, config)
+	}).Methods("GET"), openapi.Operation{
+		Summary:     "Made up user signups about every ?interval=",
+		Tags:        []string{"realtime"},
+		Raw:         true,
+		ContentType: "text/event-stream",
+	})
+	openapi.Describe(router.HandleFunc("/collections/{id}", authenticated(config, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleCollection(w, r, a, config)
+	})).Methods("GET"), openapi.Operation{
+		Summary:     "Changes to the products of a collection, resumable with Last-Event-ID",
+		Tags:        []string{"realtime"},
+		Raw:         true,
+		Auth:        true,
+		ContentType: "text/event-stream",
+	})
+	openapi.Describe(router.HandleFunc("/{resource:products|users}", authenticated(config, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleResource(w, r, a, config)
+	})).Methods("GET"), openapi.Operation{
+		Summary:     "Changes to products or users, resumable with Last-Event-ID",
+		Tags:        []string{"realtime"},
+		Raw:         true,
+		Auth:        true,
+		ContentType: "text/event-stream",
+	})
+}
@@ -0,0 +1,143 @@
+package stream
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"nojoke/auth"
+	"nojoke/events"
+	"nojoke/lib"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLastEventID(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header string
+		id     uint64
+		resume bool
+		valid  bool
+	}{
+		{"none", "/", "", 0, false, true},
+		{"header", "/", "42", 42, true, true},
+		{"query", "/?lastEventId=7", "", 7, true, true},
+		{"header before query", "/?lastEventId=7", "42", 42, true, true},
+		{"not a number", "/", "abc", 0, true, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("Last-Event-ID", tt.header)
+		}
+		id, resume, err := lastEventID(r)
+		if (err == nil) != tt.valid || tt.valid && (id != tt.id || resume != tt.resume) {
+			t.Errorf("%s: %d, %v, %v", tt.name, id, resume, err)
+		}
+	}
+}
+
+func TestVisible(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   events.Event
+		admin   *auth.Admin
+		visible bool
+	}{
+		{"same channel", events.Event{Channels: []string{"products", "collections/1"}}, nil, true},
+		{"other channel", events.Event{Channels: []string{"users"}}, nil, false},
+		{"admin only for a guest", events.Event{Channels: []string{"products"}, AdminOnly: true}, nil, false},
+		{"admin only for an admin", events.Event{Channels: []string{"products"}, AdminOnly: true}, &auth.Admin{}, true},
+		{"sandbox", events.Event{Channels: []string{"products"}, Sandbox: "1"}, &auth.Admin{}, false},
+	}
+	for _, tt := range tests {
+		if got := visible(tt.event, "products", tt.admin); got != tt.visible {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.visible)
+		}
+	}
+}
+
+func TestRejectedStreams(t *testing.T) {
+	config := lib.DefaultConfig()
+	config.Auth.JWTSecret = "secret"
+	router := mux.NewRouter()
+	InitStreamRouter(router, nil, lib.NewLogger(nil, lib.LogConfig{Level: "error"}), config)
+	tests := []struct {
+		name   string
+		target string
+		header string
+		status int
+	}{
+		{"invalid token", "/api/stream/products?token=letmein", "", http.StatusUnauthorized},
+		{"guest on a collection", "/api/stream/collections/1", "", http.StatusUnauthorized},
+		{"invalid Last-Event-ID", "/api/stream/products", "abc", http.StatusBadRequest},
+		{"interval out of range", "/api/stream/signups?interval=1ns", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("Last-Event-ID", tt.header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	config := lib.DefaultConfig()
+	router := mux.NewRouter()
+	InitStreamRouter(router, nil, lib.NewLogger(nil, lib.LogConfig{Level: "error"}), config)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	missed := events.Default.Publish(events.Event{Type: "product.created", Channels: []string{"products"}})
+	events.Default.Publish(events.Event{Type: "user.created", Channels: []string{"users"}})
+	events.Default.Publish(events.Event{Type: "product.updated", Channels: []string{"products"}, AdminOnly: true})
+
+	request, _ := http.NewRequest("GET", server.URL+"/api/stream/products", nil)
+	request.Header.Set("Last-Event-ID", strconv.FormatUint(missed.ID-1, 10))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Content-Type %q", response.Header.Get("Content-Type"))
+	}
+
+	// the first id is the logged event, the second one published live
+	ids := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if id, found := strings.CutPrefix(scanner.Text(), "id: "); found {
+				ids <- id
+			}
+		}
+		close(ids)
+	}()
+	next := func() string {
+		select {
+		case id := <-ids:
+			return id
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+			return ""
+		}
+	}
+	if id := next(); id != strconv.FormatUint(missed.ID, 10) {
+		t.Errorf("resumed with %s, want %d", id, missed.ID)
+	}
+	live := events.Default.Publish(events.Event{Type: "product.deleted", Channels: []string{"products"}})
+	if id := next(); id != strconv.FormatUint(live.ID, 10) {
+		t.Errorf("live event %s, want %d", id, live.ID)
+	}
+}
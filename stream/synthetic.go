@@ -0,0 +1,152 @@
+package stream
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"nojoke/auth"
+	"nojoke/lib"
+	product "nojoke/products"
+	user "nojoke/users"
+	"strconv"
+	"time"
+)
+
+const (
+	minInterval = 100 * time.Millisecond
+	maxInterval = time.Minute
+	maxSymbols  = 50
+	// standard deviation of a price move per tick
+	volatility = 0.01
+)
+
+// Quote is one price move of the ticker
+type Quote struct {
+	ProductId     int64     `json:"product_id"`
+	Name          string    `json:"name"`
+	Price         int       `json:"price"`
+	PreviousPrice int       `json:"previous_price"`
+	Change        int       `json:"change"`
+	ChangePercent float64   `json:"change_percent"`
+	Time          time.Time `json:"time"`
+}
+
+func badRequest(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(lib.NewErrorResponse(400, message))
+}
+
+// interval reads ?interval= such as 500ms, fallback when it is absent
+func interval(r *http.Request, fallback time.Duration) (time.Duration, bool) {
+	value := r.URL.Query().Get("interval")
+	if value == "" {
+		return fallback, true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < minInterval || d > maxInterval {
+		return 0, false
+	}
+	return d, true
+}
+
+type ticker struct {
+	products *product.ProductQuery
+}
+
+func newTicker(database *sql.DB, logger *lib.Logger) *ticker {
+	return &ticker{products: product.NewProductQuery(database, logger)}
+}
+
+// handle moves the prices of the first products on every tick with a
+// random walk, nothing is written to the database
+func (t *ticker) handle(w http.ResponseWriter, r *http.Request, admin *auth.Admin) {
+	every, ok := interval(r, time.Second)
+	if !ok {
+		badRequest(w, "interval must be a duration between 100ms and 1m")
+		return
+	}
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSymbols {
+			badRequest(w, "limit must be between 1 and "+strconv.Itoa(maxSymbols))
+			return
+		}
+		limit = n
+	}
+	products, err := t.products.List(r.Context(), admin == nil, 0, &lib.Pagination{Limit: limit, Page: 1})
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error getting products"))
+		return
+	}
+
+	s, err := start(w)
+	if err != nil {
+		return
+	}
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case now := <-tick.C:
+			for i := range products {
+				p := &products[i]
+				previous := p.Price
+				p.Price = int(math.Max(1, math.Round(float64(p.Price)*(1+volatility*rand.NormFloat64()))))
+				quote := Quote{
+					ProductId:     p.Id,
+					Name:          p.Name,
+					Price:         p.Price,
+					PreviousPrice: previous,
+					Change:        p.Price - previous,
+					ChangePercent: math.Round(float64(p.Price-previous)/float64(previous)*10000) / 100,
+					Time:          now.UTC(),
+				}
+				if err := s.send("", "price", quote); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleSignups makes up a user about every interval with the mock data
+// generator, nothing is written to the database
+func handleSignups(w http.ResponseWriter, r *http.Request, config *lib.Config) {
+	every, ok := interval(r, 2*time.Second)
+	if !ok {
+		badRequest(w, "interval must be a duration between 100ms and 1m")
+		return
+	}
+	s, err := start(w)
+	if err != nil {
+		return
+	}
+	nextId := config.Mock.Users
+	// jitter between half and one and a half intervals looks less robotic
+	timer := time.NewTimer(every)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case now := <-timer.C:
+			nextId++
+			u := user.GenerateUsers(1)[0]
+			u.Id = nextId
+			u.Password = ""
+			u.UpdatedAt = now.UTC()
+			if err := s.send("", "signup", u); err != nil {
+				return
+			}
+			timer.Reset(every/2 + time.Duration(rand.Int63n(int64(every))))
+		}
+	}
+}
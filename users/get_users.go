@@ -0,0 +1,192 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"nojoke/events"
+	"nojoke/lib"
+	"time"
+)
+
+type UserQuery struct {
+	database *sql.DB
+	logger   *lib.Logger
+}
+
+func NewUserQuery(database *sql.DB, logger *lib.Logger) *UserQuery {
+	return &UserQuery{database: database, logger: logger}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	user := User{}
+	err := row.Scan(
+		&user.Id,
+		&user.FirstName,
+		&user.LastName,
+		&user.Phone,
+		&user.Email,
+		&user.Age,
+		&user.Image,
+		&user.Password,
+		&user.UpdatedAt,
+	)
+	return user, err
+}
+
+// LastModified returns the number of users and the latest updated_at
+func (q *UserQuery) LastModified(ctx context.Context) (int, time.Time, error) {
+	var count int
+	var lastModified time.Time
+	err := lib.DB(ctx, q.database).QueryRowContext(ctx, GetUsersLastModifiedQuery).Scan(&count, &lastModified)
+	return count, lastModified, err
+}
+
+func (q *UserQuery) List(ctx context.Context, pagination *lib.Pagination) ([]User, error) {
+	q.logger.DebugContext(ctx, "Getting users", "limit", pagination.Limit, "page", pagination.Page)
+	offset := (pagination.Page - 1) * pagination.Limit
+	rows, err := lib.DB(ctx, q.database).QueryContext(ctx, GetUsersQuery, pagination.Limit, offset)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error getting users", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	userList := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		userList = append(userList, user)
+	}
+	return userList, rows.Err()
+}
+
+// FindOne returns sql.ErrNoRows when the user does not exist
+func (q *UserQuery) FindOne(ctx context.Context, id int) (User, error) {
+	return scanUser(lib.DB(ctx, q.database).QueryRowContext(ctx, GetUserQuery, id))
+}
+
+// ChangeEvent describes a change of user on the users channel, without the
+// password
+func ChangeEvent(typ string, user User) events.Event {
+	user.Password = ""
+	return events.Event{Type: typ, Data: user, Channels: []string{"users"}}
+}
+
+func insertUser(ctx context.Context, db lib.Queryer, user User) (User, error) {
+	return scanUser(db.QueryRowContext(ctx, InsertUserQuery,
+		user.FirstName, user.LastName, user.Phone, user.Email,
+		user.Age, user.Image, user.Password,
+	))
+}
+
+// Create inserts user and returns the stored record
+func (q *UserQuery) Create(ctx context.Context, user User) (User, error) {
+	user, err := insertUser(ctx, lib.DB(ctx, q.database), user)
+	if err == nil {
+		events.Default.PublishContext(ctx, ChangeEvent("user.created", user))
+	}
+	return user, err
+}
+
+// Import inserts users one by one, or in a single transaction that stops at
+// the first failure when atomic. It returns the number of stored users and
+// the errors by index into users.
+func (q *UserQuery) Import(ctx context.Context, users []User, atomic bool) (int, map[int]error) {
+	failures := map[int]error{}
+	if !atomic {
+		imported := 0
+		for i, user := range users {
+			// the client left, the rows after i are not stored
+			if err := ctx.Err(); err != nil {
+				failures[i] = err
+				break
+			}
+			if _, err := q.Create(ctx, user); err != nil {
+				failures[i] = err
+				continue
+			}
+			imported++
+		}
+		return imported, failures
+	}
+	tx, err := lib.BeginTx(ctx, q.database)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error creating transaction", "error", err)
+		failures[0] = err
+		return 0, failures
+	}
+	created := make([]User, 0, len(users))
+	for i, user := range users {
+		if err := ctx.Err(); err != nil {
+			tx.Rollback()
+			failures[i] = err
+			return 0, failures
+		}
+		user, err := insertUser(ctx, tx, user)
+		if err != nil {
+			tx.Rollback()
+			failures[i] = err
+			return 0, failures
+		}
+		created = append(created, user)
+	}
+	if err := tx.Commit(); err != nil {
+		q.logger.ErrorContext(ctx, "Error importing users", "error", err)
+		failures[0] = err
+		return 0, failures
+	}
+	for _, user := range created {
+		events.Default.PublishContext(ctx, ChangeEvent("user.created", user))
+	}
+	return len(created), failures
+}
+
+// Export calls each for every user in id order while reading them from the
+// database
+func (q *UserQuery) Export(ctx context.Context, each func(User) error) error {
+	rows, err := lib.DB(ctx, q.database).QueryContext(ctx, ExportUsersQuery)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error exporting users", "error", err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		if err := each(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Update returns the stored record, or sql.ErrNoRows when the user does not
+// exist
+func (q *UserQuery) Update(ctx context.Context, user User) (User, error) {
+	user, err := scanUser(lib.DB(ctx, q.database).QueryRowContext(ctx, UpdateUserQuery,
+		user.Id, user.FirstName, user.LastName, user.Phone, user.Email,
+		user.Age, user.Image, user.Password,
+	))
+	if err == nil {
+		events.Default.PublishContext(ctx, ChangeEvent("user.updated", user))
+	}
+	return user, err
+}
+
+func (q *UserQuery) Delete(ctx context.Context, id int) error {
+	result, err := lib.DB(ctx, q.database).ExecContext(ctx, DeleteUserQuery, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		events.Default.PublishContext(ctx, ChangeEvent("user.deleted", User{Id: id}))
+	}
+	return nil
+}
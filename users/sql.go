@@ -12,3 +12,68 @@ const CreateUserTableQuery = `
 		password VARCHAR(255) NOT NULL
 	);
 `
+
+const CountUsersQuery = `
+	SELECT COUNT(*) FROM users;
+`
+
+const DropUserTableQuery = `
+	DROP TABLE IF EXISTS users;
+`
+
+const AddUserUpdatedAtQuery = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+	CREATE TRIGGER users_set_updated_at BEFORE UPDATE ON users
+		FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+`
+
+const DropUserUpdatedAtQuery = `
+	DROP TRIGGER IF EXISTS users_set_updated_at ON users;
+	ALTER TABLE users DROP COLUMN IF EXISTS updated_at;
+`
+
+const GetUsersQuery = `
+	SELECT id, first_name, last_name, phone, email,
+	COALESCE(age, 0), COALESCE(image, ''), password, updated_at
+	FROM users
+	ORDER BY id
+	LIMIT $1 OFFSET $2;
+`
+
+const GetUserQuery = `
+	SELECT id, first_name, last_name, phone, email,
+	COALESCE(age, 0), COALESCE(image, ''), password, updated_at
+	FROM users
+	WHERE id = $1;
+`
+
+const GetUsersLastModifiedQuery = `
+	SELECT COUNT(*), COALESCE(MAX(updated_at), 'epoch') FROM users;
+`
+
+const InsertUserQuery = `
+	INSERT INTO users (first_name, last_name, phone, email, age, image, password)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id, first_name, last_name, phone, email,
+	COALESCE(age, 0), COALESCE(image, ''), password, updated_at;
+`
+
+const UpdateUserQuery = `
+	UPDATE users
+	SET first_name = $2, last_name = $3, phone = $4, email = $5,
+	age = $6, image = $7, password = $8
+	WHERE id = $1
+	RETURNING id, first_name, last_name, phone, email,
+	COALESCE(age, 0), COALESCE(image, ''), password, updated_at;
+`
+
+const DeleteUserQuery = `
+	DELETE FROM users WHERE id = $1;
+`
+
+const ExportUsersQuery = `
+	SELECT id, first_name, last_name, phone, email,
+	COALESCE(age, 0), COALESCE(image, ''), password, updated_at
+	FROM users
+	ORDER BY id;
+`
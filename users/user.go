@@ -4,11 +4,13 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
 	"math/rand"
 	"net/http"
+	"nojoke/auth"
 	"nojoke/lib"
+	"nojoke/openapi"
 	"strconv"
+	"time"
 
 	faker "github.com/bxcodec/faker/v3"
 	"github.com/gookit/validate"
@@ -16,15 +18,16 @@ import (
 )
 
 type User struct {
-	Id         int    `json:"id"`
-	FirstName  string `json:"first_name" validate:"required|minLen:3|maxLen:20"`
-	LastName   string `json:"last_name" validate:"required|minLen:3|maxLen:20"`
-	MiddleName string `json:"middle_name"`
-	Email      string `json:"email" validate:"required|email"`
-	Age        int    `json:"age" validate:"min:18|max:60"`
-	Phone      string `json:"phone"`
-	Password   string `json:"password" validate:"minLen:8"`
-	Image      string `json:"image"`
+	Id         int       `json:"id"`
+	FirstName  string    `json:"first_name" validate:"required|minLen:3|maxLen:20"`
+	LastName   string    `json:"last_name" validate:"required|minLen:3|maxLen:20"`
+	MiddleName string    `json:"middle_name"`
+	Email      string    `json:"email" validate:"required|email"`
+	Age        int       `json:"age" validate:"min:18|max:60"`
+	Phone      string    `json:"phone"`
+	Password   string    `json:"password" validate:"minLen:8"`
+	Image      string    `json:"image"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 func (user *User) String() string {
@@ -58,158 +61,289 @@ func validateUserForm(userForm User) (bool, string) {
 	return true, ""
 }
 
-func handleGet(w http.ResponseWriter, r *http.Request) {
+func parseId(r *http.Request) (int, error) {
+	return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+func handleGet(w http.ResponseWriter, r *http.Request, uq *UserQuery) {
 
 	limit := r.URL.Query().Get("limit")
 	page := r.URL.Query().Get("page")
-	total := r.URL.Query().Get("total")
-
-	limitInt, pageInt, totalInt, error := lib.PaginationParams(limit, page, total)
 
 	w.Header().Set("Content-Type", "application/json")
 
-	if error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid query params"))
+	count, lastModified, err := uq.LastModified(r.Context())
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting users"))
 		return
 	}
 
-	userList := GenerateUsers(totalInt)
-	users := lib.PaginateData(userList, limitInt, pageInt, totalInt)
+	limitInt, pageInt, totalInt, error := lib.PaginationParams(limit, page, strconv.Itoa(count))
+	if error != nil || limitInt < 1 || pageInt < 1 {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid query params"))
+		return
+	}
+	pagination := lib.Pagination{
+		Total: totalInt,
+		Limit: limitInt,
+		Page:  pageInt,
+	}
+
+	users, err := uq.List(r.Context(), &pagination)
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting users"))
+		return
+	}
 
 	response := lib.DataResponse{
-		Status:  200,
-		Message: "OK",
-		Data:    users,
-		Pagination: lib.Pagination{
-			Total: totalInt,
-			Limit: limitInt,
-			Page:  pageInt,
-		},
+		Status:     200,
+		Message:    "OK",
+		Data:       users,
+		Pagination: pagination,
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlList)
+	if lib.NotModified(w, r, lib.WeakETag(response), lastModified) {
+		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	lib.Render(w, r, http.StatusOK, response)
 }
 
-func handlePut(w http.ResponseWriter, r *http.Request) {
+func handlePut(w http.ResponseWriter, r *http.Request, uq *UserQuery) {
 	w.Header().Add("Content-Type", "application/json")
-	pathParams := mux.Vars(r)
-	id := pathParams["id"]
+	intId, err := parseId(r)
+	if err != nil {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid Id"))
+		return
+	}
 	data := User{}
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err = lib.DecodeBody(r, &data)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, err.Error()))
 		return
 	}
 
 	isValid, message := lib.ValidateForm(data)
 	if !isValid {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, message))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, message))
 		return
 	}
-	userList := GenerateUsers(100)
-	found := false
-	for i, user := range userList {
-		if user.Id == data.Id || fmt.Sprint(user.Id) == id {
-			userList[i] = data
-			found = true
-			break
-		}
+	current, err := uq.FindOne(r.Context(), intId)
+	if err == sql.ErrNoRows {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "User not found"))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting user"))
+		return
+	}
+	if lib.PreconditionFailed(w, r, lib.ETag(current), current.UpdatedAt) {
+		return
 	}
-	if !found || data.Id == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "User not found"))
+	data.Id = intId
+	data, err = uq.Update(r.Context(), data)
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error updating user"))
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(
-		lib.NewDataResponse(200, "OK", data),
-	)
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	lib.SetValidators(w, r, lib.ETag(data), data.UpdatedAt)
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "OK", data))
 }
 
-func handlePost(w http.ResponseWriter, r *http.Request) {
+func handlePost(w http.ResponseWriter, r *http.Request, uq *UserQuery) {
 	w.Header().Add("Content-Type", "application/json")
 	data := User{}
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err := lib.DecodeBody(r, &data)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, err.Error()))
 		return
 	}
 	isValid, message := validateUserForm(data)
 	if !isValid {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, message))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, message))
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(
-		lib.NewDataResponse(201, "OK", data),
-	)
+	data, err = uq.Create(r.Context(), data)
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error creating user"))
+		return
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	lib.SetValidators(w, r, lib.ETag(data), data.UpdatedAt)
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(201, "OK", data))
 }
 
-func handleDelete(w http.ResponseWriter, r *http.Request) {
+func handlePatch(w http.ResponseWriter, r *http.Request, uq *UserQuery) {
+	w.Header().Add("Content-Type", "application/json")
+	intId, err := parseId(r)
+	if err != nil {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid Id"))
+		return
+	}
+	current, err := uq.FindOne(r.Context(), intId)
+	if err == sql.ErrNoRows {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "User not found"))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting user"))
+		return
+	}
+	if lib.PreconditionFailed(w, r, lib.ETag(current), current.UpdatedAt) {
+		return
+	}
+	data, err := lib.Patch(r, current)
+	if patchErr, ok := err.(*lib.PatchError); ok {
+		lib.Render(w, r, patchErr.Status, lib.NewErrorResponse(patchErr.Status, patchErr.Message))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error patching user"))
+		return
+	}
+	// only the patched document is validated, like a PUT of the whole user
+	isValid, message := validateUserForm(data)
+	if !isValid {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, message))
+		return
+	}
+	data.Id = intId
+	data, err = uq.Update(r.Context(), data)
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error updating user"))
+		return
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	lib.SetValidators(w, r, lib.ETag(data), data.UpdatedAt)
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "OK", data))
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, uq *UserQuery) {
 
 	w.Header().Add("Content-Type", "application/json")
-	pathParams := mux.Vars(r)
-	id := pathParams["id"]
-	intId, err := strconv.Atoi(id)
+	intId, err := parseId(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid Id"))
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid Id"))
 		return
 	}
 
-	if intId == 0 || intId > 100 {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "User not found"))
+	current, err := uq.FindOne(r.Context(), intId)
+	if err == sql.ErrNoRows {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "User not found"))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting user"))
+		return
+	}
+	if lib.PreconditionFailed(w, r, lib.ETag(current), current.UpdatedAt) {
+		return
+	}
+	err = uq.Delete(r.Context(), intId)
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error deleting user"))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(
-		lib.NewDataResponse(200, "DELETED", nil),
-	)
+	w.Header().Set("Cache-Control", lib.CacheControlNoStore)
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "DELETED", nil))
 }
 
-func handleFindOne(w http.ResponseWriter, r *http.Request) {
+func handleFindOne(w http.ResponseWriter, r *http.Request, uq *UserQuery) {
 	w.Header().Add("Content-Type", "application/json")
-	pathParams := mux.Vars(r)
-	id := pathParams["id"]
-	intId, err := strconv.Atoi(id)
+	intId, err := parseId(r)
 	if err != nil {
+		lib.Render(w, r, http.StatusBadRequest, lib.NewErrorResponse(400, "Invalid Id"))
+		return
+	}
+	user, err := uq.FindOne(r.Context(), intId)
+	if err == sql.ErrNoRows {
+		lib.Render(w, r, http.StatusNotFound, lib.NewErrorResponse(404, "User not found"))
+		return
+	}
+	if err != nil {
+		lib.Render(w, r, http.StatusInternalServerError, lib.NewErrorResponse(500, "Error getting user"))
+		return
+	}
+	w.Header().Set("Cache-Control", lib.CacheControlResource)
+	if lib.NotModified(w, r, lib.ETag(user), user.UpdatedAt) {
+		return
+	}
+	lib.Render(w, r, http.StatusOK, lib.NewDataResponse(200, "OK", user))
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	lib.Render(w, r, http.StatusUnauthorized, lib.NewErrorResponse(401, "Unauthorized"))
+}
+
+func handleImport(w http.ResponseWriter, r *http.Request, admin *auth.Admin, uq *UserQuery, config *lib.Config) {
+	if admin == nil {
+		unauthorized(w, r)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	lib.Import(w, r, config.Import, validateUserForm, uq.Import)
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request, admin *auth.Admin, uq *UserQuery) {
+	if admin == nil {
+		unauthorized(w, r)
+		return
+	}
+	format, err := lib.ExportFormat(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid Id"))
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return
 	}
-	if intId == 0 || intId > 100 {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "User not found"))
+	// the download starts with the first row, so a failing query can still
+	// be answered with an error
+	var exporter *lib.Exporter
+	start := func() error {
+		exporter, err = lib.NewExporter(w, format, "users", User{})
+		return err
+	}
+	err = uq.Export(r.Context(), func(user User) error {
+		if exporter == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return exporter.Write(user)
+	})
+	if err != nil && exporter == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error exporting users"))
+		return
+	}
+	if err != nil {
+		// the status is sent, the client sees a truncated file
+		uq.logger.ErrorContext(r.Context(), "Error exporting users", "error", err)
+		return
+	}
+	if exporter == nil && start() != nil {
 		return
 	}
-	userList := GenerateUsers(2)
-	user := userList[0]
-	user.Id = intId
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", user))
+	exporter.Close()
 }
 
-func insertMockData(database *sql.DB, logger *lib.Logger) {
-	countQuery := `SELECT COUNT(*) FROM users;`
+func insertMockData(database *sql.DB, logger *lib.Logger, config *lib.Config) {
+	countQuery := CountUsersQuery
 	var count int
 	tx, err := database.Begin()
 	if err != nil {
-		logger.Error("Error creating transaction" + err.Error())
+		logger.Error("Error creating transaction", "error", err)
 		return
 	}
 	tx.QueryRow(countQuery).Scan(&count)
-	if count > 99 {
+	if count >= config.Mock.Users {
 		logger.Info("User data already inserted Skipping")
 		tx.Rollback()
 		return
 	}
-	userList := GenerateUsers(100)
+	userList := GenerateUsers(config.Mock.Users - count)
 	vals := []interface{}{}
 	sqlStr := `INSERT INTO users (first_name, last_name, phone, email, age, image, password) VALUES `
 	for idx, user := range userList {
@@ -220,35 +354,49 @@ func insertMockData(database *sql.DB, logger *lib.Logger) {
 	sqlStr += ";"
 	stmt, err := tx.Prepare(sqlStr)
 	if err != nil {
-		logger.Error("Error preparing statement" + err.Error())
+		logger.Error("Error preparing statement", "error", err)
 		return
 	}
-	res, err := stmt.Exec(vals...)
+	_, err = stmt.Exec(vals...)
 	if err != nil {
+		logger.Error("Error inserting mock users", "error", err)
 		tx.Rollback()
+		return
 	}
-	fmt.Println(res.LastInsertId())
 	tx.Commit()
 	logger.Info("Data inserted successfully for User")
 }
 
-func initializeDatabase(database *sql.DB, logger *lib.Logger) {
-	q := CreateUserTableQuery
-	_, err := database.Exec(q)
-	if err != nil {
-		logger.Info("Error creating table" + err.Error())
-		log.Fatal(err)
-	}
-	logger.Info("Table created successfully for User")
-}
-
-func InitUserRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger) {
+func InitUserRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config) {
+	insertMockData(database, logger, config)
+	lib.RegisterRecordCount(database, "users", CountUsersQuery)
+	uq := NewUserQuery(database, logger)
+	// the export picks CSV or NDJSON itself, see lib.ExportFormat, so it is
+	// matched before the negotiated routes
+	openapi.Describe(mux.Handle("/api/users/export", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleExport(w, r, a, uq)
+	})).Methods("GET"), openapi.Operation{Summary: "Download every user as CSV or NDJSON", Raw: true, ContentType: "text/csv", Auth: true})
 	router := mux.PathPrefix("/api/users").Subrouter()
-	initializeDatabase(database, logger)
-	insertMockData(database, logger)
-	router.HandleFunc("", handleGet).Methods("GET")
-	router.HandleFunc("", handlePost).Methods("POST")
-	router.HandleFunc("/{id}", handleFindOne).Methods("GET")
-	router.HandleFunc("/{id}", handlePut).Methods("PUT")
-	router.HandleFunc("/{id}", handleDelete).Methods("DELETE")
+	router.Use(lib.Negotiate)
+	openapi.Describe(router.HandleFunc("", func(w http.ResponseWriter, r *http.Request) {
+		handleGet(w, r, uq)
+	}).Methods("GET"), openapi.Operation{Summary: "List users", Response: User{}, List: true})
+	openapi.Describe(router.HandleFunc("", func(w http.ResponseWriter, r *http.Request) {
+		handlePost(w, r, uq)
+	}).Methods("POST"), openapi.Operation{Summary: "Create a user", Request: User{}, Response: User{}})
+	openapi.Describe(router.Handle("/import", auth.Verified(config.Auth.JWTSecret, func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleImport(w, r, a, uq, config)
+	})).Methods("POST"), openapi.Operation{Summary: "Import users from a CSV, JSON array or NDJSON body", Request: []User{}, Response: lib.ImportResult{}, Auth: true})
+	openapi.Describe(router.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleFindOne(w, r, uq)
+	}).Methods("GET"), openapi.Operation{Summary: "Get a user", Response: User{}})
+	openapi.Describe(router.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlePut(w, r, uq)
+	}).Methods("PUT"), openapi.Operation{Summary: "Replace a user", Request: User{}, Response: User{}})
+	openapi.Describe(router.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlePatch(w, r, uq)
+	}).Methods("PATCH"), openapi.Operation{Summary: "Update a user with a JSON Merge Patch or a JSON Patch", Request: User{}, Response: User{}})
+	openapi.Describe(router.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleDelete(w, r, uq)
+	}).Methods("DELETE"), openapi.Operation{Summary: "Delete a user"})
 }
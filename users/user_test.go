@@ -0,0 +1,48 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"nojoke/lib"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestImportAndExportNeedAnAdmin(t *testing.T) {
+	handlers := map[string]func(http.ResponseWriter, *http.Request){
+		"IMPORT": func(w http.ResponseWriter, r *http.Request) { handleImport(w, r, nil, nil, nil) },
+		"EXPORT": func(w http.ResponseWriter, r *http.Request) { handleExport(w, r, nil, nil) },
+	}
+	for name, handler := range handlers {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/api/users/import", strings.NewReader(`{}`)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want 401", name, w.Code)
+		}
+	}
+}
+
+func TestImportStopsWhenTheClientLeaves(t *testing.T) {
+	for _, atomic := range []bool{true, false} {
+		database, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		uq := NewUserQuery(database, lib.NewLogger(nil, lib.LogConfig{Level: "error"}))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		imported, failures := uq.Import(ctx, []User{{FirstName: "A"}, {FirstName: "B"}}, atomic)
+		if imported != 0 || len(failures) != 1 || !errors.Is(failures[0], context.Canceled) {
+			t.Errorf("atomic %v: imported %d, failures %v", atomic, imported, failures)
+		}
+		// nothing reached the database
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("atomic %v: %v", atomic, err)
+		}
+		database.Close()
+	}
+}
@@ -0,0 +1,412 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"nojoke/events"
+	"nojoke/lib"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Nojoke-Signature"
+	EventHeader     = "X-Nojoke-Event"
+	DeliveryHeader  = "X-Nojoke-Delivery"
+	userAgent       = "nojoke-webhooks/1"
+	// events queued for the fan-out before it resubscribes from the log
+	eventBuffer = 256
+	// the start of the response kept with every attempt
+	maxResponseBytes = 1024
+)
+
+// Payload is the JSON body of every delivery
+type Payload struct {
+	Id        uint64      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Sign returns the X-Nojoke-Signature value for body sent at timestamp, an
+// HMAC-SHA256 of "{unix timestamp}.{body}" keyed with the webhook secret
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + signature(secret, t, body)
+}
+
+func signature(secret string, t string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a X-Nojoke-Signature header the way receivers should,
+// rejecting signatures older than tolerance to prevent replays
+func Verify(secret string, header string, body []byte, tolerance time.Duration) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			v1 = value
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return errors.New("malformed signature header")
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature timestamp outside the tolerance")
+	}
+	if !hmac.Equal([]byte(v1), []byte(signature(secret, t, body))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// backoff is the delay after the attempt-th failure, doubling from initial
+// up to max with up to a fifth of jitter so receivers coming back up are
+// not hit by every retry at once
+func backoff(attempt int, initial time.Duration, max time.Duration) time.Duration {
+	delay := initial
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// claim is a due delivery leased by Poll
+type claim struct {
+	id        int64
+	webhookId int64
+	eventId   uint64
+	eventType string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// Dispatcher queues a delivery for every webhook subscribed to a published
+// event and sends the due deliveries, retrying failures with exponential
+// backoff. Deliveries are stored so retries survive restarts and several
+// instances can share the queue.
+type Dispatcher struct {
+	webhooks *WebhookQuery
+	database *sql.DB
+	logger   *lib.Logger
+	config   lib.WebhookConfig
+	client   *http.Client
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// blockedNetworks are the ranges net.IP has no predicate for that a
+// receiver must not resolve to either
+var blockedNetworks = func() []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // this network
+		"100.64.0.0/10", // carrier-grade NAT
+		"192.0.0.0/24",  // IETF protocol assignments
+		"198.18.0.0/15", // benchmarking
+		"240.0.0.0/4",   // reserved and broadcast
+		"64:ff9b::/96",  // NAT64, maps to any IPv4 address
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// publicIP reports whether ip is routable on the internet, so the server
+// never posts to itself, its cloud metadata endpoint or its private network
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// guard is a net.Dialer Control rejecting connections to addresses that are
+// not public, it runs after the name is resolved so a receiver cannot point
+// its DNS at an internal address
+func guard(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return errors.New("webhook receiver " + host + " is not a public address")
+	}
+	return nil
+}
+
+// NewDispatcher sends deliveries with client, nil uses a client with the
+// configured timeout that only connects to public addresses unless
+// allow_private_networks is set. Tests can pass the client of an
+// httptest.Server so no network is needed.
+func NewDispatcher(database *sql.DB, logger *lib.Logger, config *lib.Config, client *http.Client) *Dispatcher {
+	if client == nil {
+		dialer := &net.Dialer{Timeout: config.Webhooks.Timeout}
+		if !config.Webhooks.AllowPrivateNetworks {
+			dialer.Control = guard
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		// a proxy would make the dialer check the proxy instead of the
+		// receiver
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+		client = &http.Client{
+			Transport: transport,
+			Timeout:   config.Webhooks.Timeout,
+			// a redirect is reported as the receiver's answer instead of
+			// posting the payload somewhere else
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	return &Dispatcher{
+		webhooks: NewWebhookQuery(database, logger),
+		database: database,
+		logger:   logger,
+		config:   config.Webhooks,
+		client:   client,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// notify makes the worker look for due deliveries right away, d may be nil
+// when deliveries are disabled
+func (d *Dispatcher) notify() {
+	if d == nil {
+		return
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run fans the published events out and sends the due deliveries until
+// Shutdown is called
+func (d *Dispatcher) Run() {
+	defer close(d.done)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.listen()
+	}()
+	d.logger.Info("Webhook dispatcher running", "workers", d.config.Workers)
+	ticker := time.NewTicker(d.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.Poll(context.Background()); err != nil {
+			d.logger.Error("Error polling webhook deliveries", "error", err)
+		}
+		select {
+		case <-d.stop:
+			wg.Wait()
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Shutdown waits for the deliveries in flight until ctx expires, the lease
+// of an abandoned delivery runs out and another instance or the next start
+// retries it
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.once.Do(func() { close(d.stop) })
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// listen queues deliveries for the events published through the data
+// layer, synthetic events never touched the database and are skipped
+func (d *Dispatcher) listen() {
+	subscription := events.Default.Subscribe(eventBuffer)
+	defer func() { subscription.Close() }()
+	var lastID uint64
+	for {
+		select {
+		case <-d.stop:
+			return
+		case event, ok := <-subscription.C:
+			if ok {
+				d.enqueue(event)
+				lastID = event.ID
+				continue
+			}
+			// dropped for falling behind, the missed events are still in
+			// the log unless a lot happened at once
+			var missed []events.Event
+			var complete bool
+			subscription, missed, complete = events.Default.SubscribeSince(lastID, eventBuffer)
+			if !complete {
+				d.logger.Warn("Webhook events were lost", "after", lastID)
+			}
+			for _, event := range missed {
+				d.enqueue(event)
+				lastID = event.ID
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(event events.Event) {
+	if event.Simulated || event.Sandbox != "" {
+		return
+	}
+	payload, err := json.Marshal(Payload{Id: event.ID, Type: event.Type, CreatedAt: event.Time, Data: event.Data})
+	if err != nil {
+		d.logger.Error("Error encoding webhook payload", "type", event.Type, "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.Timeout)
+	defer cancel()
+	n, err := d.webhooks.EnqueueEvent(ctx, event.ID, event.Type, payload)
+	if err != nil {
+		d.logger.Error("Error queueing webhook deliveries", "type", event.Type, "error", err)
+		return
+	}
+	if n > 0 {
+		d.notify()
+	}
+}
+
+// Poll sends the due deliveries once, up to Workers at a time, and returns
+// how many were attempted
+func (d *Dispatcher) Poll(ctx context.Context) (int, error) {
+	// the lease outlasts an attempt so a delivery in flight is not claimed
+	// twice
+	lease := (2 * d.config.Timeout).Seconds()
+	rows, err := d.database.QueryContext(ctx, ClaimDeliveriesQuery, d.config.Workers, lease)
+	if err != nil {
+		return 0, err
+	}
+	claims := []claim{}
+	for rows.Next() {
+		c := claim{}
+		var payload string
+		err := rows.Scan(&c.id, &c.webhookId, &c.eventId, &c.eventType, &payload, &c.attempts, &c.url, &c.secret)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		c.payload = []byte(payload)
+		claims = append(claims, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range claims {
+		wg.Add(1)
+		go func(c claim) {
+			defer wg.Done()
+			d.attempt(ctx, c)
+		}(c)
+	}
+	wg.Wait()
+	return len(claims), nil
+}
+
+// post sends one attempt and returns the response status and the start of
+// its body
+func (d *Dispatcher) post(ctx context.Context, c claim) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(c.payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(EventHeader, c.eventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(c.id, 10))
+	req.Header.Set(SignatureHeader, Sign(c.secret, time.Now(), c.payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	// drain a little more so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, string(body), nil
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, c claim) {
+	attempt := c.attempts + 1
+	start := time.Now()
+	code, body, err := d.post(ctx, c)
+	duration := time.Since(start)
+	message := ""
+	if err != nil {
+		message = err.Error()
+	} else if code < 200 || code > 299 {
+		message = "unexpected status " + strconv.Itoa(code)
+	}
+
+	_, dbErr := d.database.ExecContext(ctx, InsertAttemptQuery, c.id, attempt, code, body, message, duration.Milliseconds())
+	if dbErr != nil {
+		d.logger.Error("Error recording webhook attempt", "delivery_id", c.id, "error", dbErr)
+	}
+	if message == "" {
+		_, dbErr = d.database.ExecContext(ctx, MarkDeliveredQuery, c.id, attempt, code)
+		d.logger.Info("Webhook delivered", "delivery_id", c.id, "webhook_id", c.webhookId, "type", c.eventType, "status", code, "attempt", attempt)
+	} else {
+		status := "pending"
+		if attempt >= d.config.MaxAttempts {
+			status = "failed"
+		}
+		delay := backoff(attempt, d.config.InitialBackoff, d.config.MaxBackoff)
+		_, dbErr = d.database.ExecContext(ctx, MarkAttemptFailedQuery, c.id, attempt, code, delay.Seconds(), status)
+		d.logger.Warn("Webhook delivery failed", "delivery_id", c.id, "webhook_id", c.webhookId, "type", c.eventType,
+			"attempt", attempt, "error", message, "status", status, "retry_in", delay)
+	}
+	if dbErr != nil {
+		d.logger.Error("Error updating webhook delivery", "delivery_id", c.id, "error", dbErr)
+	}
+}
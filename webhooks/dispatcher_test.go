@@ -0,0 +1,210 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"nojoke/lib"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		valid  bool
+	}{
+		{"valid", "secret", Sign("secret", now, body), body, true},
+		{"other secret", "other", Sign("secret", now, body), body, false},
+		{"other body", "secret", Sign("secret", now, body), []byte(`{"id":2}`), false},
+		{"too old", "secret", Sign("secret", now.Add(-10*time.Minute), body), body, false},
+		{"from the future", "secret", Sign("secret", now.Add(10*time.Minute), body), body, false},
+		{"no signature", "secret", "t=" + strings.TrimPrefix(strings.Split(Sign("secret", now, body), ",")[0], "t="), body, false},
+		{"garbage", "secret", "nonsense", body, false},
+	}
+	for _, tt := range tests {
+		if err := Verify(tt.secret, tt.header, tt.body, 5*time.Minute); (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{10, time.Minute},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			got := backoff(tt.attempt, 10*time.Second, time.Minute)
+			if got > tt.want || got < tt.want-tt.want/5 {
+				t.Fatalf("backoff(%d) = %v, want %v less up to a fifth", tt.attempt, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::7f00:1", false},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestDefaultClientRefusesLoopback(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer server.Close()
+	config := lib.DefaultConfig()
+	d := NewDispatcher(nil, nil, config, nil)
+	if _, _, err := d.post(context.Background(), claim{url: server.URL}); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("err = %v", err)
+	}
+	config.Webhooks.AllowPrivateNetworks = true
+	d = NewDispatcher(nil, nil, config, nil)
+	if _, _, err := d.post(context.Background(), claim{url: server.URL}); err != nil {
+		t.Errorf("err = %v", err)
+	}
+	if hits != 1 {
+		t.Errorf("receiver got %d requests, want 1", hits)
+	}
+}
+
+func TestPollDeliversAndRetries(t *testing.T) {
+	payload := `{"id":7,"type":"product.created"}`
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify("whsec_test", r.Header.Get(SignatureHeader), body, time.Minute); err != nil {
+			t.Errorf("signature: %v", err)
+		}
+		if string(body) != payload || r.Header.Get(EventHeader) != "product.created" || r.Header.Get(DeliveryHeader) != "3" {
+			t.Errorf("unexpected delivery %s %v", body, r.Header)
+		}
+		// the receiver is down for the first attempt
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "try later")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	config := lib.DefaultConfig()
+	logger := lib.NewLogger(nil, lib.LogConfig{Level: "error"})
+	d := NewDispatcher(database, logger, config, server.Client())
+
+	columns := []string{"id", "webhook_id", "event_id", "event_type", "payload", "attempts", "url", "secret"}
+	claimed := func(attempts int) {
+		mock.ExpectQuery(regexp.QuoteMeta(ClaimDeliveriesQuery)).
+			WithArgs(config.Webhooks.Workers, (2 * config.Webhooks.Timeout).Seconds()).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(3, 1, 7, "product.created", payload, attempts, server.URL, "whsec_test"))
+	}
+
+	claimed(0)
+	mock.ExpectExec(regexp.QuoteMeta(InsertAttemptQuery)).
+		WithArgs(3, 1, http.StatusServiceUnavailable, "try later", "unexpected status 503", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(MarkAttemptFailedQuery)).
+		WithArgs(3, 1, http.StatusServiceUnavailable, sqlmock.AnyArg(), "pending").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if n, err := d.Poll(context.Background()); err != nil || n != 1 {
+		t.Fatalf("first poll: %d, %v", n, err)
+	}
+
+	claimed(1)
+	mock.ExpectExec(regexp.QuoteMeta(InsertAttemptQuery)).
+		WithArgs(3, 2, http.StatusNoContent, "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(MarkDeliveredQuery)).
+		WithArgs(3, 2, http.StatusNoContent).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if n, err := d.Poll(context.Background()); err != nil || n != 1 {
+		t.Fatalf("second poll: %d, %v", n, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if calls != 2 {
+		t.Errorf("receiver got %d requests, want 2", calls)
+	}
+}
+
+func TestPollGivesUpAfterMaxAttempts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	config := lib.DefaultConfig()
+	logger := lib.NewLogger(nil, lib.LogConfig{Level: "error"})
+	d := NewDispatcher(database, logger, config, server.Client())
+
+	mock.ExpectQuery(regexp.QuoteMeta(ClaimDeliveriesQuery)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "webhook_id", "event_id", "event_type", "payload", "attempts", "url", "secret"}).
+			AddRow(3, 1, 7, "user.deleted", `{}`, config.Webhooks.MaxAttempts-1, server.URL, "whsec_test"))
+	mock.ExpectExec(regexp.QuoteMeta(InsertAttemptQuery)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(MarkAttemptFailedQuery)).
+		WithArgs(3, config.Webhooks.MaxAttempts, http.StatusInternalServerError, sqlmock.AnyArg(), "failed").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := d.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,172 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"nojoke/lib"
+
+	"github.com/lib/pq"
+)
+
+type WebhookQuery struct {
+	database *sql.DB
+	logger   *lib.Logger
+}
+
+func NewWebhookQuery(database *sql.DB, logger *lib.Logger) *WebhookQuery {
+	return &WebhookQuery{database: database, logger: logger}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	webhook := Webhook{}
+	err := row.Scan(
+		&webhook.Id,
+		&webhook.URL,
+		(*pq.StringArray)(&webhook.Events),
+		&webhook.Secret,
+		&webhook.Active,
+		&webhook.CreatedAt,
+		&webhook.UpdatedAt,
+	)
+	return webhook, err
+}
+
+func scanDelivery(row rowScanner) (Delivery, error) {
+	delivery := Delivery{}
+	var payload string
+	err := row.Scan(
+		&delivery.Id,
+		&delivery.WebhookId,
+		&delivery.EventId,
+		&delivery.EventType,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.ResponseCode,
+		&delivery.NextAttemptAt,
+		&delivery.DeliveredAt,
+		&delivery.CreatedAt,
+	)
+	delivery.Payload = []byte(payload)
+	return delivery, err
+}
+
+func (q *WebhookQuery) List(ctx context.Context) ([]Webhook, error) {
+	rows, err := q.database.QueryContext(ctx, GetWebhooksQuery)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error getting webhooks", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	webhooks := []Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// FindOne returns sql.ErrNoRows when the webhook does not exist
+func (q *WebhookQuery) FindOne(ctx context.Context, id int64) (Webhook, error) {
+	return scanWebhook(q.database.QueryRowContext(ctx, GetWebhookQuery, id))
+}
+
+func (q *WebhookQuery) Create(ctx context.Context, webhook Webhook) (Webhook, error) {
+	return scanWebhook(q.database.QueryRowContext(ctx, InsertWebhookQuery,
+		webhook.URL, pq.Array(webhook.Events), webhook.Secret, webhook.Active,
+	))
+}
+
+// Update returns the stored record, or sql.ErrNoRows when the webhook does
+// not exist
+func (q *WebhookQuery) Update(ctx context.Context, webhook Webhook) (Webhook, error) {
+	return scanWebhook(q.database.QueryRowContext(ctx, UpdateWebhookQuery,
+		webhook.Id, webhook.URL, pq.Array(webhook.Events), webhook.Secret, webhook.Active,
+	))
+}
+
+// Delete removes the webhook with its deliveries, sql.ErrNoRows when it
+// does not exist
+func (q *WebhookQuery) Delete(ctx context.Context, id int64) error {
+	result, err := q.database.ExecContext(ctx, DeleteWebhookQuery, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Deliveries returns a page of the deliveries of a webhook, newest first,
+// and sets pagination.Total
+func (q *WebhookQuery) Deliveries(ctx context.Context, webhookId int64, pagination *lib.Pagination) ([]Delivery, error) {
+	err := q.database.QueryRowContext(ctx, CountDeliveriesQuery, webhookId).Scan(&pagination.Total)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error counting webhook deliveries", "error", err)
+		return nil, err
+	}
+	offset := (pagination.Page - 1) * pagination.Limit
+	rows, err := q.database.QueryContext(ctx, GetDeliveriesQuery, webhookId, pagination.Limit, offset)
+	if err != nil {
+		q.logger.ErrorContext(ctx, "Error getting webhook deliveries", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// FindDelivery returns the delivery with its attempts, sql.ErrNoRows when it
+// does not exist
+func (q *WebhookQuery) FindDelivery(ctx context.Context, id int64) (Delivery, error) {
+	delivery, err := scanDelivery(q.database.QueryRowContext(ctx, GetDeliveryQuery, id))
+	if err != nil {
+		return delivery, err
+	}
+	rows, err := q.database.QueryContext(ctx, GetAttemptsQuery, id)
+	if err != nil {
+		return delivery, err
+	}
+	defer rows.Close()
+	delivery.AttemptLog = []Attempt{}
+	for rows.Next() {
+		attempt := Attempt{}
+		err := rows.Scan(&attempt.Attempt, &attempt.ResponseCode, &attempt.ResponseBody, &attempt.Error, &attempt.DurationMs, &attempt.CreatedAt)
+		if err != nil {
+			return delivery, err
+		}
+		delivery.AttemptLog = append(delivery.AttemptLog, attempt)
+	}
+	return delivery, rows.Err()
+}
+
+// Enqueue queues a delivery to a single webhook, for pings and
+// redeliveries
+func (q *WebhookQuery) Enqueue(ctx context.Context, webhookId int64, eventId uint64, eventType string, payload []byte) (Delivery, error) {
+	return scanDelivery(q.database.QueryRowContext(ctx, InsertDeliveryQuery, webhookId, int64(eventId), eventType, string(payload)))
+}
+
+// EnqueueEvent queues a delivery to every active webhook subscribed to the
+// event type and returns how many were queued
+func (q *WebhookQuery) EnqueueEvent(ctx context.Context, eventId uint64, eventType string, payload []byte) (int64, error) {
+	result, err := q.database.ExecContext(ctx, InsertDeliveriesForEventQuery, int64(eventId), eventType, string(payload))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,162 @@
+package webhooks
+
+const CreateWebhookTablesQuery = `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		url TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		secret VARCHAR(255) NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TRIGGER webhooks_set_updated_at BEFORE UPDATE ON webhooks
+		FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event_id BIGINT NOT NULL,
+		event_type VARCHAR(255) NOT NULL,
+		payload TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		response_code INTEGER,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		delivered_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due
+		ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook
+		ON webhook_deliveries (webhook_id, id);
+
+	CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id SERIAL PRIMARY KEY,
+		delivery_id INTEGER NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+		attempt INTEGER NOT NULL,
+		response_code INTEGER,
+		response_body TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS webhook_attempts_delivery
+		ON webhook_attempts (delivery_id, attempt);
+`
+
+const DropWebhookTablesQuery = `
+	DROP TABLE IF EXISTS webhook_attempts;
+	DROP TABLE IF EXISTS webhook_deliveries;
+	DROP TABLE IF EXISTS webhooks;
+`
+
+const webhookColumns = `id, url, events, secret, active, created_at, updated_at`
+
+const GetWebhooksQuery = `
+	SELECT ` + webhookColumns + `
+	FROM webhooks
+	ORDER BY id;
+`
+
+const GetWebhookQuery = `
+	SELECT ` + webhookColumns + `
+	FROM webhooks
+	WHERE id = $1;
+`
+
+const InsertWebhookQuery = `
+	INSERT INTO webhooks (url, events, secret, active)
+	VALUES ($1, $2, $3, $4)
+	RETURNING ` + webhookColumns + `;
+`
+
+const UpdateWebhookQuery = `
+	UPDATE webhooks
+	SET url = $2, events = $3, secret = $4, active = $5
+	WHERE id = $1
+	RETURNING ` + webhookColumns + `;
+`
+
+const DeleteWebhookQuery = `
+	DELETE FROM webhooks WHERE id = $1;
+`
+
+// queues a delivery of the event for every active webhook subscribed to its
+// type or to *
+const InsertDeliveriesForEventQuery = `
+	INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+	SELECT id, $1::BIGINT, $2::VARCHAR, $3::TEXT
+	FROM webhooks
+	WHERE active AND ($2 = ANY(events) OR '*' = ANY(events));
+`
+
+const deliveryColumns = `id, webhook_id, event_id, event_type, payload, status, attempts,
+	COALESCE(response_code, 0), next_attempt_at, delivered_at, created_at`
+
+const InsertDeliveryQuery = `
+	INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+	VALUES ($1, $2, $3, $4)
+	RETURNING ` + deliveryColumns + `;
+`
+
+// claims up to $1 due deliveries and pushes their next attempt $2 seconds
+// out, so another instance does not pick them up while they are in flight
+const ClaimDeliveriesQuery = `
+	UPDATE webhook_deliveries d
+	SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+	FROM webhooks w
+	WHERE w.id = d.webhook_id AND d.id IN (
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY next_attempt_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.attempts, w.url, w.secret;
+`
+
+const InsertAttemptQuery = `
+	INSERT INTO webhook_attempts (delivery_id, attempt, response_code, response_body, error, duration_ms)
+	VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6);
+`
+
+const MarkDeliveredQuery = `
+	UPDATE webhook_deliveries
+	SET status = 'succeeded', attempts = $2, response_code = NULLIF($3, 0), delivered_at = CURRENT_TIMESTAMP
+	WHERE id = $1;
+`
+
+// $4 is the delay in seconds before the next attempt, ignored once the
+// delivery failed for good
+const MarkAttemptFailedQuery = `
+	UPDATE webhook_deliveries
+	SET status = $5, attempts = $2, response_code = NULLIF($3, 0),
+		next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $4)
+	WHERE id = $1;
+`
+
+const CountDeliveriesQuery = `
+	SELECT COUNT(*) FROM webhook_deliveries WHERE webhook_id = $1;
+`
+
+const GetDeliveriesQuery = `
+	SELECT ` + deliveryColumns + `
+	FROM webhook_deliveries
+	WHERE webhook_id = $1
+	ORDER BY id DESC
+	LIMIT $2 OFFSET $3;
+`
+
+const GetDeliveryQuery = `
+	SELECT ` + deliveryColumns + `
+	FROM webhook_deliveries
+	WHERE id = $1;
+`
+
+const GetAttemptsQuery = `
+	SELECT attempt, COALESCE(response_code, 0), response_body, error, duration_ms, created_at
+	FROM webhook_attempts
+	WHERE delivery_id = $1
+	ORDER BY attempt;
+`
@@ -0,0 +1,431 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"nojoke/auth"
+	"nojoke/lib"
+	"nojoke/openapi"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EventTypes are the events webhooks can subscribe to, * subscribes to
+// every one of them. There is no order.paid, this API has no orders.
+var EventTypes = []string{
+	"product.created", "product.updated", "product.deleted",
+	"user.created", "user.updated", "user.deleted",
+}
+
+type Webhook struct {
+	Id        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookForm registers or replaces a webhook, a secret is generated when
+// Secret is empty on creation and kept when it is empty on update
+type WebhookForm struct {
+	URL    string   `json:"url" validate:"required"`
+	Events []string `json:"events" validate:"required"`
+	Secret string   `json:"secret"`
+	Active *bool    `json:"active"`
+}
+
+type Attempt struct {
+	Attempt      int       `json:"attempt"`
+	ResponseCode int       `json:"response_code"`
+	ResponseBody string    `json:"response_body"`
+	Error        string    `json:"error"`
+	DurationMs   int64     `json:"duration_ms"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Delivery is one event queued for a webhook, Status is pending, succeeded
+// or failed
+type Delivery struct {
+	Id            int64           `json:"id"`
+	WebhookId     int64           `json:"webhook_id"`
+	EventId       uint64          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	ResponseCode  int             `json:"response_code"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	// only filled in when a single delivery is requested
+	AttemptLog []Attempt `json:"attempt_log,omitempty"`
+}
+
+func (f WebhookForm) validate() error {
+	u, err := url.Parse(f.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	for _, event := range f.Events {
+		if event == "*" {
+			continue
+		}
+		known := false
+		for _, eventType := range EventTypes {
+			known = known || event == eventType
+		}
+		if !known {
+			return errors.New("Unknown event " + event + ", expected * or one of " + strings.Join(EventTypes, ", "))
+		}
+	}
+	return nil
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(lib.NewErrorResponse(401, "Unauthorized"))
+}
+
+func parseId(r *http.Request) (int64, error) {
+	return strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+}
+
+// readForm decodes and validates the body, answering 400 when it is invalid
+func readForm(w http.ResponseWriter, r *http.Request) (WebhookForm, bool) {
+	form := WebhookForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return form, false
+	}
+	if isValid, message := lib.ValidateForm(form); !isValid {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, message))
+		return form, false
+	}
+	if err := form.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, err.Error()))
+		return form, false
+	}
+	return form, true
+}
+
+// findWebhook answers 400, 404 or 500 when the webhook of the {id} route
+// variable cannot be loaded
+func findWebhook(w http.ResponseWriter, r *http.Request, q *WebhookQuery) (Webhook, bool) {
+	id, err := parseId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid Id"))
+		return Webhook{}, false
+	}
+	webhook, err := q.FindOne(r.Context(), id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Webhook not found"))
+		return webhook, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error getting webhook"))
+		return webhook, false
+	}
+	return webhook, true
+}
+
+// findDelivery is findWebhook for deliveries, with their attempts
+func findDelivery(w http.ResponseWriter, r *http.Request, q *WebhookQuery) (Delivery, bool) {
+	id, err := parseId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid Id"))
+		return Delivery{}, false
+	}
+	delivery, err := q.FindDelivery(r.Context(), id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Delivery not found"))
+		return delivery, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error getting delivery"))
+		return delivery, false
+	}
+	return delivery, true
+}
+
+func handleGet(w http.ResponseWriter, r *http.Request, admin *auth.Admin, q *WebhookQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	webhooks, err := q.List(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error getting webhooks"))
+		return
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", webhooks))
+}
+
+func handleFindOne(w http.ResponseWriter, r *http.Request, admin *auth.Admin, q *WebhookQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	webhook, ok := findWebhook(w, r, q)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", webhook))
+}
+
+func handlePost(w http.ResponseWriter, r *http.Request, admin *auth.Admin, q *WebhookQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	form, ok := readForm(w, r)
+	if !ok {
+		return
+	}
+	webhook := Webhook{URL: form.URL, Events: form.Events, Secret: form.Secret, Active: true}
+	if form.Active != nil {
+		webhook.Active = *form.Active
+	}
+	if webhook.Secret == "" {
+		secret, err := generateSecret()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error creating webhook"))
+			return
+		}
+		webhook.Secret = secret
+	}
+	webhook, err := q.Create(r.Context(), webhook)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error creating webhook"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lib.NewDataResponse(201, "OK", webhook))
+}
+
+func handlePut(w http.ResponseWriter, r *http.Request, admin *auth.Admin, q *WebhookQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	webhook, ok := findWebhook(w, r, q)
+	if !ok {
+		return
+	}
+	form, ok := readForm(w, r)
+	if !ok {
+		return
+	}
+	webhook.URL = form.URL
+	webhook.Events = form.Events
+	if form.Secret != "" {
+		webhook.Secret = form.Secret
+	}
+	if form.Active != nil {
+		webhook.Active = *form.Active
+	}
+	webhook, err := q.Update(r.Context(), webhook)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Webhook not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error updating webhook"))
+		return
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", webhook))
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, admin *auth.Admin, q *WebhookQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	id, err := parseId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid Id"))
+		return
+	}
+	err = q.Delete(r.Context(), id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(404, "Webhook not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error deleting webhook"))
+		return
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "DELETED", nil))
+}
+
+func handleDeliveries(w http.ResponseWriter, r *http.Request, admin *auth.Admin, q *WebhookQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if r.URL.Query().Get("limit") == "" {
+		limit, err = 10, nil
+	}
+	page, pageErr := strconv.Atoi(r.URL.Query().Get("page"))
+	if r.URL.Query().Get("page") == "" {
+		page, pageErr = 1, nil
+	}
+	if err != nil || pageErr != nil || limit < 1 || limit > 100 || page < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(400, "Invalid query params"))
+		return
+	}
+	webhook, ok := findWebhook(w, r, q)
+	if !ok {
+		return
+	}
+	pagination := lib.Pagination{Limit: limit, Page: page}
+	deliveries, err := q.Deliveries(r.Context(), webhook.Id, &pagination)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error getting deliveries"))
+		return
+	}
+	json.NewEncoder(w).Encode(lib.DataResponse{Status: 200, Message: "OK", Data: deliveries, Pagination: pagination})
+}
+
+func handleFindDelivery(w http.ResponseWriter, r *http.Request, admin *auth.Admin, q *WebhookQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	delivery, ok := findDelivery(w, r, q)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(lib.NewDataResponse(200, "OK", delivery))
+}
+
+// handleRedeliver queues the payload of a delivery again as a new delivery,
+// whatever the state of the original
+func handleRedeliver(w http.ResponseWriter, r *http.Request, admin *auth.Admin, q *WebhookQuery, d *Dispatcher) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	original, ok := findDelivery(w, r, q)
+	if !ok {
+		return
+	}
+	delivery, err := q.Enqueue(r.Context(), original.WebhookId, original.EventId, original.EventType, original.Payload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error queueing delivery"))
+		return
+	}
+	d.notify()
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lib.NewDataResponse(201, "OK", delivery))
+}
+
+// handlePing queues a ping event for a webhook regardless of its events,
+// to check that the receiver is reachable and verifies signatures
+func handlePing(w http.ResponseWriter, r *http.Request, admin *auth.Admin, q *WebhookQuery, d *Dispatcher) {
+	w.Header().Set("Content-Type", "application/json")
+	if admin == nil {
+		unauthorized(w)
+		return
+	}
+	webhook, ok := findWebhook(w, r, q)
+	if !ok {
+		return
+	}
+	payload, _ := json.Marshal(Payload{Type: "ping", CreatedAt: time.Now().UTC(), Data: map[string]int64{"webhook_id": webhook.Id}})
+	delivery, err := q.Enqueue(r.Context(), webhook.Id, 0, "ping", payload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(lib.NewErrorResponse(500, "Error queueing delivery"))
+		return
+	}
+	d.notify()
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lib.NewDataResponse(201, "OK", delivery))
+}
+
+// InitWebhookRouter serves the webhook admin API, d may be nil when
+// deliveries are disabled and queued deliveries then wait for an instance
+// that sends them
+func InitWebhookRouter(mux *mux.Router, database *sql.DB, logger *lib.Logger, config *lib.Config, d *Dispatcher) {
+	router := mux.PathPrefix("/api/admin/webhooks").Subrouter()
+	q := NewWebhookQuery(database, logger)
+	handle := func(path string, method string, handler func(http.ResponseWriter, *http.Request, *auth.Admin), operation openapi.Operation) {
+		operation.Tags = []string{"webhooks"}
+		operation.Auth = true
+		openapi.Describe(router.Handle(path, auth.Verified(config.Auth.JWTSecret, handler)).Methods(method), operation)
+	}
+	handle("", "GET", func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleGet(w, r, a, q)
+	}, openapi.Operation{Summary: "List the webhooks", Response: Webhook{}, List: true})
+	handle("", "POST", func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handlePost(w, r, a, q)
+	}, openapi.Operation{Summary: "Register a webhook for product.*, user.* or * events", Request: WebhookForm{}, Response: Webhook{}})
+	handle("/deliveries/{id}", "GET", func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleFindDelivery(w, r, a, q)
+	}, openapi.Operation{Summary: "Get a delivery with every attempt", Response: Delivery{}})
+	handle("/deliveries/{id}/redeliver", "POST", func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleRedeliver(w, r, a, q, d)
+	}, openapi.Operation{Summary: "Send the payload of a delivery again as a new delivery", Response: Delivery{}})
+	handle("/{id}", "GET", func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleFindOne(w, r, a, q)
+	}, openapi.Operation{Summary: "Get a webhook", Response: Webhook{}})
+	handle("/{id}", "PUT", func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handlePut(w, r, a, q)
+	}, openapi.Operation{Summary: "Replace a webhook, an empty secret keeps the current one", Request: WebhookForm{}, Response: Webhook{}})
+	handle("/{id}", "DELETE", func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleDelete(w, r, a, q)
+	}, openapi.Operation{Summary: "Delete a webhook with its deliveries"})
+	handle("/{id}/deliveries", "GET", func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handleDeliveries(w, r, a, q)
+	}, openapi.Operation{Summary: "List the deliveries of a webhook, newest first", Response: Delivery{}, List: true})
+	handle("/{id}/ping", "POST", func(w http.ResponseWriter, r *http.Request, a *auth.Admin) {
+		handlePing(w, r, a, q, d)
+	}, openapi.Operation{Summary: "Send a ping event to a webhook", Response: Delivery{}})
+}